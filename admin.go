@@ -0,0 +1,159 @@
+package triblab
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+)
+
+// What a node reports on its admin address.
+type adminNode struct {
+	// nil when the node is ready to take requests
+	ready func() error
+
+	// writes the node's metrics in the Prometheus text format
+	metrics func(w io.Writer)
+
+	// served at /debug/traces if not nil
+	traces *Tracer
+}
+
+// Serves /healthz, /readyz, /metrics, /debug/pprof/ and, with a tracer,
+// /debug/traces on addr.
+func serveAdmin(addr string, node *adminNode) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		e := node.ready()
+		if e != nil {
+			http.Error(w, e.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		node.metrics(w)
+	})
+	if node.traces != nil {
+		mux.HandleFunc("/debug/traces", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			node.traces.Export(w)
+		})
+	}
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	l, e := net.Listen("tcp", addr)
+	if e != nil {
+		return e
+	}
+	go http.Serve(l, mux)
+	return nil
+}
+
+// A set-once flag for readiness.
+type readyFlag struct {
+	lock sync.Mutex
+	set  bool
+}
+
+func (self *readyFlag) mark() {
+	self.lock.Lock()
+	self.set = true
+	self.lock.Unlock()
+}
+
+func (self *readyFlag) check(what string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.set {
+		return fmt.Errorf("%s not ready", what)
+	}
+	return nil
+}
+
+func writeGauge(w io.Writer, name, help string, v interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, v)
+}
+
+// Writes the call counters of m, described as help.
+func writeCallMetrics(w io.Writer, m *Metrics, help string) {
+	stats := m.Snapshot()
+	methods := m.Methods()
+
+	fmt.Fprintf(w, "# HELP triblab_rpc_calls_total %s.\n", help)
+	fmt.Fprintf(w, "# TYPE triblab_rpc_calls_total counter\n")
+	for _, name := range methods {
+		fmt.Fprintf(w, "triblab_rpc_calls_total{method=%q} %d\n", name, stats[name].Calls)
+	}
+
+	fmt.Fprintf(w, "# HELP triblab_rpc_errors_total %s that failed.\n", help)
+	fmt.Fprintf(w, "# TYPE triblab_rpc_errors_total counter\n")
+	for _, name := range methods {
+		fmt.Fprintf(w, "triblab_rpc_errors_total{method=%q} %d\n", name, stats[name].Errors)
+	}
+
+	fmt.Fprintf(w, "# HELP triblab_rpc_latency_seconds Latency of %s.\n", help)
+	fmt.Fprintf(w, "# TYPE triblab_rpc_latency_seconds histogram\n")
+	for _, name := range methods {
+		st := stats[name]
+		var n int64
+		for i, bound := range LATENCY_BUCKETS {
+			n += st.Buckets[i]
+			fmt.Fprintf(w, "triblab_rpc_latency_seconds_bucket{method=%q,le=\"%g\"} %d\n",
+				name, bound.Seconds(), n)
+		}
+		fmt.Fprintf(w, "triblab_rpc_latency_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", name, st.Calls)
+		fmt.Fprintf(w, "triblab_rpc_latency_seconds_sum{method=%q} %g\n", name, st.Total.Seconds())
+		fmt.Fprintf(w, "triblab_rpc_latency_seconds_count{method=%q} %d\n", name, st.Calls)
+	}
+}
+
+// Metrics of a backend: its calls, key counts and clock.
+func backMetrics(back *backend, m *Metrics) func(w io.Writer) {
+	return func(w io.Writer) {
+		writeCallMetrics(w, m, "Storage calls served")
+
+		keys, lists, clk := back.stats()
+		writeGauge(w, "triblab_keys", "String keys stored.", keys)
+		writeGauge(w, "triblab_lists", "Lists stored.", lists)
+		writeGauge(w, "triblab_clock", "Logical clock of the backend.", clk)
+	}
+}
+
+// Metrics of a keeper: its calls to backends and its view of the
+// cluster.
+func (self *Keeper) metrics(m *Metrics) func(w io.Writer) {
+	return func(w io.Writer) {
+		writeCallMetrics(w, m, "Storage calls made to backends")
+
+		self.lock.Lock()
+		defer self.lock.Unlock()
+
+		leader := 0
+		if self.leader {
+			leader = 1
+		}
+		alive := 0
+		for _, b := range self.state.Backs {
+			if b.Alive {
+				alive++
+			}
+		}
+		writeGauge(w, "triblab_keeper_leader", "1 if this keeper is the leader.", leader)
+		writeGauge(w, "triblab_keeper_epoch", "Membership epoch.", self.state.Epoch)
+		writeGauge(w, "triblab_clock", "Highest backend clock synced.", self.state.Clock)
+		writeGauge(w, "triblab_keeper_backs", "Backends configured.", len(self.state.Backs))
+		writeGauge(w, "triblab_keeper_backs_alive", "Backends alive in the last sync.", alive)
+		writeGauge(w, "triblab_keeper_migrations", "Bin migrations in progress.", len(self.state.Migrations))
+	}
+}
@@ -0,0 +1,145 @@
+package triblab_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"trib"
+	"trib/randaddr"
+	"trib/store"
+	"triblab"
+)
+
+func httpGet(t *testing.T, url string) (int, string) {
+	resp, e := http.Get(url)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer resp.Body.Close()
+	body, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestAdmin(t *testing.T) {
+	addr := randaddr.Local()
+	admin := randaddr.Local()
+	for admin == addr {
+		admin = randaddr.Local()
+	}
+	ready := make(chan bool)
+	go func() {
+		b := &trib.BackConfig{Addr: addr, Store: store.NewStorage(), Ready: ready}
+		e := triblab.ServeBackWith(b, &triblab.BackOptions{AdminAddr: admin})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-ready {
+		t.Fatal("not ready")
+	}
+
+	for _, path := range []string{"/healthz", "/readyz", "/debug/pprof/"} {
+		if code, body := httpGet(t, "http://"+admin+path); code != http.StatusOK {
+			t.Fatalf("%s: %d %s", path, code, body)
+		}
+	}
+
+	c := triblab.NewClient(addr)
+	var succ bool
+	if e := c.Set(trib.KV("k", "v"), &succ); e != nil {
+		t.Fatal(e)
+	}
+	if e := c.ListAppend(trib.KV("l", "v"), &succ); e != nil {
+		t.Fatal(e)
+	}
+	var clk uint64
+	if e := c.Clock(41, &clk); e != nil {
+		t.Fatal(e)
+	}
+
+	// scraping reads the clock without moving it
+	var metrics string
+	for i := 0; i < 2; i++ {
+		_, metrics = httpGet(t, "http://"+admin+"/metrics")
+		for _, want := range []string{
+			`triblab_rpc_calls_total{method="Set"} 1`,
+			`triblab_rpc_latency_seconds_count{method="Clock"} 1`,
+			`triblab_rpc_latency_seconds_bucket{method="Set",le="+Inf"} 1`,
+			"triblab_keys 1",
+			"triblab_lists 1",
+			"triblab_clock 41",
+		} {
+			if !strings.Contains(metrics, want) {
+				t.Fatalf("no %q in metrics:\n%s", want, metrics)
+			}
+		}
+	}
+
+	// and counts what goes away
+	var n int
+	if e := c.Set(trib.KV("k", ""), &succ); e != nil {
+		t.Fatal(e)
+	}
+	if e := c.ListRemove(trib.KV("l", "v"), &n); e != nil {
+		t.Fatal(e)
+	}
+	_, metrics = httpGet(t, "http://"+admin+"/metrics")
+	if !strings.Contains(metrics, "triblab_keys 0") || !strings.Contains(metrics, "triblab_lists 0") {
+		t.Fatalf("removed keys still counted:\n%s", metrics)
+	}
+
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	kaddr := randaddr.Local()
+	kadmin := randaddr.Local()
+	for kaddr == addr || kaddr == admin || kadmin == addr || kadmin == admin || kadmin == kaddr {
+		kaddr = randaddr.Local()
+		kadmin = randaddr.Local()
+	}
+	readyk := make(chan bool)
+	go func() {
+		e := triblab.ServeKeeperWith(&trib.KeeperConfig{
+			Backs: []string{addr},
+			Addrs: []string{kaddr},
+			Ready: readyk,
+		}, &triblab.KeeperOptions{StateDir: dir, AdminAddr: kadmin})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-readyk {
+		t.Fatal("keeper not ready")
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		code, _ := httpGet(t, "http://"+kadmin+"/readyz")
+		_, metrics = httpGet(t, "http://"+kadmin+"/metrics")
+		// ready once elected, then syncing clocks
+		if code == http.StatusOK && strings.Contains(metrics, `triblab_rpc_calls_total{method="Clock"}`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("keeper not ready: %d\n%s", code, metrics)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, want := range []string{
+		"triblab_keeper_leader 1",
+		"triblab_keeper_backs_alive 1",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Fatalf("no %q in keeper metrics:\n%s", want, metrics)
+		}
+	}
+}
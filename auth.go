@@ -0,0 +1,370 @@
+package triblab
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"trib"
+)
+
+// Life of the tokens that tools sign for a run.
+const TOKEN_TTL = time.Hour
+
+// Operations a caller may be allowed on a bin.
+const (
+	ACL_READ  = "read"
+	ACL_WRITE = "write"
+)
+
+// Caller authentication and authorization of a backend. Tokens can be
+// replayed by whoever sees them until they expire, so serve with TLS.
+type AuthConfig struct {
+	// Key that caller tokens are signed with, see NewToken.
+	Secret string
+
+	// Rules of each caller identity. Callers not listed are refused.
+	ACL map[string][]ACLRule
+}
+
+// Lets a caller do Ops on the bins whose names start with Prefix. Keys
+// outside of any bin, such as the placement table, count as a bin of
+// their own name. Calls that span all bins, like listing the prepared
+// transactions, need an empty Prefix.
+type ACLRule struct {
+	Prefix string
+	Ops    []string // ACL_READ and/or ACL_WRITE
+}
+
+// Reads the "Auth" section of an rc file such as bins.rc. Returns nil
+// when the section is missing, meaning anyone may do anything.
+func LoadAuth(rcPath string) (*AuthConfig, error) {
+	bytes, e := ioutil.ReadFile(rcPath)
+	if e != nil {
+		return nil, e
+	}
+
+	var rc struct {
+		Auth *AuthConfig
+	}
+	e = json.Unmarshal(bytes, &rc)
+	if e != nil {
+		return nil, e
+	}
+	return rc.Auth, nil
+}
+
+func tokenMAC(secret []byte, who string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(who))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Signs a token for caller identity who, to be given to clients as
+// ClientOptions.Token, good until expires, or for ever if zero. Whoever
+// gets hold of a token calls as who until then, so tokens should only go
+// over TLS, and those that never expire are for services that hold the
+// secret anyway, such as the keepers.
+func NewToken(secret, who string, expires time.Time) string {
+	var exp int64
+	if !expires.IsZero() {
+		exp = expires.Unix()
+	}
+	signed := who + ":" + strconv.FormatInt(exp, 10)
+	return signed + ":" + tokenMAC([]byte(secret), signed)
+}
+
+// Returns the identity a token was signed for, unless it expired by now.
+func verifyToken(secret []byte, token string, now time.Time) (string, error) {
+	i := strings.LastIndex(token, ":")
+	j := -1
+	if i > 0 {
+		j = strings.LastIndex(token[:i], ":")
+	}
+	if j <= 0 {
+		return "", fmt.Errorf("missing or malformed caller token")
+	}
+
+	signed, who := token[:i], token[:j]
+	if !hmac.Equal([]byte(token[i+1:]), []byte(tokenMAC(secret, signed))) {
+		return "", fmt.Errorf("bad caller token for %q", who)
+	}
+	exp, e := strconv.ParseInt(token[j+1:i], 10, 64)
+	if e != nil {
+		return "", fmt.Errorf("missing or malformed caller token")
+	}
+	if exp != 0 && now.Unix() >= exp {
+		return "", fmt.Errorf("caller token for %q expired", who)
+	}
+	return who, nil
+}
+
+// Hands each caller a server whose Storage checks the caller's rules.
+type authority struct {
+	secret []byte
+	acl    map[string][]ACLRule
+	s      Storage  // what callers get to
+	back   *backend // underneath s
+
+	lock    sync.Mutex
+	servers map[string]*rpc.Server // by identity
+}
+
+func newAuthority(conf *AuthConfig, s Storage, back *backend) (*authority, error) {
+	if conf.Secret == "" {
+		return nil, fmt.Errorf("auth needs a secret")
+	}
+	for who, rules := range conf.ACL {
+		for _, r := range rules {
+			for _, op := range r.Ops {
+				if op != ACL_READ && op != ACL_WRITE {
+					return nil, fmt.Errorf("unknown op %q for %q", op, who)
+				}
+			}
+		}
+	}
+
+	return &authority{
+		secret:  []byte(conf.Secret),
+		acl:     conf.ACL,
+		s:       s,
+		back:    back,
+		servers: make(map[string]*rpc.Server),
+	}, nil
+}
+
+// A serverFor.
+func (self *authority) server(token string) (*rpc.Server, string, error) {
+	who, e := verifyToken(self.secret, token, self.back.sim.time())
+	if e != nil {
+		return nil, "", e
+	}
+	rules, found := self.acl[who]
+	if !found {
+		return nil, "", fmt.Errorf("unknown caller %q", who)
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	srv, found := self.servers[who]
+	if found {
+		return srv, who, nil
+	}
+	srv = rpc.NewServer()
+	e = srv.RegisterName("Storage", &guard{s: self.s, back: self.back, who: who, rules: rules})
+	if e != nil {
+		return nil, "", e
+	}
+	self.servers[who] = srv
+	return srv, who, nil
+}
+
+// The storage as one caller sees it.
+type guard struct {
+	s     Storage
+	back  *backend // to look at prepared transactions
+	who   string
+	rules []ACLRule
+}
+
+func binOf(key string) string {
+	return strings.SplitN(key, "::", 2)[0]
+}
+
+// Checks that the caller may do op on everything starting with prefix.
+func (self *guard) check(op, prefix string) error {
+	for _, r := range self.rules {
+		if !strings.HasPrefix(prefix, r.Prefix) {
+			continue
+		}
+		for _, o := range r.Ops {
+			if o == op {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s may not %s %q", self.who, op, prefix)
+}
+
+func (self *guard) checkKey(op, key string) error {
+	return self.check(op, binOf(key))
+}
+
+func (self *guard) checkTxn(reads []TxnRead, writes []TxnWrite) error {
+	for _, r := range reads {
+		e := self.checkKey(ACL_READ, r.Key)
+		if e != nil {
+			return e
+		}
+	}
+	for _, w := range writes {
+		e := self.checkKey(ACL_WRITE, w.Key)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (self *guard) Get(key string, value *string) error {
+	if e := self.checkKey(ACL_READ, key); e != nil {
+		return e
+	}
+	return self.s.Get(key, value)
+}
+
+func (self *guard) Set(kv *trib.KeyValue, succ *bool) error {
+	if e := self.checkKey(ACL_WRITE, kv.Key); e != nil {
+		return e
+	}
+	return self.s.Set(kv, succ)
+}
+
+func (self *guard) Keys(p *trib.Pattern, list *trib.List) error {
+	if e := self.check(ACL_READ, p.Prefix); e != nil {
+		return e
+	}
+	return self.s.Keys(p, list)
+}
+
+func (self *guard) ListGet(key string, list *trib.List) error {
+	if e := self.checkKey(ACL_READ, key); e != nil {
+		return e
+	}
+	return self.s.ListGet(key, list)
+}
+
+func (self *guard) ListAppend(kv *trib.KeyValue, succ *bool) error {
+	if e := self.checkKey(ACL_WRITE, kv.Key); e != nil {
+		return e
+	}
+	return self.s.ListAppend(kv, succ)
+}
+
+func (self *guard) ListRemove(kv *trib.KeyValue, n *int) error {
+	if e := self.checkKey(ACL_WRITE, kv.Key); e != nil {
+		return e
+	}
+	return self.s.ListRemove(kv, n)
+}
+
+func (self *guard) ListKeys(p *trib.Pattern, list *trib.List) error {
+	if e := self.check(ACL_READ, p.Prefix); e != nil {
+		return e
+	}
+	return self.s.ListKeys(p, list)
+}
+
+// Open to every known caller, front ends need it to order posts.
+func (self *guard) Clock(atLeast uint64, ret *uint64) error {
+	return self.s.Clock(atLeast, ret)
+}
+
+func (self *guard) Scan(args *ScanArgs, page *ScanPage) error {
+	if e := self.check(ACL_READ, args.Prefix); e != nil {
+		return e
+	}
+	return self.s.Scan(args, page)
+}
+
+func (self *guard) ListRange(args *RangeArgs, list *trib.List) error {
+	if e := self.checkKey(ACL_READ, args.Key); e != nil {
+		return e
+	}
+	return self.s.ListRange(args, list)
+}
+
+func (self *guard) ListLen(key string, n *int) error {
+	if e := self.checkKey(ACL_READ, key); e != nil {
+		return e
+	}
+	return self.s.ListLen(key, n)
+}
+
+func (self *guard) ListTrim(args *TrimArgs, n *int) error {
+	if e := self.checkKey(ACL_WRITE, args.Key); e != nil {
+		return e
+	}
+	return self.s.ListTrim(args, n)
+}
+
+func (self *guard) SetWithTTL(args *TTLArgs, succ *bool) error {
+	if e := self.checkKey(ACL_WRITE, args.Key); e != nil {
+		return e
+	}
+	return self.s.SetWithTTL(args, succ)
+}
+
+func (self *guard) ListExpire(args *ExpireArgs, succ *bool) error {
+	if e := self.checkKey(ACL_WRITE, args.Key); e != nil {
+		return e
+	}
+	return self.s.ListExpire(args, succ)
+}
+
+func (self *guard) Incr(args *IncrArgs, ret *int64) error {
+	if e := self.checkKey(ACL_WRITE, args.Key); e != nil {
+		return e
+	}
+	return self.s.Incr(args, ret)
+}
+
+func (self *guard) Watch(args *WatchArgs, ret *WatchResult) error {
+	for _, keys := range [][]string{args.Keys, args.Lists} {
+		for _, k := range keys {
+			if e := self.checkKey(ACL_READ, k); e != nil {
+				return e
+			}
+		}
+	}
+	return self.s.Watch(args, ret)
+}
+
+func (self *guard) GetVersioned(args *VersionArgs, ret *Versioned) error {
+	if e := self.checkKey(ACL_READ, args.Key); e != nil {
+		return e
+	}
+	return self.s.GetVersioned(args, ret)
+}
+
+func (self *guard) Commit(args *CommitArgs, committed *bool) error {
+	if e := self.checkTxn(args.Reads, args.Writes); e != nil {
+		return e
+	}
+	return self.s.Commit(args, committed)
+}
+
+func (self *guard) Prepare(args *PrepareArgs, ok *bool) error {
+	if e := self.checkTxn(args.Reads, args.Writes); e != nil {
+		return e
+	}
+	return self.s.Prepare(args, ok)
+}
+
+// Deciding needs the rights the transaction was prepared with.
+func (self *guard) Decide(args *DecideArgs, ret *Decision) error {
+	p, found := self.back.preparedArgs(args.Id)
+	if found {
+		if e := self.checkTxn(p.Reads, p.Writes); e != nil {
+			return e
+		}
+	}
+	return self.s.Decide(args, ret)
+}
+
+func (self *guard) InDoubt(age time.Duration, ids *[]string) error {
+	if e := self.check(ACL_READ, ""); e != nil {
+		return e
+	}
+	return self.s.InDoubt(age, ids)
+}
+
+var _ Storage = new(guard)
@@ -0,0 +1,200 @@
+package triblab_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"trib"
+	"trib/randaddr"
+	"trib/store"
+	"triblab"
+)
+
+func TestAuth(t *testing.T) {
+	const secret = "s3cret"
+	acl := map[string][]triblab.ACLRule{
+		"front": {
+			{Prefix: "alice", Ops: []string{triblab.ACL_READ, triblab.ACL_WRITE}},
+			{Prefix: "_PLACEMENT_", Ops: []string{triblab.ACL_READ}},
+		},
+		"reader": {
+			{Prefix: "alice", Ops: []string{triblab.ACL_READ}},
+		},
+		"keeper": {
+			{Prefix: "", Ops: []string{triblab.ACL_READ, triblab.ACL_WRITE}},
+		},
+	}
+
+	dir, e := ioutil.TempDir("", "triblab-auth")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	conf := loadTestTLS(t, dir)
+
+	addr := randaddr.Local()
+	jaddr := randaddr.Local()
+	for jaddr == addr {
+		jaddr = randaddr.Local()
+	}
+
+	// tokens would go in plaintext without TLS
+	ready := make(chan bool)
+	refused := make(chan error, 1)
+	go func() {
+		b := &trib.BackConfig{Addr: addr, Store: store.NewStorage(), Ready: ready}
+		refused <- triblab.ServeBackWith(b, &triblab.BackOptions{
+			Auth: &triblab.AuthConfig{Secret: secret, ACL: acl},
+		})
+	}()
+	if <-ready || <-refused == nil {
+		t.Fatal("served Auth without TLS")
+	}
+
+	ready = make(chan bool)
+	go func() {
+		b := &trib.BackConfig{Addr: addr, Store: store.NewStorage(), Ready: ready}
+		e := triblab.ServeBackWith(b, &triblab.BackOptions{
+			JSONAddr: jaddr,
+			TLS:      conf,
+			Auth:     &triblab.AuthConfig{Secret: secret, ACL: acl},
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-ready {
+		t.Fatal("not ready")
+	}
+
+	client := func(addr, token string) triblab.Storage {
+		c, e := triblab.NewClientWith(addr, &triblab.ClientOptions{TLS: conf, Token: token})
+		if e != nil {
+			t.Fatal(e)
+		}
+		return c.(triblab.Storage)
+	}
+
+	var v string
+	var succ bool
+	if e := client(addr, "").Get("alice::name", &v); e == nil {
+		t.Fatal("caller without a token got through")
+	}
+	if e := client(addr, "front:0:"+strings.Repeat("0", 64)).Get("alice::name", &v); e == nil {
+		t.Fatal("forged token got through")
+	}
+	expired := triblab.NewToken(secret, "front", time.Now().Add(-time.Second))
+	if e := client(addr, expired).Get("alice::name", &v); e == nil {
+		t.Fatal("expired token got through")
+	}
+	if e := client(addr, triblab.NewToken(secret, "front", time.Now().Add(time.Hour))).Get("alice::name", &v); e != nil {
+		t.Fatal("token before its expiry refused:", e)
+	}
+	if e := client(addr, triblab.NewToken("other", "front", time.Time{})).Get("alice::name", &v); e == nil {
+		t.Fatal("token of another secret got through")
+	}
+	if e := client(addr, triblab.NewToken(secret, "nobody", time.Time{})).Get("alice::name", &v); e == nil {
+		t.Fatal("caller missing from the ACL got through")
+	}
+
+	front := triblab.NewToken(secret, "front", time.Time{})
+	bc, e := triblab.NewBinClientWith([]string{addr}, &triblab.ClientOptions{TLS: conf, Token: front})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := bc.Bin("alice").Set(trib.KV("name", "alice"), &succ); e != nil {
+		t.Fatal(e)
+	}
+	if e := bc.Bin("alice").Get("name", &v); e != nil || v != "alice" {
+		t.Fatalf("front in its bin: %q, %v", v, e)
+	}
+	if e := bc.Bin("bob").Set(trib.KV("name", "bob"), &succ); e == nil {
+		t.Fatal("front wrote outside of its bins")
+	}
+	var l trib.List
+	if e := client(addr, front).Keys(&trib.Pattern{}, &l); e == nil {
+		t.Fatal("front listed all keys")
+	}
+	var ids []string
+	if e := client(addr, front).InDoubt(0, &ids); e == nil {
+		t.Fatal("front listed all transactions")
+	}
+
+	reader := client(addr, triblab.NewToken(secret, "reader", time.Time{}))
+	if e := reader.Get("alice::name", &v); e != nil || v != "alice" {
+		t.Fatalf("reader: %q, %v", v, e)
+	}
+	if e := reader.Set(trib.KV("alice::name", "eve"), &succ); e == nil {
+		t.Fatal("reader wrote")
+	}
+	var committed bool
+	e = reader.Commit(&triblab.CommitArgs{
+		Writes: []triblab.TxnWrite{{Op: triblab.TXN_SET, Key: "alice::name", Value: "eve"}},
+	}, &committed)
+	if e == nil {
+		t.Fatal("reader wrote in a transaction")
+	}
+
+	keeper := client(addr, triblab.NewToken(secret, "keeper", time.Time{}))
+	if e := keeper.Set(trib.KV("bob::name", "bob"), &succ); e != nil {
+		t.Fatal(e)
+	}
+	if e := keeper.InDoubt(0, &ids); e != nil {
+		t.Fatal(e)
+	}
+
+	// JSON-RPC checks callers too
+	jc := client(triblab.JSONRPC_SCHEME+jaddr, front)
+	if e := jc.Get("alice::name", &v); e != nil || v != "alice" {
+		t.Fatalf("json front: %q, %v", v, e)
+	}
+	if e := jc.Get("bob::name", &v); e == nil {
+		t.Fatal("json front read outside of its bins")
+	}
+	if e := client(triblab.JSONRPC_SCHEME+jaddr, "").Get("alice::name", &v); e == nil {
+		t.Fatal("json caller without a token got through")
+	}
+
+	cert, e := tls.LoadX509KeyPair(filepath.Join(dir, "node.pem"), filepath.Join(dir, "node-key.pem"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	pem, e := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+	hc := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool},
+	}}
+	post := func(token string) int {
+		req, e := http.NewRequest("POST", "https://"+addr+triblab.JSONRPC_PATH,
+			strings.NewReader(`{"jsonrpc": "2.0", "method": "Storage.Get", "params": ["alice::name"], "id": 1}`))
+		if e != nil {
+			t.Fatal(e)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, e := hc.Do(req)
+		if e != nil {
+			t.Fatal(e)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(front); code != http.StatusOK {
+		t.Fatalf("json post with token: %d", code)
+	}
+	if code := post(""); code != http.StatusUnauthorized {
+		t.Fatalf("json post without token: %d", code)
+	}
+}
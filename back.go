@@ -0,0 +1,530 @@
+package triblab
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"trib"
+)
+
+const (
+	// page size of a Scan that does not ask for one
+	SCAN_LIMIT = 1000
+)
+
+// Storage served by triblab backends: trib.Storage plus extended
+// operations, implemented by the backend, the RPC client and bins.
+type Storage interface {
+	trib.Storage
+
+	// Pages through the keys matching a pattern in key order.
+	Scan(args *ScanArgs, page *ScanPage) error
+
+	// Fetches the items from Start to Stop, both inclusive. Negative
+	// indices count from the end, -1 being the last item. Items are in
+	// append order, or ordered by a field if By is set.
+	ListRange(args *RangeArgs, list *trib.List) error
+
+	// Number of items in a list.
+	ListLen(key string, n *int) error
+
+	// Drops all but the last Keep items of a list, atomically, in the
+	// same order as ListRange. Returns the number of items dropped.
+	ListTrim(args *TrimArgs, n *int) error
+
+	// Sets a key that goes away on its own after TTL. A plain Set
+	// makes the key permanent again.
+	SetWithTTL(args *TTLArgs, succ *bool) error
+
+	// Makes a list go away after TTL, or keeps it for good if TTL is 0.
+	// Fails if the list is empty.
+	ListExpire(args *ExpireArgs, succ *bool) error
+
+	// Adds Delta to the integer stored at a key, atomically, and returns
+	// the new value. A missing key counts as 0.
+	Incr(args *IncrArgs, ret *int64) error
+
+	// Waits until one of the given keys or lists changes after clock
+	// Since, or until the timeout, and reports what changed.
+	Watch(args *WatchArgs, ret *WatchResult) error
+
+	// Reads a key or list along with its version, for transactions.
+	GetVersioned(args *VersionArgs, ret *Versioned) error
+
+	// Applies the writes of a transaction atomically, if none of its
+	// reads changed since.
+	Commit(args *CommitArgs, committed *bool) error
+
+	// First phase of a cross-bin transaction: validates the reads and
+	// holds the keys until Decide.
+	Prepare(args *PrepareArgs, ok *bool) error
+
+	// Second phase: applies or drops a prepared transaction.
+	Decide(args *DecideArgs, ret *Decision) error
+
+	// Ids of the transactions prepared longer ago than age.
+	InDoubt(age time.Duration, ids *[]string) error
+}
+
+// Args of Storage.Scan.
+type ScanArgs struct {
+	Prefix string
+	Suffix string
+	Lists  bool   // scan list keys instead of string keys
+	Cursor string // from the previous page, "" for the first one
+	Limit  int    // max keys in the page, SCAN_LIMIT when 0
+}
+
+// Reply of Storage.Scan.
+type ScanPage struct {
+	Keys   []string
+	Cursor string // to fetch the next page with, "" when done
+}
+
+// Args of Storage.ListRange.
+type RangeArgs struct {
+	Key   string
+	Start int
+	Stop  int
+	By    string // integer field of JSON items to order by, see orderBy
+}
+
+// Args of Storage.ListTrim.
+type TrimArgs struct {
+	Key  string
+	Keep int
+	By   string // as for RangeArgs
+}
+
+// Args of Storage.Incr.
+type IncrArgs struct {
+	Key   string
+	Delta int64
+}
+
+// What a backend serves: the configured store with the extended
+// operations built on top of it.
+type backend struct {
+	trib.Storage
+
+	lock sync.RWMutex // updates made of several store calls
+
+	tlock   sync.Mutex
+	strTTL  map[string]time.Time // expiry of string keys
+	listTTL map[string]time.Time // expiry of lists
+
+	wlock   sync.Mutex
+	strVer  map[string]uint64  // clock of the last change of string keys
+	listVer map[string]uint64  // clock of the last change of lists
+	floor   uint64             // version of the keys pruned from them
+	watches map[uint64]int     // Since of the waiting watches -> how many
+	pruneAt int                // versions kept before the next prune
+	wake    chan bool          // closed on every change
+	stored  [2]map[string]bool // string keys and lists held, for metrics
+	clock   uint64             // last clock handed out, for metrics
+
+	prepared map[string]*preparedTxn    // by id, guarded by lock
+	held     map[string]string          // lockKey -> id of the txn holding it alone
+	shared   map[string]map[string]bool // lockKey -> ids of the txns sharing it
+
+	log *Logger // nil for the default
+	sim *Sim    // nil for real time
+}
+
+func newBackend(s trib.Storage) *backend {
+	ret := &backend{
+		Storage: s,
+		strTTL:  make(map[string]time.Time),
+		listTTL: make(map[string]time.Time),
+		strVer:  make(map[string]uint64),
+		listVer: make(map[string]uint64),
+		watches: make(map[uint64]int),
+		pruneAt: WATCH_PRUNE,
+		wake:    make(chan bool),
+
+		prepared: make(map[string]*preparedTxn),
+		held:     make(map[string]string),
+		shared:   make(map[string]map[string]bool),
+	}
+
+	// from then on touch keeps track
+	for i, lists := range []bool{false, true} {
+		ret.stored[i] = make(map[string]bool)
+		var l trib.List
+		if lists && s.ListKeys(&trib.Pattern{}, &l) == nil || !lists && s.Keys(&trib.Pattern{}, &l) == nil {
+			for _, k := range l.L {
+				ret.stored[i][k] = true
+			}
+		}
+	}
+	return ret
+}
+
+// The cursor is the last key of the page, so a scan never returns a key
+// twice and keeps going past keys removed in between.
+//
+// The store cannot list keys from a cursor, so every page still lists
+// all N keys of the pattern, though it orders only the limit it returns:
+// a page costs O(N log limit), and a whole scan O(N^2/limit log limit).
+// Large scans should ask for large pages.
+func (self *backend) Scan(args *ScanArgs, page *ScanPage) error {
+	var l trib.List
+	var e error
+	pat := &trib.Pattern{Prefix: args.Prefix, Suffix: args.Suffix}
+	if args.Lists {
+		e = self.ListKeys(pat, &l)
+	} else {
+		e = self.Keys(pat, &l)
+	}
+	if e != nil {
+		return e
+	}
+
+	limit := args.Limit
+	if limit <= 0 {
+		limit = SCAN_LIMIT
+	}
+
+	keys := l.L[:0]
+	for _, k := range l.L {
+		if args.Cursor == "" || k > args.Cursor {
+			keys = append(keys, k)
+		}
+	}
+
+	page.Keys = smallest(keys, limit)
+	page.Cursor = ""
+	if len(keys) > limit {
+		page.Cursor = page.Keys[limit-1]
+	}
+	return nil
+}
+
+// The n smallest of keys, sorted. Keeps the n smallest seen so far in a
+// max-heap rather than sorting them all.
+func smallest(keys []string, n int) []string {
+	if len(keys) <= n {
+		sort.Strings(keys)
+		return keys
+	}
+
+	h := keyHeap(make([]string, 0, n))
+	for _, k := range keys {
+		if len(h) < n {
+			heap.Push(&h, k)
+		} else if k < h[0] {
+			h[0] = k
+			heap.Fix(&h, 0)
+		}
+	}
+	sort.Strings(h)
+	return h
+}
+
+// Max-heap of keys.
+type keyHeap []string
+
+func (self keyHeap) Len() int            { return len(self) }
+func (self keyHeap) Less(i, j int) bool  { return self[i] > self[j] }
+func (self keyHeap) Swap(i, j int)       { self[i], self[j] = self[j], self[i] }
+func (self *keyHeap) Push(x interface{}) { *self = append(*self, x.(string)) }
+func (self *keyHeap) Pop() interface{} {
+	old := *self
+	x := old[len(old)-1]
+	*self = old[:len(old)-1]
+	return x
+}
+
+func (self *backend) ListGet(key string, list *trib.List) error {
+	e := self.evict(true, key)
+	if e != nil {
+		return e
+	}
+
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.Storage.ListGet(key, list)
+}
+
+func (self *backend) ListAppend(kv *trib.KeyValue, succ *bool) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	e := self.evictLocked(true, kv.Key)
+	if e != nil {
+		return e
+	}
+	e = self.Storage.ListAppend(kv, succ)
+	if e != nil {
+		return e
+	}
+	self.touch(true, kv.Key, true)
+	return nil
+}
+
+func (self *backend) ListRemove(kv *trib.KeyValue, n *int) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	e := self.evictLocked(true, kv.Key)
+	if e != nil {
+		return e
+	}
+	e = self.Storage.ListRemove(kv, n)
+	if e != nil {
+		return e
+	}
+	if *n > 0 {
+		return self.touchRemoved(kv.Key)
+	}
+	return nil
+}
+
+func (self *backend) ListRange(args *RangeArgs, list *trib.List) error {
+	e := self.ListGet(args.Key, list)
+	if e != nil {
+		return e
+	}
+
+	orderBy(list.L, args.By)
+	start, stop := listRange(len(list.L), args.Start, args.Stop)
+	list.L = list.L[start:stop]
+	return nil
+}
+
+// Sorts JSON list items by an integer field, keeping append order
+// among equal ones and for items without the field, which go first.
+// Does nothing for an empty field.
+func orderBy(items []string, field string) {
+	if field == "" {
+		return
+	}
+
+	keys := make(map[string]uint64, len(items))
+	for _, v := range items {
+		var obj map[string]json.RawMessage
+		if json.Unmarshal([]byte(v), &obj) == nil {
+			keys[v], _ = strconv.ParseUint(string(obj[field]), 10, 64)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return keys[items[i]] < keys[items[j]]
+	})
+}
+
+// Turns inclusive, possibly negative, indices into a slice range.
+func listRange(n, start, stop int) (int, int) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	stop++
+
+	if start < 0 {
+		start = 0
+	}
+	if stop < 0 {
+		stop = 0
+	}
+	if stop > n {
+		stop = n
+	}
+	if start > stop {
+		start = stop
+	}
+	return start, stop
+}
+
+func (self *backend) ListLen(key string, n *int) error {
+	var list trib.List
+	e := self.ListGet(key, &list)
+	if e != nil {
+		return e
+	}
+
+	*n = len(list.L)
+	return nil
+}
+
+func (self *backend) ListTrim(args *TrimArgs, n *int) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	*n = 0
+	e := self.evictLocked(true, args.Key)
+	if e != nil {
+		return e
+	}
+
+	var list trib.List
+	e = self.Storage.ListGet(args.Key, &list)
+	if e != nil {
+		return e
+	}
+
+	keep := args.Keep
+	if keep < 0 {
+		keep = 0
+	}
+	if len(list.L) <= keep {
+		return nil
+	}
+	orderBy(list.L, args.By)
+
+	// ListRemove drops every copy of a value, so the kept tail may get
+	// hit as well; rebuild the list to be safe
+	return self.rebuild(args.Key, list.L, list.L[len(list.L)-keep:], n)
+}
+
+// Replaces the list at key, currently holding old, with items. Stores
+// the number of items that went away in n. Caller holds the lock.
+func (self *backend) rebuild(key string, old, items []string, n *int) error {
+	removed := make(map[string]bool)
+	for _, v := range old {
+		if removed[v] {
+			continue
+		}
+		removed[v] = true
+
+		var r int
+		e := self.Storage.ListRemove(&trib.KeyValue{Key: key, Value: v}, &r)
+		if e != nil {
+			return e
+		}
+	}
+
+	for _, v := range items {
+		var succ bool
+		e := self.Storage.ListAppend(&trib.KeyValue{Key: key, Value: v}, &succ)
+		if e != nil {
+			return e
+		}
+	}
+
+	*n = len(old) - len(items)
+	self.touch(true, key, len(items) > 0)
+	return nil
+}
+
+// Keeps the TTL of the key, if any.
+func (self *backend) Incr(args *IncrArgs, ret *int64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	e := self.evictLocked(false, args.Key)
+	if e != nil {
+		return e
+	}
+
+	var v string
+	e = self.Storage.Get(args.Key, &v)
+	if e != nil {
+		return e
+	}
+
+	var n int64
+	if v != "" {
+		n, e = strconv.ParseInt(v, 10, 64)
+		if e != nil {
+			return fmt.Errorf("value of %q is not an integer", args.Key)
+		}
+	}
+	n += args.Delta
+
+	var succ bool
+	e = self.Storage.Set(&trib.KeyValue{Key: args.Key, Value: strconv.FormatInt(n, 10)}, &succ)
+	if e != nil {
+		return e
+	}
+	self.touch(false, args.Key, true)
+
+	*ret = n
+	return nil
+}
+
+// Remembers the clock handed out, for metrics to read it without
+// moving it.
+func (self *backend) Clock(atLeast uint64, ret *uint64) error {
+	e := self.Storage.Clock(atLeast, ret)
+	if e != nil {
+		return e
+	}
+
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if *ret > self.clock {
+		self.clock = *ret
+	}
+	return nil
+}
+
+// String keys and lists held, expired ones until evicted, and the last
+// clock handed out.
+func (self *backend) stats() (keys, lists int, clock uint64) {
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	return len(self.stored[0]), len(self.stored[1]), self.clock
+}
+
+// Adds the extended operations to s, unless it has them already. The
+// result is only atomic with regard to calls made through it.
+func extend(s trib.Storage) Storage {
+	if ext, ok := s.(Storage); ok {
+		return ext
+	}
+	return newBackend(s)
+}
+
+// Bin storage whose bins have the extended operations, built once per
+// bin so that calls on a bin are atomic with regard to each other.
+type extBins struct {
+	trib.BinStorage
+
+	lock sync.Mutex
+	bins map[string]Storage
+}
+
+// Adds the extended operations to the bins of bs, for the bins that do
+// not have them already.
+func extendBins(bs trib.BinStorage) trib.BinStorage {
+	if _, ok := bs.(*extBins); ok {
+		return bs
+	}
+	return &extBins{BinStorage: bs, bins: make(map[string]Storage)}
+}
+
+func (self *extBins) Bin(name string) trib.Storage {
+	self.lock.Lock()
+	ext, found := self.bins[name]
+	self.lock.Unlock()
+	if found {
+		return ext
+	}
+
+	// getting a bin may wait on the network, so not under the lock
+	s := self.BinStorage.Bin(name)
+	if ext, ok := s.(Storage); ok {
+		return ext // ours, with state kept on the backend
+	}
+	ext = extend(s)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if first, found := self.bins[name]; found {
+		return first
+	}
+	self.bins[name] = ext
+	return ext
+}
+
+func (self *extBins) simulation() *Sim {
+	return simOf(self.BinStorage)
+}
+
+var _ Storage = new(backend)
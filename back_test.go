@@ -1,8 +1,12 @@
 package triblab_test
 
 import (
+	"fmt"
+	"io/ioutil"
 	"testing"
+	"time"
 
+	"trib"
 	"trib/entries"
 	"trib/randaddr"
 	"trib/store"
@@ -30,3 +34,430 @@ func TestRPC(t *testing.T) {
 
 	tribtest.CheckStorage(t, c)
 }
+
+func startBack(t *testing.T) string {
+	addr := randaddr.Local()
+	ready := make(chan bool)
+
+	go func() {
+		e := entries.ServeBackSingle(addr, store.NewStorage(), ready)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	if !<-ready {
+		t.Fatal("not ready")
+	}
+	return addr
+}
+
+func TestScan(t *testing.T) {
+	c := triblab.NewClient(startBack(t)).(triblab.Storage)
+
+	var succ bool
+	for i := 0; i < 25; i++ {
+		e := c.Set(trib.KV(fmt.Sprintf("k%02d", i), "v"), &succ)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	e := c.Set(trib.KV("other", "v"), &succ)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var keys []string
+	args := &triblab.ScanArgs{Prefix: "k", Limit: 10}
+	pages := 0
+	for {
+		var page triblab.ScanPage
+		e := c.Scan(args, &page)
+		if e != nil {
+			t.Fatal(e)
+		}
+		pages++
+		keys = append(keys, page.Keys...)
+		if page.Cursor == "" {
+			break
+		}
+		args.Cursor = page.Cursor
+	}
+
+	if pages != 3 || len(keys) != 25 {
+		t.Fatalf("%d keys in %d pages", len(keys), pages)
+	}
+	for i, k := range keys {
+		if k != fmt.Sprintf("k%02d", i) {
+			t.Fatalf("key %d is %q", i, k)
+		}
+	}
+}
+
+func TestListRange(t *testing.T) {
+	c := triblab.NewClient(startBack(t)).(triblab.Storage)
+
+	var succ bool
+	for i := 0; i < 10; i++ {
+		e := c.ListAppend(trib.KV("l", fmt.Sprint(i)), &succ)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	check := func(start, stop int, want string) {
+		var l trib.List
+		e := c.ListRange(&triblab.RangeArgs{Key: "l", Start: start, Stop: stop}, &l)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if fmt.Sprint(l.L) != want {
+			t.Fatalf("range %d..%d: got %v, want %s", start, stop, l.L, want)
+		}
+	}
+	check(0, 2, "[0 1 2]")
+	check(-3, -1, "[7 8 9]")
+	check(8, 100, "[8 9]")
+	check(-100, 0, "[0]")
+	check(5, 2, "[]")
+	check(-20, -15, "[]")
+
+	var n int
+	e := c.ListTrim(&triblab.TrimArgs{Key: "l", Keep: 4}, &n)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if n != 6 {
+		t.Fatalf("trimmed %d", n)
+	}
+	e = c.ListLen("l", &n)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if n != 4 {
+		t.Fatalf("len %d after trim", n)
+	}
+	check(0, -1, "[6 7 8 9]")
+
+	// ordered by a field, append order breaking ties
+	for _, v := range []string{`{"C": 3}`, `{"C": 1, "n": "a"}`, `{"C": 2}`, `{"C": 1, "n": "b"}`} {
+		e := c.ListAppend(trib.KV("o", v), &succ)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	var l trib.List
+	e = c.ListRange(&triblab.RangeArgs{Key: "o", Start: 0, Stop: 1, By: "C"}, &l)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if fmt.Sprint(l.L) != `[{"C": 1, "n": "a"} {"C": 1, "n": "b"}]` {
+		t.Fatalf("ordered range: %v", l.L)
+	}
+	e = c.ListTrim(&triblab.TrimArgs{Key: "o", Keep: 2, By: "C"}, &n)
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = c.ListRange(&triblab.RangeArgs{Key: "o", Start: 0, Stop: -1, By: "C"}, &l)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if n != 2 || fmt.Sprint(l.L) != `[{"C": 2} {"C": 3}]` {
+		t.Fatalf("ordered trim: %d, %v", n, l.L)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	c := triblab.NewClient(startBack(t)).(triblab.Storage)
+
+	var succ bool
+	var v string
+	var l trib.List
+	ttl := 200 * time.Millisecond
+
+	e := c.SetWithTTL(&triblab.TTLArgs{Key: "a", Value: "1", TTL: ttl}, &succ)
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = c.SetWithTTL(&triblab.TTLArgs{Key: "b", Value: "1", TTL: ttl}, &succ)
+	if e != nil {
+		t.Fatal(e)
+	}
+	// a plain set makes b permanent
+	e = c.Set(trib.KV("b", "2"), &succ)
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = c.ListAppend(trib.KV("l", "x"), &succ)
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = c.ListExpire(&triblab.ExpireArgs{Key: "l", TTL: ttl}, &succ)
+	if e != nil || !succ {
+		t.Fatal("list expire failed", e)
+	}
+
+	e = c.Get("a", &v)
+	if e != nil || v != "1" {
+		t.Fatalf("got %q, %v before expiry", v, e)
+	}
+
+	time.Sleep(2 * ttl)
+
+	e = c.Get("a", &v)
+	if e != nil || v != "" {
+		t.Fatalf("got %q, %v after expiry", v, e)
+	}
+	e = c.Get("b", &v)
+	if e != nil || v != "2" {
+		t.Fatalf("permanent key: got %q, %v", v, e)
+	}
+	e = c.ListKeys(&trib.Pattern{}, &l)
+	if e != nil || len(l.L) != 0 {
+		t.Fatalf("list keys %v, %v after expiry", l.L, e)
+	}
+	e = c.ListExpire(&triblab.ExpireArgs{Key: "l", TTL: ttl}, &succ)
+	if e != nil || succ {
+		t.Fatal("expired an empty list", e)
+	}
+}
+
+func TestIncr(t *testing.T) {
+	addr := startBack(t)
+
+	const N = 20
+	done := make(chan bool, N)
+	for i := 0; i < N; i++ {
+		go func() {
+			// a client per front end
+			c := triblab.NewClient(addr).(triblab.Storage)
+			for j := 0; j < 10; j++ {
+				var n int64
+				e := c.Incr(&triblab.IncrArgs{Key: "cnt", Delta: 1}, &n)
+				if e != nil {
+					t.Error(e)
+				}
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < N; i++ {
+		<-done
+	}
+
+	c := triblab.NewClient(addr).(triblab.Storage)
+	var n int64
+	e := c.Incr(&triblab.IncrArgs{Key: "cnt", Delta: -200}, &n)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if n != 0 {
+		t.Fatalf("lost %d increments", -n)
+	}
+
+	var succ bool
+	e = c.Set(trib.KV("str", "abc"), &succ)
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = c.Incr(&triblab.IncrArgs{Key: "str", Delta: 1}, &n)
+	if e == nil {
+		t.Fatal("incremented a string")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	addr := startBack(t)
+	c := triblab.NewClient(addr).(triblab.Storage)
+
+	var succ bool
+	e := c.ListAppend(trib.KV("posts", "old"), &succ)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var clk uint64
+	e = c.Clock(0, &clk)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		var succ bool
+		e := triblab.NewClient(addr).ListAppend(trib.KV("posts", "new"), &succ)
+		if e != nil {
+			t.Error(e)
+		}
+	}()
+
+	args := &triblab.WatchArgs{
+		Keys:    []string{"name"},
+		Lists:   []string{"posts"},
+		Since:   clk,
+		Timeout: 5 * time.Second,
+	}
+	var ret triblab.WatchResult
+	start := time.Now()
+	e = c.Watch(args, &ret)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(ret.Lists) != 1 || ret.Lists[0] != "posts" || len(ret.Keys) != 0 {
+		t.Fatalf("watch returned %+v", ret)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("watch did not return on change")
+	}
+	if ret.Clock <= clk {
+		t.Fatal("clock did not move")
+	}
+
+	// nothing new since
+	args.Since = ret.Clock
+	args.Timeout = 100 * time.Millisecond
+	e = c.Watch(args, &ret)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(ret.Lists)+len(ret.Keys) != 0 || ret.Clock != args.Since {
+		t.Fatalf("watch returned %+v after timeout", ret)
+	}
+}
+
+// Watches wait on the clock of a simulation, and versions are pruned
+// from under them without waking them up early.
+func TestWatchSim(t *testing.T) {
+	s := triblab.NewSim(1)
+	s.Go("back", func() {
+		b := &trib.BackConfig{Addr: "back", Store: store.NewStorage()}
+		e := triblab.ServeBackWith(b, &triblab.BackOptions{
+			Sim:    s,
+			Logger: triblab.NewLogger(ioutil.Discard, triblab.LOG_ERROR),
+		})
+		if e != nil {
+			t.Error(e)
+		}
+	})
+
+	tc, e := triblab.NewClientWith("back", &triblab.ClientOptions{Sim: s})
+	if e != nil {
+		t.Fatal(e)
+	}
+	c := tc.(triblab.Storage)
+	var clk uint64
+	s.Go("", func() {
+		var succ bool
+		if e := c.Set(trib.KV("name", "alice"), &succ); e != nil {
+			t.Error(e)
+		}
+		if e := c.Clock(0, &clk); e != nil {
+			t.Error(e)
+		}
+	})
+	if e := s.Run(time.Second); e != nil {
+		t.Fatal(e)
+	}
+
+	set := false
+	s.Go("", func() {
+		var ret triblab.WatchResult
+		args := &triblab.WatchArgs{Keys: []string{"name"}, Since: clk, Timeout: triblab.WATCH_MAX}
+		if e := c.Watch(args, &ret); e != nil {
+			t.Error(e)
+		}
+		if !set || len(ret.Keys) != 1 {
+			t.Errorf("watch returned %+v, name set: %v", ret, set)
+		}
+
+		// and with nothing new it times out in virtual time
+		start := s.Now()
+		args = &triblab.WatchArgs{Keys: []string{"name"}, Since: ret.Clock, Timeout: time.Minute}
+		if e := c.Watch(args, &ret); e != nil {
+			t.Error(e)
+		}
+		if len(ret.Keys) != 0 || s.Now().Sub(start) < time.Minute {
+			t.Errorf("watch returned %+v after %v", ret, s.Now().Sub(start))
+		}
+	})
+	s.Go("", func() {
+		var succ bool
+		for i := 0; i < 3*triblab.WATCH_PRUNE; i++ {
+			if e := c.Set(trib.KV(fmt.Sprintf("k%d", i), "v"), &succ); e != nil {
+				t.Error(e)
+			}
+		}
+		set = true
+		if e := c.Set(trib.KV("name", "bob"), &succ); e != nil {
+			t.Error(e)
+		}
+	})
+	if e := s.Run(triblab.WATCH_MAX); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	addr := startBack(t)
+	c := triblab.NewClient(addr).(triblab.Storage)
+
+	// a transaction that loses a race does not commit
+	tx := triblab.NewTxn(c)
+	var v string
+	e := tx.Get("k", &v)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var succ bool
+	e = c.Set(trib.KV("k", "other"), &succ)
+	if e != nil {
+		t.Fatal(e)
+	}
+	tx.Set(trib.KV("k", "mine"))
+	tx.ListAppend(trib.KV("l", "mine"))
+	if tx.Commit() != triblab.ErrConflict {
+		t.Fatal("conflicting commit went through")
+	}
+	var l trib.List
+	e = c.ListGet("l", &l)
+	if e != nil || len(l.L) != 0 {
+		t.Fatal("aborted transaction left writes behind")
+	}
+
+	// concurrent read-modify-write transactions
+	const N = 10
+	done := make(chan bool, N)
+	for i := 0; i < N; i++ {
+		go func(i int) {
+			c := triblab.NewClient(addr).(triblab.Storage)
+			e := triblab.RunTxn(c, func(tx *triblab.Txn) error {
+				var l trib.List
+				e := tx.ListGet("members", &l)
+				if e != nil {
+					return e
+				}
+				tx.ListAppend(trib.KV("members", fmt.Sprint(i)))
+				tx.Set(trib.KV("count", fmt.Sprint(len(l.L)+1)))
+				return nil
+			})
+			if e != nil {
+				t.Error(e)
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < N; i++ {
+		<-done
+	}
+
+	e = c.ListGet("members", &l)
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = c.Get("count", &v)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(l.L) != N || v != fmt.Sprint(N) {
+		t.Fatalf("%d members, count %s", len(l.L), v)
+	}
+}
@@ -2,7 +2,9 @@ package triblab_test
 
 import (
 	"fmt"
+	"io/ioutil"
 	"testing"
+	"time"
 
 	"os"
 	"trib"
@@ -83,3 +85,66 @@ func TestBinStorage(t *testing.T) {
 		<-done
 	}
 }
+
+func TestWhere(t *testing.T) {
+	addr1 := randaddr.Local()
+	addr2 := randaddr.Local()
+	for addr2 == addr1 {
+		addr2 = randaddr.Local()
+	}
+	ready := make(chan bool)
+	for _, addr := range []string{addr1, addr2} {
+		go func(addr string) {
+			e := entries.ServeBackSingle(addr, store.NewStorage(), ready)
+			if e != nil {
+				t.Fatal(e)
+			}
+		}(addr)
+	}
+	if !<-ready || !<-ready {
+		t.Fatal("not ready")
+	}
+
+	bc := triblab.NewBinClient([]string{addr1, addr2}).(*triblab.VStorage)
+	backs, shadows, version := bc.Where("alice")
+	if len(backs) != 1 || len(shadows) != 0 || version != 0 {
+		t.Fatalf("hashed: %q %q %d", backs, shadows, version)
+	}
+
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	readyk := make(chan bool)
+	addrk := randaddr.Local()
+	for addrk == addr1 || addrk == addr2 {
+		addrk = randaddr.Local()
+	}
+	go func() {
+		e := triblab.ServeKeeperWith(&trib.KeeperConfig{
+			Backs: []string{addr1, addr2},
+			Addrs: []string{addrk},
+			Ready: readyk,
+		}, &triblab.KeeperOptions{StateDir: dir, Replicas: 2})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-readyk {
+		t.Fatal("keeper not ready")
+	}
+
+	// the table is published with the next clock sync
+	for deadline := time.Now().Add(5 * time.Second); version == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("no placement published")
+		}
+		time.Sleep(100 * time.Millisecond)
+		backs, shadows, version = bc.Where("alice")
+	}
+	if len(backs) != 2 || backs[0] == backs[1] || len(shadows) != 0 {
+		t.Fatalf("replicated: %q %q", backs, shadows)
+	}
+}
@@ -1,33 +1,46 @@
 package triblab
 
 import (
+	"crypto/tls"
 	"trib"
-	"net/rpc"
 	"time"
-	"fmt"
 )
 
 type client struct {
 	// server address
 	addr string
+
+	// nil for plaintext
+	tls *tls.Config
+
+	// caller token, "" for none
+	token string
+
+	// parent of the spans of the calls, nil for no tracing
+	span *Span
+
+	// nil for the default
+	log *Logger
+
+	// nil for the real network
+	sim *Sim
 }
 
 // implement KeyString interface
 func (self *client) Get(key string, value *string) error {
-	conn, e := rpc.DialHTTP("tcp", self.addr)
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
 	if e != nil {
 		return e
 	}
 
 	// perform the call
 	tstart := time.Now()
-	e = conn.Call("Storage.Get", &key, value)
+	e = callBackoff(conn, "Storage.Get", &key, value)
 	if e != nil {
 		conn.Close()
 		return e
 	}
-	elapsed := time.Since(tstart)
-	fmt.Println("Storage.Get latency = ", elapsed)
+	self.log.Debug("call", "method", "Storage.Get", "peer", self.addr, "latency", time.Since(tstart))
 
 
 	// close connection
@@ -35,27 +48,26 @@ func (self *client) Get(key string, value *string) error {
 }
 
 func (self *client) Set(kv *trib.KeyValue, succ *bool) error {
-	conn, e := rpc.DialHTTP("tcp", self.addr)
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
 	if e != nil {
 		return e
 	}
 
 	// perform the call
 	tstart := time.Now()
-	e = conn.Call("Storage.Set", kv, succ)
+	e = callBackoff(conn, "Storage.Set", kv, succ)
 	if e != nil {
 		conn.Close()
 		return e
 	}
-	elapsed := time.Since(tstart)
-	fmt.Println("Storage.Set latency = ", elapsed)
+	self.log.Debug("call", "method", "Storage.Set", "peer", self.addr, "latency", time.Since(tstart))
 
 	// close connection
 	return conn.Close()
 }
 
 func (self *client) Keys(p *trib.Pattern, list *trib.List) error {
-	conn, e := rpc.DialHTTP("tcp", self.addr)
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
 	if e != nil {
 		return e
 	}
@@ -64,13 +76,12 @@ func (self *client) Keys(p *trib.Pattern, list *trib.List) error {
 
 	// perform the call
 	tstart := time.Now()
-	e = conn.Call("Storage.Keys", p, list)
+	e = callBackoff(conn, "Storage.Keys", p, list)
 	if e != nil {
 		conn.Close()
 		return e
 	}
-	elapsed := time.Since(tstart)
-	fmt.Println("Storage.Keys latency = ", elapsed)
+	self.log.Debug("call", "method", "Storage.Keys", "peer", self.addr, "latency", time.Since(tstart))
 
 	if list.L == nil {
 		list.L = []string{}
@@ -82,7 +93,7 @@ func (self *client) Keys(p *trib.Pattern, list *trib.List) error {
 
 // implement KeyList interface 
 func (self *client) ListGet(key string, list *trib.List) error {
-	conn, e := rpc.DialHTTP("tcp", self.addr)
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
 	if e != nil {
 		return e
 	}
@@ -91,13 +102,12 @@ func (self *client) ListGet(key string, list *trib.List) error {
 
 	// perform the call
 	tstart := time.Now()
-	e = conn.Call("Storage.ListGet", &key, list)
+	e = callBackoff(conn, "Storage.ListGet", &key, list)
 	if e != nil {
 		conn.Close()
 		return e
 	}
-	elapsed := time.Since(tstart)
-	fmt.Println("Storage.ListGet latency = ", elapsed)
+	self.log.Debug("call", "method", "Storage.ListGet", "peer", self.addr, "latency", time.Since(tstart))
 
 	if list.L == nil {
 		list.L = []string{}
@@ -108,47 +118,45 @@ func (self *client) ListGet(key string, list *trib.List) error {
 }
 
 func (self *client) ListAppend(kv *trib.KeyValue, succ *bool) error {
-	conn, e := rpc.DialHTTP("tcp", self.addr)
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
 	if e != nil {
 		return e
 	}
 
 	// perform the call
 	tstart := time.Now()
-	e = conn.Call("Storage.ListAppend", kv, succ)
+	e = callBackoff(conn, "Storage.ListAppend", kv, succ)
 	if e != nil {
 		conn.Close()
 		return e
 	}
-	elapsed := time.Since(tstart)
-	fmt.Println("Storage.ListAppend latency = ", elapsed)
+	self.log.Debug("call", "method", "Storage.ListAppend", "peer", self.addr, "latency", time.Since(tstart))
 
 	// close connection
 	return conn.Close()
 }
 
 func (self *client) ListRemove(kv *trib.KeyValue, n *int) error {
-	conn, e := rpc.DialHTTP("tcp", self.addr)
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
 	if e != nil {
 		return e
 	}
 
 	// perform the call
 	tstart := time.Now()
-	e = conn.Call("Storage.ListRemove", kv, n)
+	e = callBackoff(conn, "Storage.ListRemove", kv, n)
 	if e != nil {
 		conn.Close()
 		return e
 	}
-	elapsed := time.Since(tstart)
-	fmt.Println("Storage.ListRemove latency = ", elapsed)
+	self.log.Debug("call", "method", "Storage.ListRemove", "peer", self.addr, "latency", time.Since(tstart))
 
 	// close connection
 	return conn.Close()
 }
 
 func (self *client) ListKeys(p *trib.Pattern, list *trib.List) error {
-	conn, e := rpc.DialHTTP("tcp", self.addr)
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
 	if e != nil {
 		return e
 	}
@@ -157,13 +165,12 @@ func (self *client) ListKeys(p *trib.Pattern, list *trib.List) error {
 
 	// perform the call
 	tstart := time.Now()
-	e = conn.Call("Storage.ListKeys", p, list)
+	e = callBackoff(conn, "Storage.ListKeys", p, list)
 	if e != nil {
 		conn.Close()
 		return e
 	}
-	elapsed := time.Since(tstart)
-	fmt.Println("Storage.ListKeys latency = ", elapsed)
+	self.log.Debug("call", "method", "Storage.ListKeys", "peer", self.addr, "latency", time.Since(tstart))
 
 	if list.L == nil {
 		list.L = []string{}
@@ -175,20 +182,309 @@ func (self *client) ListKeys(p *trib.Pattern, list *trib.List) error {
 
 // implement clock
 func (self *client) Clock(atLeast uint64, ret *uint64) error {
-	conn, e := rpc.DialHTTP("tcp", self.addr)
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	tstart := time.Now()
+	e = callBackoff(conn, "Storage.Clock", &atLeast, ret)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+	self.log.Debug("call", "method", "Storage.Clock", "peer", self.addr, "latency", time.Since(tstart))
+
+	// close connection
+	return conn.Close()
+}
+
+// implement Storage extensions
+func (self *client) Scan(args *ScanArgs, page *ScanPage) error {
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
+	if e != nil {
+		return e
+	}
+
+	page.Keys = nil
+	page.Cursor = ""
+
+	// perform the call
+	tstart := time.Now()
+	e = callBackoff(conn, "Storage.Scan", args, page)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+	self.log.Debug("call", "method", "Storage.Scan", "peer", self.addr, "latency", time.Since(tstart))
+
+	if page.Keys == nil {
+		page.Keys = []string{}
+	}
+
+	// close connection
+	return conn.Close()
+}
+
+func (self *client) ListRange(args *RangeArgs, list *trib.List) error {
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
+	if e != nil {
+		return e
+	}
+
+	list.L = nil
+
+	// perform the call
+	tstart := time.Now()
+	e = callBackoff(conn, "Storage.ListRange", args, list)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+	self.log.Debug("call", "method", "Storage.ListRange", "peer", self.addr, "latency", time.Since(tstart))
+
+	if list.L == nil {
+		list.L = []string{}
+	}
+
+	// close connection
+	return conn.Close()
+}
+
+func (self *client) ListLen(key string, n *int) error {
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	tstart := time.Now()
+	e = callBackoff(conn, "Storage.ListLen", &key, n)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+	self.log.Debug("call", "method", "Storage.ListLen", "peer", self.addr, "latency", time.Since(tstart))
+
+	// close connection
+	return conn.Close()
+}
+
+func (self *client) ListTrim(args *TrimArgs, n *int) error {
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	tstart := time.Now()
+	e = callBackoff(conn, "Storage.ListTrim", args, n)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+	self.log.Debug("call", "method", "Storage.ListTrim", "peer", self.addr, "latency", time.Since(tstart))
+
+	// close connection
+	return conn.Close()
+}
+
+func (self *client) SetWithTTL(args *TTLArgs, succ *bool) error {
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	tstart := time.Now()
+	e = callBackoff(conn, "Storage.SetWithTTL", args, succ)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+	self.log.Debug("call", "method", "Storage.SetWithTTL", "peer", self.addr, "latency", time.Since(tstart))
+
+	// close connection
+	return conn.Close()
+}
+
+func (self *client) ListExpire(args *ExpireArgs, succ *bool) error {
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	tstart := time.Now()
+	e = callBackoff(conn, "Storage.ListExpire", args, succ)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+	self.log.Debug("call", "method", "Storage.ListExpire", "peer", self.addr, "latency", time.Since(tstart))
+
+	// close connection
+	return conn.Close()
+}
+
+func (self *client) Incr(args *IncrArgs, ret *int64) error {
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	tstart := time.Now()
+	e = callBackoff(conn, "Storage.Incr", args, ret)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+	self.log.Debug("call", "method", "Storage.Incr", "peer", self.addr, "latency", time.Since(tstart))
+
+	// close connection
+	return conn.Close()
+}
+
+// blocks for up to args.Timeout
+func (self *client) Watch(args *WatchArgs, ret *WatchResult) error {
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
+	if e != nil {
+		return e
+	}
+
+	ret.Keys = nil
+	ret.Lists = nil
+
+	// perform the call
+	tstart := time.Now()
+	e = callBackoff(conn, "Storage.Watch", args, ret)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+	self.log.Debug("call", "method", "Storage.Watch", "peer", self.addr, "latency", time.Since(tstart))
+
+	if ret.Keys == nil {
+		ret.Keys = []string{}
+	}
+	if ret.Lists == nil {
+		ret.Lists = []string{}
+	}
+
+	// close connection
+	return conn.Close()
+}
+
+func (self *client) GetVersioned(args *VersionArgs, ret *Versioned) error {
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
 	if e != nil {
 		return e
 	}
 
+	ret.List = nil
+
 	// perform the call
 	tstart := time.Now()
-	e = conn.Call("Storage.Clock", &atLeast, ret)
+	e = callBackoff(conn, "Storage.GetVersioned", args, ret)
 	if e != nil {
 		conn.Close()
 		return e
 	}
-	elapsed := time.Since(tstart)
-	fmt.Println("Storage.Clock latency = ", elapsed)
+	self.log.Debug("call", "method", "Storage.GetVersioned", "peer", self.addr, "latency", time.Since(tstart))
+
+	if ret.List == nil {
+		ret.List = []string{}
+	}
+
+	// close connection
+	return conn.Close()
+}
+
+func (self *client) Commit(args *CommitArgs, committed *bool) error {
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	tstart := time.Now()
+	e = callBackoff(conn, "Storage.Commit", args, committed)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+	self.log.Debug("call", "method", "Storage.Commit", "peer", self.addr, "latency", time.Since(tstart))
+
+	// close connection
+	return conn.Close()
+}
+
+func (self *client) Prepare(args *PrepareArgs, ok *bool) error {
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	tstart := time.Now()
+	e = callBackoff(conn, "Storage.Prepare", args, ok)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+	self.log.Debug("call", "method", "Storage.Prepare", "peer", self.addr, "latency", time.Since(tstart))
+
+	// close connection
+	return conn.Close()
+}
+
+func (self *client) Decide(args *DecideArgs, ret *Decision) error {
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
+	if e != nil {
+		return e
+	}
+
+	ret.Writes = nil
+
+	// perform the call
+	tstart := time.Now()
+	e = callBackoff(conn, "Storage.Decide", args, ret)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+	self.log.Debug("call", "method", "Storage.Decide", "peer", self.addr, "latency", time.Since(tstart))
+
+	if ret.Writes == nil {
+		ret.Writes = []TxnWrite{}
+	}
+
+	// close connection
+	return conn.Close()
+}
+
+func (self *client) InDoubt(age time.Duration, ids *[]string) error {
+	conn, e := self.sim.dial(self.addr, self.tls, self.token, self.span)
+	if e != nil {
+		return e
+	}
+
+	*ids = nil
+
+	// perform the call
+	tstart := time.Now()
+	e = callBackoff(conn, "Storage.InDoubt", &age, ids)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+	self.log.Debug("call", "method", "Storage.InDoubt", "peer", self.addr, "latency", time.Since(tstart))
+
+	if *ids == nil {
+		*ids = []string{}
+	}
 
 	// close connection
 	return conn.Close()
@@ -196,4 +492,5 @@ func (self *client) Clock(atLeast uint64, ret *uint64) error {
 
 // test creation
 var _ trib.Storage = new(client)
+var _ Storage = new(client)
 
@@ -0,0 +1,86 @@
+package triblab
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// How the nodes of bins.rc are run, as found in its "Cluster" section,
+// e.g.
+//
+//	"Cluster": {"Replicas": 2, "DataDir": "data",
+//	    "BackAdmins": ["localhost:28165", "", "localhost:28167"]}
+//
+// Admin addresses go by index, so the first of BackAdmins is for the
+// first of Backs.
+type ClusterConfig struct {
+	Replicas     int      // of each hashed bin, 1 if 0; fixed by the first run
+	DataDir      string   // for keeper state, relative to bins.rc; none if empty
+	BackAdmins   []string // admin address of each backend, "" for none
+	KeeperAdmins []string // admin address of each keeper, "" for none
+}
+
+// Reads the "Cluster" section of an rc file such as bins.rc. Returns nil
+// when the section is missing, meaning the defaults.
+func LoadCluster(rcPath string) (*ClusterConfig, error) {
+	bytes, e := ioutil.ReadFile(rcPath)
+	if e != nil {
+		return nil, e
+	}
+
+	var rc struct {
+		Cluster *ClusterConfig
+	}
+	e = json.Unmarshal(bytes, &rc)
+	if e != nil {
+		return nil, e
+	}
+	if rc.Cluster == nil {
+		return nil, nil
+	}
+
+	if rc.Cluster.DataDir != "" && !filepath.IsAbs(rc.Cluster.DataDir) {
+		rc.Cluster.DataDir = filepath.Join(filepath.Dir(rcPath), rc.Cluster.DataDir)
+	}
+	return rc.Cluster, nil
+}
+
+func pick(addrs []string, i int) string {
+	if i < 0 || i >= len(addrs) {
+		return ""
+	}
+	return addrs[i]
+}
+
+// Admin address of the i-th backend, "" for none.
+func (self *ClusterConfig) BackAdmin(i int) string {
+	if self == nil {
+		return ""
+	}
+	return pick(self.BackAdmins, i)
+}
+
+// Admin address of the i-th keeper, "" for none.
+func (self *ClusterConfig) KeeperAdmin(i int) string {
+	if self == nil {
+		return ""
+	}
+	return pick(self.KeeperAdmins, i)
+}
+
+// Where keepers keep their state, "" for nowhere.
+func (self *ClusterConfig) StateDir() string {
+	if self == nil {
+		return ""
+	}
+	return self.DataDir
+}
+
+// Replicas of each hashed bin, 0 for one.
+func (self *ClusterConfig) Replication() int {
+	if self == nil {
+		return 0
+	}
+	return self.Replicas
+}
@@ -0,0 +1,100 @@
+package triblab_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"trib"
+	"triblab"
+)
+
+// An address nothing listens on, unlike a random one, which servers of
+// earlier tests may still hold.
+func freeAddr(t *testing.T) string {
+	l, e := net.Listen("tcp", "localhost:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestCluster(t *testing.T) {
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	rc := filepath.Join(dir, "bins.rc")
+	e = ioutil.WriteFile(rc, []byte(`{"Backs": ["localhost:1"]}`), 0644)
+	if e != nil {
+		t.Fatal(e)
+	}
+	c, e := triblab.LoadCluster(rc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if c != nil || c.BackAdmin(0) != "" || c.StateDir() != "" || c.Replication() != 0 {
+		t.Fatalf("defaults: %+v", c)
+	}
+
+	e = ioutil.WriteFile(rc, []byte(`{"Cluster": {
+		"Replicas": 2, "DataDir": "data", "BackAdmins": ["", "localhost:2"]}}`), 0644)
+	if e != nil {
+		t.Fatal(e)
+	}
+	c, e = triblab.LoadCluster(rc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if c.StateDir() != filepath.Join(dir, "data") {
+		t.Fatalf("data dir: %q", c.StateDir())
+	}
+	if c.BackAdmin(0) != "" || c.BackAdmin(1) != "localhost:2" || c.BackAdmin(2) != "" {
+		t.Fatalf("admins: %q", c.BackAdmins)
+	}
+	if c.KeeperAdmin(0) != "" {
+		t.Fatalf("keeper admins: %q", c.KeeperAdmins)
+	}
+
+	// keepers place bins on as many backends as asked
+	addrk := freeAddr(t)
+	backs := []string{"localhost:1", "localhost:2", "localhost:3"}
+	ready := make(chan bool)
+	go func() {
+		e := triblab.ServeKeeperWith(&trib.KeeperConfig{
+			Backs: backs,
+			Addrs: []string{addrk},
+			Ready: ready,
+		}, &triblab.KeeperOptions{StateDir: c.StateDir(), Replicas: c.Replication()})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-ready {
+		t.Fatal("keeper not ready")
+	}
+
+	var p triblab.Placement
+	e = triblab.NewKeeperClient(addrk).GetPlacement("", &p)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if p.Replicas != 2 || len(p.Lookup("alice")) != 2 {
+		t.Fatalf("placement: %+v", p)
+	}
+
+	// but not change them once they have a state
+	e = triblab.ServeKeeperWith(&trib.KeeperConfig{
+		Backs: backs,
+		Addrs: []string{addrk},
+	}, &triblab.KeeperOptions{StateDir: c.StateDir(), Replicas: 3})
+	if e == nil || !strings.Contains(e.Error(), "replicas changed from 2 to 3") {
+		t.Fatalf("replicas changed on a saved state: %v", e)
+	}
+}
@@ -0,0 +1,200 @@
+// Command bins-admin inspects and edits the bins of the cluster in
+// bins.rc.
+//
+//	bins-admin [-rc bins.rc] [-as caller] bin <name> get <key>
+//	bins-admin ... bin <name> set <key> <value>
+//	bins-admin ... bin <name> keys [prefix [suffix]]
+//	bins-admin ... bin <name> list-get <key>
+//	bins-admin ... bin <name> list-append <key> <value>
+//	bins-admin ... bin <name> list-remove <key> <value>
+//	bins-admin ... bin <name> list-keys [prefix [suffix]]
+//	bins-admin ... clock [at-least]
+//	bins-admin ... which-backend <name>
+//
+// Bins are reached the way front ends reach them, through the placement
+// table of the keepers. Clock goes to every backend instead. With an
+// Auth section in bins.rc, calls are signed as caller, "admin" by
+// default, which the ACL must allow, with a token good for TOKEN_TTL.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"trib"
+	"triblab"
+)
+
+var (
+	frc = flag.String("rc", trib.DefaultRCPath, "bin storage config file")
+	fas = flag.String("as", "admin", "caller identity to sign calls as, with Auth")
+)
+
+func noError(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: bins-admin [flags] command
+commands:
+  bin <name> get <key>
+  bin <name> set <key> <value>
+  bin <name> keys [prefix [suffix]]
+  bin <name> list-get <key>
+  bin <name> list-append <key> <value>
+  bin <name> list-remove <key> <value>
+  bin <name> list-keys [prefix [suffix]]
+  clock [at-least]
+  which-backend <name>
+flags:
+`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// Takes between min and max arguments.
+func nargs(args []string, min, max int) {
+	if len(args) < min || len(args) > max {
+		usage()
+	}
+}
+
+func pattern(args []string) *trib.Pattern {
+	p := new(trib.Pattern)
+	if len(args) > 0 {
+		p.Prefix = args[0]
+	}
+	if len(args) > 1 {
+		p.Suffix = args[1]
+	}
+	return p
+}
+
+func printList(l trib.List) {
+	for _, s := range l.L {
+		fmt.Println(s)
+	}
+}
+
+// Runs a command on one bin.
+func binCmd(s trib.Storage, cmd string, args []string) {
+	var succ bool
+	var l trib.List
+
+	switch cmd {
+	case "get":
+		nargs(args, 1, 1)
+		var v string
+		noError(s.Get(args[0], &v))
+		fmt.Println(v)
+	case "set":
+		nargs(args, 2, 2)
+		noError(s.Set(trib.KV(args[0], args[1]), &succ))
+	case "keys":
+		nargs(args, 0, 2)
+		noError(s.Keys(pattern(args), &l))
+		printList(l)
+	case "list-get":
+		nargs(args, 1, 1)
+		noError(s.ListGet(args[0], &l))
+		printList(l)
+	case "list-append":
+		nargs(args, 2, 2)
+		noError(s.ListAppend(trib.KV(args[0], args[1]), &succ))
+	case "list-remove":
+		nargs(args, 2, 2)
+		var n int
+		noError(s.ListRemove(trib.KV(args[0], args[1]), &n))
+		fmt.Println(n)
+	case "list-keys":
+		nargs(args, 0, 2)
+		noError(s.ListKeys(pattern(args), &l))
+		printList(l)
+	default:
+		usage()
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+
+	conf, e := triblab.LoadConfig(*frc)
+	noError(e)
+	noError(conf.Validate())
+	logger, e := conf.Log.Open()
+	noError(e)
+
+	opts := &triblab.ClientOptions{TLS: conf.TLS, Logger: logger}
+	if conf.Auth != nil {
+		opts.Token = triblab.NewToken(conf.Auth.Secret, *fas, time.Now().Add(triblab.TOKEN_TTL))
+	}
+
+	switch args[0] {
+	case "bin":
+		if len(args) < 3 {
+			usage()
+		}
+		bc, e := triblab.NewBinClientWith(conf.Backs, opts)
+		noError(e)
+		binCmd(bc.Bin(args[1]), args[2], args[3:])
+
+	case "clock":
+		nargs(args[1:], 0, 1)
+		var atLeast uint64
+		if len(args) > 1 {
+			atLeast, e = strconv.ParseUint(args[1], 10, 64)
+			noError(e)
+		}
+		failed := false
+		for _, addr := range conf.Backs {
+			c, e := triblab.NewClientWith(addr, opts)
+			noError(e)
+			var clk uint64
+			e = c.Clock(atLeast, &clk)
+			if e != nil {
+				fmt.Printf("%s error: %v\n", addr, e)
+				failed = true
+				continue
+			}
+			fmt.Printf("%s %d\n", addr, clk)
+		}
+		if failed {
+			os.Exit(1)
+		}
+
+	case "which-backend":
+		nargs(args[1:], 1, 1)
+		bc, e := triblab.NewBinClientWith(conf.Backs, opts)
+		noError(e)
+		backs, shadows, version := bc.(*triblab.VStorage).Where(args[1])
+		for i, b := range backs {
+			role := "replica"
+			if i == 0 {
+				role = "primary"
+			}
+			fmt.Printf("%s %s\n", role, b)
+		}
+		for _, b := range shadows {
+			fmt.Printf("migrating-to %s\n", b)
+		}
+		if version == 0 {
+			fmt.Println("placement hashed, no table published")
+		} else {
+			fmt.Printf("placement version %d\n", version)
+		}
+
+	default:
+		usage()
+	}
+}
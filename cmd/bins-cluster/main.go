@@ -0,0 +1,251 @@
+// Command bins-cluster launches the backends and keepers listed in
+// bins.rc and reports when each is ready.
+//
+//	bins-cluster [-rc bins.rc] [-procs] [node...]
+//	bins-cluster [-rc bins.rc] check
+//
+// Nodes are named back/N and keeper/N after their index in bins.rc;
+// "backs" and "keepers" stand for all of either, and no node for all of
+// them. With -procs every node runs in a process of its own, otherwise
+// all of them run in this one. Check reports every problem of bins.rc
+// without launching anything, and nothing is launched while there are
+// any.
+//
+// Besides Backs and Keepers, bins.rc may have Cluster, TLS, Auth and Log
+// sections. With Auth, which needs TLS, keepers call backends as
+// "keeper", which the ACL must allow to read and write every bin.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"trib"
+	"trib/store"
+	"triblab"
+)
+
+var (
+	frc    = flag.String("rc", trib.DefaultRCPath, "bin storage config file")
+	fprocs = flag.Bool("procs", false, "run each node in a process of its own")
+)
+
+func noError(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+type node struct {
+	kind string // "back" or "keeper"
+	i    int
+}
+
+func (self node) String() string {
+	return fmt.Sprintf("%s/%d", self.kind, self.i)
+}
+
+// Parses the node names of the command line, in bins.rc order.
+func parseNodes(rc *trib.RC, args []string) ([]node, error) {
+	if len(args) == 0 {
+		args = []string{"backs", "keepers"}
+	}
+
+	backs := make([]bool, len(rc.Backs))
+	keepers := make([]bool, len(rc.Keepers))
+	for _, a := range args {
+		switch a {
+		case "backs":
+			for i := range backs {
+				backs[i] = true
+			}
+			continue
+		case "keepers":
+			for i := range keepers {
+				keepers[i] = true
+			}
+			continue
+		}
+
+		parts := strings.SplitN(a, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad node %q, want back/N or keeper/N", a)
+		}
+		i, e := strconv.Atoi(parts[1])
+		if e != nil {
+			return nil, fmt.Errorf("bad node %q: %v", a, e)
+		}
+		var set []bool
+		switch parts[0] {
+		case "back":
+			set = backs
+		case "keeper":
+			set = keepers
+		default:
+			return nil, fmt.Errorf("bad node %q, want back/N or keeper/N", a)
+		}
+		if i < 0 || i >= len(set) {
+			return nil, fmt.Errorf("no node %q in %s", a, *frc)
+		}
+		set[i] = true
+	}
+
+	var ret []node
+	for i, on := range backs {
+		if on {
+			ret = append(ret, node{"back", i})
+		}
+	}
+	for i, on := range keepers {
+		if on {
+			ret = append(ret, node{"keeper", i})
+		}
+	}
+	return ret, nil
+}
+
+func (self node) addr(rc *trib.RC) string {
+	if self.kind == "back" {
+		return rc.Backs[self.i]
+	}
+	return rc.Keepers[self.i]
+}
+
+// Starts n in this process. Sends on ready once it is up, or has failed.
+func (self node) run(conf *triblab.Config, ready chan<- bool) {
+	rc, cluster, auth := conf.RC(), conf.Cluster, conf.Auth
+	if self.kind == "back" {
+		b := rc.BackConfig(self.i, store.NewStorage())
+		b.Ready = ready
+		e := triblab.ServeBackWith(b, &triblab.BackOptions{
+			TLS:       conf.TLS,
+			Auth:      auth,
+			AdminAddr: cluster.BackAdmin(self.i),
+		})
+		if e != nil {
+			log.Printf("%v: %v", self, e)
+		}
+		return
+	}
+
+	var token string
+	if auth != nil {
+		token = triblab.NewToken(auth.Secret, "keeper", time.Time{}) // holds the secret anyway
+	}
+	kc := rc.KeeperConfig(self.i)
+	kc.Ready = ready
+	e := triblab.ServeKeeperWith(kc, &triblab.KeeperOptions{
+		StateDir:  cluster.StateDir(),
+		TLS:       conf.TLS,
+		Token:     token,
+		AdminAddr: cluster.KeeperAdmin(self.i),
+		Replicas:  cluster.Replication(),
+	})
+	if e != nil {
+		log.Printf("%v: %v", self, e)
+	}
+}
+
+// Runs every node here, printing a line as each gets ready.
+func runHere(conf *triblab.Config, nodes []node) {
+	rc := conf.RC()
+	failed := false
+	for _, n := range nodes {
+		ready := make(chan bool, 1)
+		go n.run(conf, ready)
+		if <-ready {
+			fmt.Printf("%v %s ready\n", n, n.addr(rc))
+		} else {
+			fmt.Printf("%v %s failed\n", n, n.addr(rc))
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+
+	select {}
+}
+
+// Runs every node in a child process, passing on the lines they print.
+func runProcs(conf *triblab.Config, nodes []node) {
+	rc := conf.RC()
+	done := make(chan error)
+	for _, n := range nodes {
+		cmd := exec.Command(os.Args[0], "-rc", *frc, n.String())
+		cmd.Stderr = os.Stderr
+		out, e := cmd.StdoutPipe()
+		noError(e)
+		noError(cmd.Start())
+		log.Printf("%v %s started as pid %d", n, n.addr(rc), cmd.Process.Pid)
+
+		go func(n node) {
+			scanner := bufio.NewScanner(out)
+			for scanner.Scan() {
+				fmt.Println(scanner.Text())
+			}
+			e := cmd.Wait()
+			if e == nil {
+				e = fmt.Errorf("exited")
+			}
+			done <- fmt.Errorf("%v: %v", n, e)
+		}(n)
+	}
+
+	// nodes serve until killed, so any exit is a failure
+	e := <-done
+	log.Fatal(e)
+}
+
+// Prints the problems of the config, if any, and exits on them.
+func check(conf *triblab.Config) {
+	e := conf.Validate()
+	if e == nil {
+		return
+	}
+	if ce, ok := e.(*triblab.ConfigError); ok {
+		for _, p := range ce.Problems {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", ce.Path, p)
+		}
+		os.Exit(1)
+	}
+	log.Fatal(e)
+}
+
+func main() {
+	flag.Parse()
+
+	conf, e := triblab.LoadConfig(*frc)
+	noError(e)
+	check(conf)
+	args := flag.Args()
+	if len(args) == 1 && args[0] == "check" {
+		fmt.Printf("%s: ok\n", *frc)
+		return
+	}
+
+	logger, e := conf.Log.Open()
+	noError(e)
+	if logger != nil {
+		triblab.SetLogger(logger)
+	}
+
+	nodes, e := parseNodes(conf.RC(), args)
+	noError(e)
+	if len(nodes) == 0 {
+		log.Fatalf("no nodes in %s", *frc)
+	}
+
+	if *fprocs && len(nodes) > 1 {
+		runProcs(conf, nodes)
+	} else {
+		runHere(conf, nodes)
+	}
+}
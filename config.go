@@ -0,0 +1,253 @@
+package triblab
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"trib"
+)
+
+// Everything bins.rc may hold: the nodes of trib.RC and the sections
+// read by LoadCluster, LoadTLS, LoadAuth and LoadLogger, nil when
+// missing. Relative paths are taken from the directory of the rc file.
+type Config struct {
+	Backs   []string
+	Keepers []string
+	Cluster *ClusterConfig
+	TLS     *TLSConfig
+	Auth    *AuthConfig
+	Log     *LogConfig
+
+	path    string
+	unknown []string // top-level fields of no section, such as typos
+}
+
+// Reads a whole rc file such as bins.rc. Only unreadable files and bad
+// JSON are errors; see Validate for the rest.
+func LoadConfig(rcPath string) (*Config, error) {
+	bytes, e := ioutil.ReadFile(rcPath)
+	if e != nil {
+		return nil, e
+	}
+
+	ret := &Config{path: rcPath}
+	e = json.Unmarshal(bytes, ret)
+	if e != nil {
+		return nil, fmt.Errorf("%s: %v", rcPath, e)
+	}
+
+	var fields map[string]json.RawMessage
+	e = json.Unmarshal(bytes, &fields)
+	if e != nil {
+		return nil, fmt.Errorf("%s: %v", rcPath, e)
+	}
+	known := []string{"Backs", "Keepers", "Cluster", "TLS", "Auth", "Log"}
+	for name := range fields {
+		found := false
+		for _, k := range known {
+			// as matched by encoding/json
+			if strings.EqualFold(name, k) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret.unknown = append(ret.unknown, name)
+		}
+	}
+	sort.Strings(ret.unknown)
+
+	dir := filepath.Dir(rcPath)
+	resolve := func(p *string) {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	if ret.Cluster != nil {
+		resolve(&ret.Cluster.DataDir)
+	}
+	if ret.TLS != nil {
+		resolve(&ret.TLS.CA)
+		resolve(&ret.TLS.Cert)
+		resolve(&ret.TLS.Key)
+	}
+	if ret.Log != nil {
+		resolve(&ret.Log.File)
+	}
+	return ret, nil
+}
+
+// The nodes of the config, for trib.RC's BackConfig and KeeperConfig.
+func (self *Config) RC() *trib.RC {
+	return &trib.RC{Backs: self.Backs, Keepers: self.Keepers}
+}
+
+// Everything wrong with a config.
+type ConfigError struct {
+	Path     string
+	Problems []string
+}
+
+func (self *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", self.Path, strings.Join(self.Problems, "; "))
+}
+
+// Collects the problems of a config.
+type configCheck struct {
+	problems []string
+	seen     map[string]string // address -> where it was first seen
+	ports    bool              // addresses must be host:port
+}
+
+func newConfigCheck(ports bool) *configCheck {
+	return &configCheck{seen: make(map[string]string), ports: ports}
+}
+
+func (self *configCheck) add(format string, args ...interface{}) {
+	self.problems = append(self.problems, fmt.Sprintf(format, args...))
+}
+
+// Checks the address at where, which must not be used anywhere else.
+func (self *configCheck) addr(where, addr string) {
+	if addr == "" {
+		self.add("%s: empty address", where)
+		return
+	}
+	if first, found := self.seen[addr]; found {
+		self.add("%s: %q is also %s", where, addr, first)
+		return
+	}
+	self.seen[addr] = where
+
+	if !self.ports {
+		return
+	}
+	_, port, e := net.SplitHostPort(addr)
+	if e != nil {
+		self.add("%s: %v", where, e)
+		return
+	}
+	n, e := strconv.Atoi(port)
+	if e != nil || n < 1 || n > 65535 {
+		self.add("%s: port %q out of range", where, port)
+	}
+}
+
+func (self *configCheck) nodes(backs, keepers []string) {
+	if len(backs) == 0 {
+		self.add("Backs: no backends")
+	}
+	if len(keepers) == 0 {
+		self.add("Keepers: no keepers")
+	}
+	for i, b := range backs {
+		self.addr(fmt.Sprintf("Backs[%d]", i), b)
+	}
+	for i, k := range keepers {
+		self.addr(fmt.Sprintf("Keepers[%d]", i), k)
+	}
+}
+
+func (self *configCheck) err(path string) error {
+	if len(self.problems) == 0 {
+		return nil
+	}
+	return &ConfigError{Path: path, Problems: self.problems}
+}
+
+// Checks the whole config, reporting every problem found in one
+// *ConfigError: empty, malformed or reused addresses, missing nodes,
+// replication beyond the backends, TLS files that cannot be read, ACLs
+// with unknown operations or without TLS, bad log levels and unknown
+// fields.
+func (self *Config) Validate() error {
+	ck := newConfigCheck(true)
+	for _, name := range self.unknown {
+		ck.add("%s: unknown field", name)
+	}
+	ck.nodes(self.Backs, self.Keepers)
+
+	if c := self.Cluster; c != nil {
+		if c.Replicas < 0 {
+			ck.add("Cluster.Replicas: %d is negative", c.Replicas)
+		} else if c.Replicas > len(self.Backs) {
+			ck.add("Cluster.Replicas: %d for %d backends", c.Replicas, len(self.Backs))
+		}
+		if len(c.BackAdmins) > len(self.Backs) {
+			ck.add("Cluster.BackAdmins: %d addresses for %d backends", len(c.BackAdmins), len(self.Backs))
+		}
+		if len(c.KeeperAdmins) > len(self.Keepers) {
+			ck.add("Cluster.KeeperAdmins: %d addresses for %d keepers", len(c.KeeperAdmins), len(self.Keepers))
+		}
+		for i, a := range c.BackAdmins {
+			if a != "" {
+				ck.addr(fmt.Sprintf("Cluster.BackAdmins[%d]", i), a)
+			}
+		}
+		for i, a := range c.KeeperAdmins {
+			if a != "" {
+				ck.addr(fmt.Sprintf("Cluster.KeeperAdmins[%d]", i), a)
+			}
+		}
+	}
+
+	if c := self.TLS; c != nil {
+		for _, f := range []struct{ name, path string }{
+			{"TLS.CA", c.CA}, {"TLS.Cert", c.Cert}, {"TLS.Key", c.Key},
+		} {
+			if f.path == "" {
+				ck.add("%s: missing", f.name)
+			} else if _, e := os.Stat(f.path); e != nil {
+				ck.add("%s: %v", f.name, e)
+			}
+		}
+	}
+
+	if c := self.Auth; c != nil {
+		if c.Secret == "" {
+			ck.add("Auth.Secret: missing")
+		}
+		if self.TLS == nil {
+			ck.add("Auth: needs TLS, caller tokens would go in plaintext")
+		}
+		var callers []string
+		for who := range c.ACL {
+			callers = append(callers, who)
+		}
+		sort.Strings(callers)
+		for _, who := range callers {
+			for i, rule := range c.ACL[who] {
+				for _, op := range rule.Ops {
+					if op != ACL_READ && op != ACL_WRITE {
+						ck.add("Auth.ACL[%q][%d]: unknown op %q", who, i, op)
+					}
+				}
+			}
+		}
+	}
+
+	if c := self.Log; c != nil && c.Level != "" {
+		if _, e := ParseLevel(c.Level); e != nil {
+			ck.add("Log.Level: %v", e)
+		}
+	}
+
+	return ck.err(self.path)
+}
+
+// Checks the config a keeper is served with, which may name simulated
+// nodes rather than host:port.
+func checkKeeperConfig(kc *trib.KeeperConfig) error {
+	ck := newConfigCheck(false)
+	ck.nodes(kc.Backs, kc.Addrs)
+	if kc.This < 0 || kc.This >= len(kc.Addrs) {
+		ck.add("This: %d for %d keepers", kc.This, len(kc.Addrs))
+	}
+	return ck.err("keeper config")
+}
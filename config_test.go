@@ -0,0 +1,106 @@
+package triblab_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"trib"
+	"triblab"
+)
+
+func TestConfig(t *testing.T) {
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	load := func(text string) *triblab.Config {
+		rc := filepath.Join(dir, "bins.rc")
+		e := ioutil.WriteFile(rc, []byte(text), 0644)
+		if e != nil {
+			t.Fatal(e)
+		}
+		c, e := triblab.LoadConfig(rc)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return c
+	}
+
+	c := load(`{
+		"Backs": ["localhost:3000", "localhost:3001"],
+		"Keepers": ["localhost:3002"],
+		"Cluster": {"Replicas": 2, "DataDir": "data", "BackAdmins": ["localhost:4000"]},
+		"Log": {"Level": "warn", "File": "bins.log"}
+	}`)
+	if e := c.Validate(); e != nil {
+		t.Fatal(e)
+	}
+	if c.Cluster.DataDir != filepath.Join(dir, "data") || c.Log.File != filepath.Join(dir, "bins.log") {
+		t.Fatalf("paths not resolved: %q %q", c.Cluster.DataDir, c.Log.File)
+	}
+	if rc := c.RC(); len(rc.Backs) != 2 || rc.Keepers[0] != "localhost:3002" {
+		t.Fatalf("rc: %v", rc)
+	}
+
+	c = load(`{
+		"Backs": ["localhost:3000", "localhost:3000", "", "localhost:70000"],
+		"Keepers": ["localhost:3000"],
+		"Kepers": [],
+		"Cluster": {"Replicas": 9, "KeeperAdmins": ["localhost:3000", "x"]},
+		"Auth": {"Secret": "s", "ACL": {"front": [{"Prefix": "", "Ops": ["read", "delete"]}]}},
+		"Log": {"Level": "loud"}
+	}`)
+	e = c.Validate()
+	ce, ok := e.(*triblab.ConfigError)
+	if !ok {
+		t.Fatalf("not a config error: %v", e)
+	}
+	// every problem at once
+	for _, want := range []string{
+		"Kepers: unknown field",
+		`Backs[1]: "localhost:3000" is also Backs[0]`,
+		"Backs[2]: empty address",
+		`Backs[3]: port "70000" out of range`,
+		`Keepers[0]: "localhost:3000" is also Backs[0]`,
+		"Cluster.Replicas: 9 for 4 backends",
+		"Cluster.KeeperAdmins: 2 addresses for 1 keepers",
+		`Cluster.KeeperAdmins[0]: "localhost:3000" is also Backs[0]`,
+		"Cluster.KeeperAdmins[1]: address x: missing port in address",
+		"Auth: needs TLS, caller tokens would go in plaintext",
+		`Auth.ACL["front"][0]: unknown op "delete"`,
+		`Log.Level: unknown log level "loud"`,
+	} {
+		found := false
+		for _, p := range ce.Problems {
+			found = found || p == want
+		}
+		if !found {
+			t.Errorf("no %q in:\n%s", want, strings.Join(ce.Problems, "\n"))
+		}
+	}
+	if len(ce.Problems) != 12 {
+		t.Errorf("%d problems:\n%s", len(ce.Problems), strings.Join(ce.Problems, "\n"))
+	}
+
+	// keepers refuse configs they cannot run
+	ready := make(chan bool, 1)
+	e = triblab.ServeKeeper(&trib.KeeperConfig{
+		Backs: []string{"localhost:3000"},
+		Addrs: []string{"localhost:3000"},
+		This:  1,
+		Ready: ready,
+	})
+	if e == nil || <-ready {
+		t.Fatal("keeper served a bad config")
+	}
+	for _, want := range []string{"is also Backs[0]", "This: 1 for 1 keepers"} {
+		if !strings.Contains(e.Error(), want) {
+			t.Fatalf("no %q in %v", want, e)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package triblab
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"trib"
+)
+
+// Returned by calls whose reply a fault dropped. The call itself was
+// done.
+var ErrDropped = errors.New("reply dropped by fault injection")
+
+// Returned by calls failed by a rule without an error of its own.
+var ErrInjected = errors.New("fault injected")
+
+// When and how a fault hits storage calls. A call is hit by the first
+// rule that matches it.
+type FaultRule struct {
+	Method string // e.g. "Set", "" for every method
+	Skip   int    // matching calls let through before the rule applies
+	Times  int    // calls the rule applies to after those, 0 for all
+
+	Delay time.Duration // before the call is done, or failed
+	Fail  bool          // fail the call without doing it
+	Err   error         // what failed calls return, ErrInjected if nil
+	Drop  bool          // do the call, but return ErrDropped
+}
+
+type faultRule struct {
+	FaultRule
+	seen int // matching calls so far
+}
+
+// A script of faults for storage calls, changed as a test goes on.
+type Faults struct {
+	lock  sync.Mutex
+	rules []*faultRule
+}
+
+func NewFaults() *Faults {
+	return new(Faults)
+}
+
+// Adds a rule after the ones already there.
+func (self *Faults) Add(r FaultRule) {
+	self.lock.Lock()
+	self.rules = append(self.rules, &faultRule{FaultRule: r})
+	self.lock.Unlock()
+}
+
+// Removes every rule, letting all calls through.
+func (self *Faults) Clear() {
+	self.lock.Lock()
+	self.rules = nil
+	self.lock.Unlock()
+}
+
+// Fails every call until Clear, as if the storage were cut off.
+func (self *Faults) Partition() {
+	self.Add(FaultRule{Fail: true, Err: errors.New("partitioned by fault injection")})
+}
+
+// The rule hitting a call of method, counting the call against it.
+func (self *Faults) match(method string) *FaultRule {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for _, r := range self.rules {
+		if r.Method != "" && r.Method != method {
+			continue
+		}
+		r.seen++
+		if r.seen <= r.Skip {
+			continue
+		}
+		if r.Times > 0 && r.seen > r.Skip+r.Times {
+			continue
+		}
+		ret := r.FaultRule
+		return &ret
+	}
+	return nil
+}
+
+// Injects the faults into calls going through an interceptor chain.
+func (self *Faults) Interceptor() Interceptor {
+	return func(c *Call, next func() error) error {
+		r := self.match(c.Method)
+		if r == nil {
+			return next()
+		}
+
+		time.Sleep(r.Delay)
+		if r.Fail {
+			if r.Err != nil {
+				return r.Err
+			}
+			return ErrInjected
+		}
+		e := next()
+		if r.Drop && e == nil {
+			return ErrDropped
+		}
+		return e
+	}
+}
+
+// Wraps s so that its calls are hit by the faults, e.g. as the Store of
+// a trib.BackConfig.
+func FaultyStorage(s trib.Storage, f *Faults) Storage {
+	return Intercept(s, f.Interceptor())
+}
+
+// Forwards TCP connections to a target address, with faults on the way.
+// Clients dial Addr instead of the target.
+type FaultProxy struct {
+	Addr string
+
+	target string
+	l      net.Listener
+
+	lock        sync.Mutex
+	delay       time.Duration
+	partitioned bool
+	dropReplies bool
+	conns       map[net.Conn]bool
+}
+
+// Starts a proxy to target on a free local port.
+func NewFaultProxy(target string) (*FaultProxy, error) {
+	l, e := net.Listen("tcp", "localhost:0")
+	if e != nil {
+		return nil, e
+	}
+
+	ret := &FaultProxy{
+		Addr:   l.Addr().String(),
+		target: target,
+		l:      l,
+		conns:  make(map[net.Conn]bool),
+	}
+	go ret.serve()
+	return ret, nil
+}
+
+// Holds every chunk of data by d, both ways.
+func (self *FaultProxy) SetDelay(d time.Duration) {
+	self.lock.Lock()
+	self.delay = d
+	self.lock.Unlock()
+}
+
+// Cuts the open connections and turns new ones away until Heal.
+func (self *FaultProxy) Partition() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.partitioned = true
+	for c := range self.conns {
+		c.Close()
+	}
+}
+
+// Undoes Partition.
+func (self *FaultProxy) Heal() {
+	self.lock.Lock()
+	self.partitioned = false
+	self.lock.Unlock()
+}
+
+// While on, requests reach the target but the connection is cut as soon
+// as the target answers, so that callers never see the reply.
+func (self *FaultProxy) DropReplies(on bool) {
+	self.lock.Lock()
+	self.dropReplies = on
+	self.lock.Unlock()
+}
+
+// Stops the proxy and cuts its connections.
+func (self *FaultProxy) Close() error {
+	e := self.l.Close()
+	self.Partition()
+	return e
+}
+
+func (self *FaultProxy) serve() {
+	for {
+		conn, e := self.l.Accept()
+		if e != nil {
+			return
+		}
+		go self.forward(conn)
+	}
+}
+
+// Registers c, unless partitioned.
+func (self *FaultProxy) track(c net.Conn) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.partitioned {
+		return false
+	}
+	self.conns[c] = true
+	return true
+}
+
+func (self *FaultProxy) untrack(c net.Conn) {
+	self.lock.Lock()
+	delete(self.conns, c)
+	self.lock.Unlock()
+}
+
+func (self *FaultProxy) forward(conn net.Conn) {
+	if !self.track(conn) {
+		conn.Close()
+		return
+	}
+	defer self.untrack(conn)
+	defer conn.Close()
+
+	back, e := net.Dial("tcp", self.target)
+	if e != nil {
+		return
+	}
+	if !self.track(back) {
+		back.Close()
+		return
+	}
+	defer self.untrack(back)
+	defer back.Close()
+
+	done := make(chan bool, 2)
+	go func() {
+		self.copy(back, conn, false)
+		done <- true
+	}()
+	go func() {
+		self.copy(conn, back, true)
+		done <- true
+	}()
+
+	// either way closing ends the other
+	<-done
+}
+
+func (self *FaultProxy) copy(dst io.Writer, src io.Reader, replies bool) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, e := src.Read(buf)
+		if n > 0 {
+			self.lock.Lock()
+			delay, drop := self.delay, replies && self.dropReplies
+			self.lock.Unlock()
+
+			// the answer to an HTTP CONNECT only opens the way for calls
+			if drop && !bytes.HasPrefix(buf[:n], []byte(rpcConnected)) {
+				return
+			}
+			time.Sleep(delay)
+			if _, e := dst.Write(buf[:n]); e != nil {
+				return
+			}
+		}
+		if e != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package triblab_test
+
+import (
+	"testing"
+	"time"
+
+	"trib"
+	"trib/randaddr"
+	"trib/store"
+	"trib/tribtest"
+	"triblab"
+)
+
+func TestFaults(t *testing.T) {
+	f := triblab.NewFaults()
+	s := triblab.FaultyStorage(store.NewStorage(), f)
+	tribtest.CheckStorage(t, s)
+
+	var succ bool
+	var v string
+	f.Add(triblab.FaultRule{Method: "Get", Skip: 1, Times: 1, Fail: true})
+	for i, fail := range []bool{false, true, false} {
+		e := s.Get("k", &v)
+		if (e == triblab.ErrInjected) != fail {
+			t.Fatalf("get %d: %v", i, e)
+		}
+	}
+
+	f.Clear()
+	f.Add(triblab.FaultRule{Method: "Set", Drop: true})
+	if e := s.Set(trib.KV("dropped", "done"), &succ); e != triblab.ErrDropped {
+		t.Fatal("set not dropped:", e)
+	}
+	if e := s.Get("dropped", &v); e != nil || v != "done" {
+		t.Fatalf("dropped set not done: %q %v", v, e)
+	}
+
+	f.Clear()
+	f.Add(triblab.FaultRule{Method: "Get", Delay: 50 * time.Millisecond})
+	start := time.Now()
+	if e := s.Get("k", &v); e != nil {
+		t.Fatal(e)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("get not delayed")
+	}
+
+	// under a backend
+	f.Clear()
+	addr := randaddr.Local()
+	ready := make(chan bool)
+	go func() {
+		e := triblab.ServeBack(&trib.BackConfig{Addr: addr, Store: s, Ready: ready})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-ready {
+		t.Fatal("not ready")
+	}
+
+	c := triblab.NewClient(addr)
+	f.Partition()
+	if e := c.Get("k", &v); e == nil {
+		t.Fatal("get through a partition")
+	}
+	f.Clear()
+	if e := c.Get("k", &v); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestFaultProxy(t *testing.T) {
+	addr := randaddr.Local()
+	ready := make(chan bool)
+	go func() {
+		e := triblab.ServeBack(&trib.BackConfig{Addr: addr, Store: store.NewStorage(), Ready: ready})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-ready {
+		t.Fatal("not ready")
+	}
+
+	p, e := triblab.NewFaultProxy(addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer p.Close()
+
+	c := triblab.NewClient(p.Addr)
+	tribtest.CheckStorage(t, c)
+
+	var succ bool
+	var v string
+	p.Partition()
+	if e := c.Get("k", &v); e == nil {
+		t.Fatal("get through a partition")
+	}
+	p.Heal()
+	if e := c.Get("k", &v); e != nil {
+		t.Fatal(e)
+	}
+
+	p.DropReplies(true)
+	if e := c.Set(trib.KV("dropped", "done"), &succ); e == nil {
+		t.Fatal("reply not dropped")
+	}
+	p.DropReplies(false)
+	if e := triblab.NewClient(addr).Get("dropped", &v); e != nil || v != "done" {
+		t.Fatalf("dropped set not done: %q %v", v, e)
+	}
+
+	p.SetDelay(50 * time.Millisecond)
+	start := time.Now()
+	if e := c.Get("k", &v); e != nil {
+		t.Fatal(e)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("get not delayed")
+	}
+}
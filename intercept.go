@@ -0,0 +1,290 @@
+package triblab
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"trib"
+)
+
+// A storage call on its way through an interceptor chain.
+type Call struct {
+	Method string      // e.g. "Get"
+	Args   interface{} // the first argument of the method
+	Reply  interface{} // the pointer the result goes to
+	Start  time.Time   // when the call entered the chain
+}
+
+// Time since the call entered the chain.
+func (self *Call) Latency() time.Duration {
+	return time.Since(self.Start)
+}
+
+// Middleware around storage calls. Goes on with the call by calling
+// next, which returns the error of the rest of the chain; Reply is
+// filled in once next returns. An interceptor may also answer the call
+// itself and not call next at all.
+type Interceptor func(c *Call, next func() error) error
+
+// Wraps s so that every call goes through chain, the first interceptor
+// seeing the call first.
+func Intercept(s trib.Storage, chain ...Interceptor) Storage {
+	return &intercepted{s: extend(s), chain: chain}
+}
+
+type intercepted struct {
+	s     Storage
+	chain []Interceptor
+}
+
+func (self *intercepted) call(method string, args, reply interface{}, f func() error) error {
+	c := &Call{Method: method, Args: args, Reply: reply, Start: time.Now()}
+
+	var next func(i int) error
+	next = func(i int) error {
+		if i == len(self.chain) {
+			return f()
+		}
+		return self.chain[i](c, func() error { return next(i + 1) })
+	}
+	return next(0)
+}
+
+func (self *intercepted) Get(key string, value *string) error {
+	return self.call("Get", key, value, func() error {
+		return self.s.Get(key, value)
+	})
+}
+
+func (self *intercepted) Set(kv *trib.KeyValue, succ *bool) error {
+	return self.call("Set", kv, succ, func() error {
+		return self.s.Set(kv, succ)
+	})
+}
+
+func (self *intercepted) Keys(p *trib.Pattern, list *trib.List) error {
+	return self.call("Keys", p, list, func() error {
+		return self.s.Keys(p, list)
+	})
+}
+
+func (self *intercepted) ListGet(key string, list *trib.List) error {
+	return self.call("ListGet", key, list, func() error {
+		return self.s.ListGet(key, list)
+	})
+}
+
+func (self *intercepted) ListAppend(kv *trib.KeyValue, succ *bool) error {
+	return self.call("ListAppend", kv, succ, func() error {
+		return self.s.ListAppend(kv, succ)
+	})
+}
+
+func (self *intercepted) ListRemove(kv *trib.KeyValue, n *int) error {
+	return self.call("ListRemove", kv, n, func() error {
+		return self.s.ListRemove(kv, n)
+	})
+}
+
+func (self *intercepted) ListKeys(p *trib.Pattern, list *trib.List) error {
+	return self.call("ListKeys", p, list, func() error {
+		return self.s.ListKeys(p, list)
+	})
+}
+
+func (self *intercepted) Clock(atLeast uint64, ret *uint64) error {
+	return self.call("Clock", atLeast, ret, func() error {
+		return self.s.Clock(atLeast, ret)
+	})
+}
+
+func (self *intercepted) Scan(args *ScanArgs, page *ScanPage) error {
+	return self.call("Scan", args, page, func() error {
+		return self.s.Scan(args, page)
+	})
+}
+
+func (self *intercepted) ListRange(args *RangeArgs, list *trib.List) error {
+	return self.call("ListRange", args, list, func() error {
+		return self.s.ListRange(args, list)
+	})
+}
+
+func (self *intercepted) ListLen(key string, n *int) error {
+	return self.call("ListLen", key, n, func() error {
+		return self.s.ListLen(key, n)
+	})
+}
+
+func (self *intercepted) ListTrim(args *TrimArgs, n *int) error {
+	return self.call("ListTrim", args, n, func() error {
+		return self.s.ListTrim(args, n)
+	})
+}
+
+func (self *intercepted) SetWithTTL(args *TTLArgs, succ *bool) error {
+	return self.call("SetWithTTL", args, succ, func() error {
+		return self.s.SetWithTTL(args, succ)
+	})
+}
+
+func (self *intercepted) ListExpire(args *ExpireArgs, succ *bool) error {
+	return self.call("ListExpire", args, succ, func() error {
+		return self.s.ListExpire(args, succ)
+	})
+}
+
+func (self *intercepted) Incr(args *IncrArgs, ret *int64) error {
+	return self.call("Incr", args, ret, func() error {
+		return self.s.Incr(args, ret)
+	})
+}
+
+func (self *intercepted) Watch(args *WatchArgs, ret *WatchResult) error {
+	return self.call("Watch", args, ret, func() error {
+		return self.s.Watch(args, ret)
+	})
+}
+
+func (self *intercepted) GetVersioned(args *VersionArgs, ret *Versioned) error {
+	return self.call("GetVersioned", args, ret, func() error {
+		return self.s.GetVersioned(args, ret)
+	})
+}
+
+func (self *intercepted) Commit(args *CommitArgs, committed *bool) error {
+	return self.call("Commit", args, committed, func() error {
+		return self.s.Commit(args, committed)
+	})
+}
+
+func (self *intercepted) Prepare(args *PrepareArgs, ok *bool) error {
+	return self.call("Prepare", args, ok, func() error {
+		return self.s.Prepare(args, ok)
+	})
+}
+
+func (self *intercepted) Decide(args *DecideArgs, ret *Decision) error {
+	return self.call("Decide", args, ret, func() error {
+		return self.s.Decide(args, ret)
+	})
+}
+
+func (self *intercepted) InDoubt(age time.Duration, ids *[]string) error {
+	return self.call("InDoubt", age, ids, func() error {
+		return self.s.InDoubt(age, ids)
+	})
+}
+
+var _ Storage = new(intercepted)
+
+// Logs every call to l at LOG_DEBUG, with its latency and error if any.
+// Nil l logs to the one given to SetLogger.
+func LogCalls(l *Logger) Interceptor {
+	return func(c *Call, next func() error) error {
+		e := next()
+		if !l.Enabled(LOG_DEBUG) {
+			return e
+		}
+		if e != nil {
+			l.Debug("call", "method", "Storage."+c.Method, "args", fmt.Sprint(c.Args),
+				"latency", c.Latency(), "error", e)
+		} else {
+			l.Debug("call", "method", "Storage."+c.Method, "args", fmt.Sprint(c.Args),
+				"latency", c.Latency())
+		}
+		return e
+	}
+}
+
+// Upper bounds of the latency histogram buckets of MethodStats.
+var LATENCY_BUCKETS = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Counters of one method.
+type MethodStats struct {
+	Calls   int64
+	Errors  int64
+	Total   time.Duration // summed latency
+	Max     time.Duration
+	Buckets []int64 // calls by latency, over LATENCY_BUCKETS
+}
+
+// Collects MethodStats of the calls going through its Interceptor.
+type Metrics struct {
+	lock    sync.Mutex
+	methods map[string]*MethodStats
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{methods: make(map[string]*MethodStats)}
+}
+
+func (self *Metrics) Interceptor() Interceptor {
+	return func(c *Call, next func() error) error {
+		e := next()
+		self.record(c.Method, c.Latency(), e)
+		return e
+	}
+}
+
+func (self *Metrics) record(method string, latency time.Duration, e error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	st, found := self.methods[method]
+	if !found {
+		st = &MethodStats{Buckets: make([]int64, len(LATENCY_BUCKETS))}
+		self.methods[method] = st
+	}
+	st.Calls++
+	if e != nil {
+		st.Errors++
+	}
+	st.Total += latency
+	if latency > st.Max {
+		st.Max = latency
+	}
+	for i, bound := range LATENCY_BUCKETS {
+		if latency <= bound {
+			st.Buckets[i]++
+			break
+		}
+	}
+}
+
+// Copy of the stats so far, by method.
+func (self *Metrics) Snapshot() map[string]MethodStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	ret := make(map[string]MethodStats, len(self.methods))
+	for m, st := range self.methods {
+		cp := *st
+		cp.Buckets = append([]int64(nil), st.Buckets...)
+		ret[m] = cp
+	}
+	return ret
+}
+
+// Names of the methods called so far, sorted.
+func (self *Metrics) Methods() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	ret := make([]string, 0, len(self.methods))
+	for m := range self.methods {
+		ret = append(ret, m)
+	}
+	sort.Strings(ret)
+	return ret
+}
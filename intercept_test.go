@@ -0,0 +1,109 @@
+package triblab_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"trib"
+	"trib/randaddr"
+	"trib/store"
+	"trib/tribtest"
+	"triblab"
+)
+
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (self *syncBuffer) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.buf.Write(p)
+}
+
+func (self *syncBuffer) String() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.buf.String()
+}
+
+func TestIntercept(t *testing.T) {
+	var order []string
+	trace := func(name string) triblab.Interceptor {
+		return func(c *triblab.Call, next func() error) error {
+			order = append(order, name+">"+c.Method)
+			e := next()
+			order = append(order, name+"<"+c.Method)
+			return e
+		}
+	}
+
+	m := triblab.NewMetrics()
+	s := triblab.Intercept(store.NewStorage(), trace("a"), trace("b"), m.Interceptor())
+	tribtest.CheckStorage(t, s)
+
+	order = nil
+	var v string
+	if e := s.Get("k", &v); e != nil {
+		t.Fatal(e)
+	}
+	if fmt.Sprint(order) != "[a>Get b>Get b<Get a<Get]" {
+		t.Fatal("bad order:", order)
+	}
+	if st := m.Snapshot()["Get"]; st.Calls == 0 || st.Errors != 0 {
+		t.Fatalf("bad Get stats: %+v", st)
+	}
+
+	// an interceptor may answer for the storage
+	deny := func(c *triblab.Call, next func() error) error {
+		if c.Method == "Set" {
+			return fmt.Errorf("read only")
+		}
+		return next()
+	}
+	s = triblab.Intercept(store.NewStorage(), m.Interceptor(), deny)
+	var succ bool
+	if e := s.Set(trib.KV("k", "v"), &succ); e == nil {
+		t.Fatal("Set got past the interceptor")
+	}
+	if st := m.Snapshot()["Set"]; st.Errors != 1 {
+		t.Fatalf("bad Set stats: %+v", st)
+	}
+
+	// and the same through ServeBack
+	var out syncBuffer
+	bm := triblab.NewMetrics()
+	addr := randaddr.Local()
+	ready := make(chan bool)
+	go func() {
+		b := &trib.BackConfig{Addr: addr, Store: store.NewStorage(), Ready: ready}
+		e := triblab.ServeBackWith(b, &triblab.BackOptions{
+			Interceptors: []triblab.Interceptor{triblab.LogCalls(triblab.NewLogger(&out, triblab.LOG_DEBUG)), bm.Interceptor()},
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-ready {
+		t.Fatal("not ready")
+	}
+
+	c := triblab.NewClient(addr)
+	if e := c.Set(trib.KV("hello", "world"), &succ); e != nil {
+		t.Fatal(e)
+	}
+	var l trib.List
+	if e := c.ListGet("l", &l); e != nil {
+		t.Fatal(e)
+	}
+	if !strings.Contains(out.String(), "method=Storage.Set args=") {
+		t.Fatalf("Set not logged: %q", out.String())
+	}
+	if fmt.Sprint(bm.Methods()) != "[ListGet Set]" {
+		t.Fatal("bad methods:", bm.Methods())
+	}
+}
@@ -0,0 +1,528 @@
+package triblab
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// address prefix that makes clients speak JSON-RPC over TCP
+	JSONRPC_SCHEME = "jsonrpc://"
+
+	// path of the JSON-RPC over HTTP POST endpoint
+	JSONRPC_PATH = "/jsonrpc"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	JSONRPC_PARSE_ERROR      = -32700
+	JSONRPC_INVALID_REQUEST  = -32600
+	JSONRPC_METHOD_NOT_FOUND = -32601
+	JSONRPC_INVALID_PARAMS   = -32602
+	JSONRPC_SERVER_ERROR     = -32000
+	JSONRPC_UNAUTHORIZED     = -32001
+	JSONRPC_OVERLOADED       = -32002
+)
+
+type jsonRequest struct {
+	Version string           `json:"jsonrpc"`
+	Method  string           `json:"method"`
+	Params  *json.RawMessage `json:"params,omitempty"`
+	Id      *json.RawMessage `json:"id,omitempty"`
+
+	// caller token, only looked at in the first request of a
+	// connection
+	Auth string `json:"auth,omitempty"`
+
+	// trace context, see TRACE_HEADER
+	Trace string `json:"trace,omitempty"`
+}
+
+type jsonError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type jsonResponse struct {
+	Version string           `json:"jsonrpc"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *jsonError       `json:"error,omitempty"`
+	Id      *json.RawMessage `json:"id"`
+}
+
+type jsonClientResponse struct {
+	Version string           `json:"jsonrpc"`
+	Result  *json.RawMessage `json:"result"`
+	Error   *jsonError       `json:"error"`
+	Id      *json.RawMessage `json:"id"`
+}
+
+var jsonNull = json.RawMessage("null")
+
+// Server side of JSON-RPC 2.0, one request or response per JSON value.
+// Method names and params are the same as for the gob protocol, e.g.
+// {"jsonrpc": "2.0", "method": "Storage.Get", "params": ["key"], "id": 1}.
+// Params may also be given as a single object instead of an array. A
+// batch, an array of requests, is answered with one array of responses
+// once all of its calls are done.
+type jsonServerCodec struct {
+	dec *json.Decoder
+	enc *json.Encoder
+	c   io.Closer
+
+	req    jsonRequest
+	params *json.RawMessage
+	next   json.RawMessage // read ahead by peek
+	queue  []json.RawMessage
+	batch  *jsonBatch // of the queued requests
+
+	lock    sync.Mutex
+	seq     uint64
+	pending map[uint64]*json.RawMessage // id of each request, nil for notifications
+	errs    map[uint64]*jsonError       // errors found while reading
+	batches map[uint64]*jsonBatch       // of the requests read in one
+}
+
+// Responses of a batch, sent once none is left to come.
+type jsonBatch struct {
+	left  int
+	resps []*jsonResponse
+}
+
+func newJSONServerCodec(r io.Reader, w io.Writer, c io.Closer) *jsonServerCodec {
+	return &jsonServerCodec{
+		dec:     json.NewDecoder(r),
+		enc:     json.NewEncoder(w),
+		c:       c,
+		pending: make(map[uint64]*json.RawMessage),
+		errs:    make(map[uint64]*jsonError),
+		batches: make(map[uint64]*jsonBatch),
+	}
+}
+
+func (self *jsonServerCodec) read() (json.RawMessage, error) {
+	if self.next != nil {
+		raw := self.next
+		self.next = nil
+		return raw, nil
+	}
+
+	var raw json.RawMessage
+	e := self.dec.Decode(&raw)
+	if e != nil {
+		if e == io.EOF || e == io.ErrUnexpectedEOF {
+			return nil, e
+		}
+		// the stream cannot be trusted anymore
+		self.writeError(&jsonNull, JSONRPC_PARSE_ERROR, e.Error())
+		return nil, e
+	}
+	return raw, nil
+}
+
+// Reads the next request, taking batches apart.
+func (self *jsonServerCodec) readOne() (json.RawMessage, error) {
+	for len(self.queue) == 0 {
+		raw, e := self.read()
+		if e != nil {
+			return nil, e
+		}
+		self.batch = nil
+
+		reqs, ok := batchOf(raw)
+		if !ok {
+			return raw, nil
+		}
+		if len(reqs) == 0 {
+			self.writeError(&jsonNull, JSONRPC_INVALID_REQUEST, "empty batch")
+			continue
+		}
+		self.queue = reqs
+		self.batch = &jsonBatch{left: len(reqs)}
+	}
+
+	raw := self.queue[0]
+	self.queue = self.queue[1:]
+	return raw, nil
+}
+
+// Checks if more requests of a batch are to be read.
+func (self *jsonServerCodec) more() bool {
+	return len(self.queue) > 0
+}
+
+// The requests of a batch, false if raw is a single request.
+func batchOf(raw json.RawMessage) ([]json.RawMessage, bool) {
+	p := bytes.TrimSpace(raw)
+	if len(p) == 0 || p[0] != '[' {
+		return nil, false
+	}
+	var reqs []json.RawMessage
+	json.Unmarshal(p, &reqs)
+	return reqs, true
+}
+
+// Reads ahead the next request and returns the caller token it carries,
+// that of the first request of a batch.
+func (self *jsonServerCodec) peek() (string, error) {
+	raw, e := self.read()
+	if e != nil {
+		return "", e
+	}
+	self.next = raw
+
+	if reqs, ok := batchOf(raw); ok {
+		if len(reqs) == 0 {
+			return "", nil
+		}
+		raw = reqs[0]
+	}
+	var req jsonRequest
+	json.Unmarshal(raw, &req)
+	return req.Auth, nil
+}
+
+// Answers the peeked request, or every request of the peeked batch,
+// with an error.
+func (self *jsonServerCodec) reject(code int, e error) error {
+	raw := self.next
+	self.next = nil
+	reqs, ok := batchOf(raw)
+	if !ok {
+		reqs = []json.RawMessage{raw}
+	}
+
+	var resps []*jsonResponse
+	for _, raw := range reqs {
+		var req jsonRequest
+		json.Unmarshal(raw, &req)
+		if req.Id != nil {
+			resps = append(resps, &jsonResponse{
+				Version: "2.0",
+				Error:   &jsonError{Code: code, Message: e.Error()},
+				Id:      req.Id,
+			})
+		}
+	}
+	if len(resps) == 0 {
+		return nil
+	}
+	if !ok {
+		return self.enc.Encode(resps[0])
+	}
+	return self.enc.Encode(resps)
+}
+
+func (self *jsonServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	raw, e := self.readOne()
+	if e != nil {
+		return e
+	}
+
+	self.req = jsonRequest{}
+	var bad *jsonError
+	e = json.Unmarshal(raw, &self.req)
+	if e != nil {
+		bad = &jsonError{JSONRPC_INVALID_REQUEST, "invalid request: " + e.Error()}
+		self.req.Id = &jsonNull
+	} else if self.req.Version != "2.0" || self.req.Method == "" {
+		bad = &jsonError{JSONRPC_INVALID_REQUEST, "invalid request"}
+		if self.req.Id == nil {
+			self.req.Id = &jsonNull
+		}
+	}
+
+	self.lock.Lock()
+	self.seq++
+	r.Seq = self.seq
+	self.pending[r.Seq] = self.req.Id
+	if self.batch != nil {
+		self.batches[r.Seq] = self.batch
+	}
+	if bad != nil {
+		self.errs[r.Seq] = bad
+		// no such method, so that the server answers with an error
+		r.ServiceMethod = "jsonrpc.invalid"
+	} else {
+		r.ServiceMethod = self.req.Method
+	}
+	self.lock.Unlock()
+
+	self.params = self.req.Params
+	return nil
+}
+
+// Trace context of the request last read.
+func (self *jsonServerCodec) traceparent() string {
+	return self.req.Trace
+}
+
+func (self *jsonServerCodec) ReadRequestBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+
+	e := unmarshalParams(self.params, x)
+	if e != nil {
+		self.lock.Lock()
+		self.errs[self.seq] = &jsonError{Code: JSONRPC_INVALID_PARAMS}
+		self.lock.Unlock()
+	}
+	return e
+}
+
+// Params are either [arg] or arg itself.
+func unmarshalParams(params *json.RawMessage, x interface{}) error {
+	if params == nil {
+		return errors.New("missing params")
+	}
+
+	p := bytes.TrimSpace(*params)
+	if len(p) > 0 && p[0] == '[' {
+		var args []json.RawMessage
+		e := json.Unmarshal(p, &args)
+		if e != nil {
+			return e
+		}
+		if len(args) != 1 {
+			return fmt.Errorf("expected 1 param, got %d", len(args))
+		}
+		p = args[0]
+	}
+	return json.Unmarshal(p, x)
+}
+
+func (self *jsonServerCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	self.lock.Lock()
+	id, found := self.pending[r.Seq]
+	bad := self.errs[r.Seq]
+	batch := self.batches[r.Seq]
+	delete(self.pending, r.Seq)
+	delete(self.errs, r.Seq)
+	delete(self.batches, r.Seq)
+	self.lock.Unlock()
+
+	if !found {
+		return fmt.Errorf("unknown request %d", r.Seq)
+	}
+	resp := self.response(id, bad, r, x)
+	if batch == nil {
+		if resp == nil {
+			return nil
+		}
+		return self.enc.Encode(resp)
+	}
+
+	self.lock.Lock()
+	if resp != nil {
+		batch.resps = append(batch.resps, resp)
+	}
+	batch.left--
+	done := batch.left == 0
+	self.lock.Unlock()
+
+	// a batch of notifications gets nothing back
+	if !done || len(batch.resps) == 0 {
+		return nil
+	}
+	return self.enc.Encode(batch.resps)
+}
+
+// The response to request id, nil for notifications.
+func (self *jsonServerCodec) response(id *json.RawMessage, bad *jsonError, r *rpc.Response, x interface{}) *jsonResponse {
+	if id == nil {
+		return nil
+	}
+	if r.Error == "" {
+		return &jsonResponse{Version: "2.0", Result: x, Id: id}
+	}
+
+	if bad == nil {
+		bad = &jsonError{Code: JSONRPC_SERVER_ERROR}
+		if strings.HasPrefix(r.Error, "rpc: can't find") {
+			bad.Code = JSONRPC_METHOD_NOT_FOUND
+		} else if strings.HasPrefix(r.Error, ErrOverloaded.Error()) {
+			bad.Code = JSONRPC_OVERLOADED
+		}
+	}
+	if bad.Message == "" {
+		bad.Message = r.Error
+	}
+	return &jsonResponse{Version: "2.0", Error: bad, Id: id}
+}
+
+func (self *jsonServerCodec) writeError(id *json.RawMessage, code int, msg string) error {
+	return self.enc.Encode(&jsonResponse{
+		Version: "2.0",
+		Error:   &jsonError{Code: code, Message: msg},
+		Id:      id,
+	})
+}
+
+func (self *jsonServerCodec) Close() error {
+	if self.c == nil {
+		return nil
+	}
+	return self.c.Close()
+}
+
+// Client side of JSON-RPC 2.0, params always sent as [arg].
+type jsonClientCodec struct {
+	dec *json.Decoder
+	enc *json.Encoder
+	c   io.Closer
+
+	token string // sent along with every request
+	trace string // likewise
+	resp  jsonClientResponse
+}
+
+func newJSONClientCodec(conn io.ReadWriteCloser, token, trace string) *jsonClientCodec {
+	return &jsonClientCodec{
+		dec:   json.NewDecoder(bufio.NewReader(conn)),
+		enc:   json.NewEncoder(conn),
+		c:     conn,
+		token: token,
+		trace: trace,
+	}
+}
+
+func (self *jsonClientCodec) WriteRequest(r *rpc.Request, x interface{}) error {
+	params, e := json.Marshal([]interface{}{x})
+	if e != nil {
+		return e
+	}
+	id := json.RawMessage(strconv.FormatUint(r.Seq, 10))
+	p := json.RawMessage(params)
+	return self.enc.Encode(&jsonRequest{
+		Version: "2.0",
+		Method:  r.ServiceMethod,
+		Params:  &p,
+		Id:      &id,
+		Auth:    self.token,
+		Trace:   self.trace,
+	})
+}
+
+func (self *jsonClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	self.resp = jsonClientResponse{}
+	e := self.dec.Decode(&self.resp)
+	if e != nil {
+		return e
+	}
+	if self.resp.Id == nil {
+		return errors.New("jsonrpc: response without id")
+	}
+
+	seq, e := strconv.ParseUint(string(*self.resp.Id), 10, 64)
+	if e != nil {
+		// a parse error of ours, answered with a null id
+		if self.resp.Error != nil {
+			return fmt.Errorf("jsonrpc: %s", self.resp.Error.Message)
+		}
+		return fmt.Errorf("jsonrpc: bad response id %s", *self.resp.Id)
+	}
+
+	r.Seq = seq
+	r.Error = ""
+	if self.resp.Error != nil {
+		r.Error = self.resp.Error.Message
+		if r.Error == "" {
+			r.Error = fmt.Sprintf("jsonrpc error %d", self.resp.Error.Code)
+		}
+	}
+	return nil
+}
+
+func (self *jsonClientCodec) ReadResponseBody(x interface{}) error {
+	if x == nil || self.resp.Result == nil {
+		return nil
+	}
+	return json.Unmarshal(*self.resp.Result, x)
+}
+
+func (self *jsonClientCodec) Close() error {
+	return self.c.Close()
+}
+
+// Dials an RPC server, over JSON-RPC if addr starts with JSONRPC_SCHEME
+// and with gob over HTTP otherwise. Uses TLS unless conf is nil, and
+// presents token unless empty. The call made over the connection is
+// traced as a child of parent, if any, until the connection is closed.
+func dial(addr string, conf *tls.Config, token string, parent *Span) (*rpcConn, error) {
+	sp := parent.Child("dial", SPAN_CLIENT)
+	sp.SetAttr("peer", addr)
+
+	c, e := dialRPC(addr, conf, token, sp.Traceparent())
+	if e != nil {
+		sp.SetError(e)
+		sp.Finish()
+		return nil, e
+	}
+	return &rpcConn{rpcCaller: c, span: sp}, nil
+}
+
+func dialRPC(addr string, conf *tls.Config, token, trace string) (*rpc.Client, error) {
+	json := strings.HasPrefix(addr, JSONRPC_SCHEME)
+	addr = strings.TrimPrefix(addr, JSONRPC_SCHEME)
+	if !json && conf == nil && token == "" && trace == "" {
+		return rpc.DialHTTP("tcp", addr)
+	}
+
+	var conn net.Conn
+	var e error
+	if conf != nil {
+		conn, e = tls.Dial("tcp", addr, conf)
+	} else {
+		conn, e = net.Dial("tcp", addr)
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	if json {
+		return rpc.NewClientWithCodec(newJSONClientCodec(conn, token, trace)), nil
+	}
+
+	// same handshake as rpc.DialHTTP
+	req := "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n"
+	if token != "" {
+		req += "Authorization: Bearer " + token + "\n"
+	}
+	if trace != "" {
+		req += TRACE_HEADER + ": " + trace + "\n"
+	}
+	io.WriteString(conn, req+"\n")
+	resp, e := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if e == nil && resp.Status != "200 Connected to Go RPC" {
+		e = fmt.Errorf("unexpected HTTP response: %s", resp.Status)
+	}
+	if e != nil {
+		conn.Close()
+		return nil, e
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// Listens on addr, with TLS unless conf is nil.
+func listen(addr string, conf *tls.Config) (net.Listener, error) {
+	l, e := net.Listen("tcp", addr)
+	if e != nil {
+		return nil, e
+	}
+	if conf != nil {
+		l = tls.NewListener(l, conf)
+	}
+	return l, nil
+}
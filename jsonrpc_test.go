@@ -0,0 +1,191 @@
+package triblab_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"trib"
+	"trib/randaddr"
+	"trib/store"
+	"trib/tribtest"
+	"triblab"
+)
+
+type jsonReply struct {
+	Result json.RawMessage
+	Error  *struct {
+		Code    int
+		Message string
+	}
+	Id json.RawMessage
+}
+
+func TestJSONRPC(t *testing.T) {
+	addr := randaddr.Local()
+	jaddr := randaddr.Local()
+	for jaddr == addr {
+		jaddr = randaddr.Local()
+	}
+	ready := make(chan bool)
+
+	go func() {
+		b := &trib.BackConfig{Addr: addr, Store: store.NewStorage(), Ready: ready}
+		e := triblab.ServeBackWith(b, &triblab.BackOptions{JSONAddr: jaddr})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-ready {
+		t.Fatal("not ready")
+	}
+
+	c := triblab.NewClient(triblab.JSONRPC_SCHEME + jaddr)
+	tribtest.CheckStorage(t, c)
+
+	// gob still works next to it
+	var v string
+	if e := triblab.NewClient(addr).Get("hello", &v); e != nil {
+		t.Fatal(e)
+	}
+
+	post := func(body string) *jsonReply {
+		resp, e := http.Post("http://"+addr+triblab.JSONRPC_PATH, "application/json", strings.NewReader(body))
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer resp.Body.Close()
+
+		var r jsonReply
+		if e := json.NewDecoder(resp.Body).Decode(&r); e != nil {
+			t.Fatal(e)
+		}
+		return &r
+	}
+
+	r := post(`{"jsonrpc": "2.0", "method": "Storage.Set", "params": {"Key": "k", "Value": "v"}, "id": "a"}`)
+	if r.Error != nil || string(r.Result) != "true" || string(r.Id) != `"a"` {
+		t.Fatalf("set: %+v", r)
+	}
+	r = post(`{"jsonrpc": "2.0", "method": "Storage.Get", "params": ["k"], "id": 7}`)
+	if r.Error != nil || string(r.Result) != `"v"` || string(r.Id) != "7" {
+		t.Fatalf("get: %+v", r)
+	}
+	r = post(`{"jsonrpc": "2.0", "method": "Storage.Nope", "params": ["k"], "id": 8}`)
+	if r.Error == nil || r.Error.Code != triblab.JSONRPC_METHOD_NOT_FOUND {
+		t.Fatalf("unknown method: %+v", r)
+	}
+	r = post(`{"jsonrpc": "2.0", "method": "Storage.Get", "params": [1, 2], "id": 9}`)
+	if r.Error == nil || r.Error.Code != triblab.JSONRPC_INVALID_PARAMS {
+		t.Fatalf("bad params: %+v", r)
+	}
+	r = post(`{"method": "Storage.Get", "params": ["k"], "id": 10}`)
+	if r.Error == nil || r.Error.Code != triblab.JSONRPC_INVALID_REQUEST {
+		t.Fatalf("no version: %+v", r)
+	}
+
+	// plain TCP, one request per line
+	conn, e := net.Dial("tcp", jaddr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	_, e = conn.Write([]byte(`{"jsonrpc": "2.0", "method": "Storage.Set", "params": [{"Key": "n", "Value": "1"}]}` + "\n" +
+		`{"jsonrpc": "2.0", "method": "Storage.Get", "params": ["k"], "id": 1}` + "\n"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	// the notification gets no reply
+	var got jsonReply
+	if e := json.NewDecoder(conn).Decode(&got); e != nil {
+		t.Fatal(e)
+	}
+	if got.Error != nil || string(got.Result) != `"v"` || string(got.Id) != "1" {
+		t.Fatalf("tcp: %+v", got)
+	}
+
+	// a batch comes back as one array
+	_, e = conn.Write([]byte(`[{"jsonrpc": "2.0", "method": "Storage.Get", "params": ["n"], "id": 2},` +
+		`{"jsonrpc": "2.0", "method": "Storage.Get", "params": ["k"], "id": 3}]` + "\n"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	var batch []jsonReply
+	if e := json.NewDecoder(conn).Decode(&batch); e != nil {
+		t.Fatal(e)
+	}
+	if len(batch) != 2 {
+		t.Fatalf("tcp batch: %+v", batch)
+	}
+	for _, r := range batch {
+		want := map[string]string{"2": `"1"`, "3": `"v"`}[string(r.Id)]
+		if r.Error != nil || want == "" || string(r.Result) != want {
+			t.Fatalf("tcp batch: %+v", batch)
+		}
+	}
+}
+
+// Batches over POST, on a backend with no JSON-RPC address of its own.
+func TestJSONRPCBatch(t *testing.T) {
+	addr := randaddr.Local()
+	ready := make(chan bool)
+
+	go func() {
+		b := &trib.BackConfig{Addr: addr, Store: store.NewStorage(), Ready: ready}
+		e := triblab.ServeBack(b)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-ready {
+		t.Fatal("not ready")
+	}
+
+	post := func(body string) (int, string) {
+		resp, e := http.Post("http://"+addr+triblab.JSONRPC_PATH, "application/json", strings.NewReader(body))
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer resp.Body.Close()
+
+		p, e := ioutil.ReadAll(resp.Body)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return resp.StatusCode, strings.TrimSpace(string(p))
+	}
+
+	code, body := post(`[{"jsonrpc": "2.0", "method": "Storage.Set", "params": {"Key": "k", "Value": "v"}, "id": 1},` +
+		`{"jsonrpc": "2.0", "method": "Storage.ListAppend", "params": {"Key": "l", "Value": "a"}},` +
+		`{"jsonrpc": "2.0", "method": "Storage.Get", "params": ["k"], "id": 2},` +
+		`{"jsonrpc": "2.0", "method": "Storage.Nope", "params": [], "id": 3},` +
+		`1]`)
+	var batch []jsonReply
+	if e := json.Unmarshal([]byte(body), &batch); e != nil || code != http.StatusOK || len(batch) != 4 {
+		t.Fatalf("batch: %d %s", code, body)
+	}
+	if string(batch[0].Result) != "true" || string(batch[1].Result) != `"v"` ||
+		batch[2].Error == nil || batch[2].Error.Code != triblab.JSONRPC_METHOD_NOT_FOUND ||
+		batch[3].Error == nil || batch[3].Error.Code != triblab.JSONRPC_INVALID_REQUEST {
+		t.Fatalf("batch: %s", body)
+	}
+
+	// notifications only get nothing back
+	code, body = post(`[{"jsonrpc": "2.0", "method": "Storage.ListAppend", "params": {"Key": "l", "Value": "b"}}]`)
+	if code != http.StatusNoContent || body != "" {
+		t.Fatalf("notifications: %d %s", code, body)
+	}
+	var l trib.List
+	if e := triblab.NewClient(addr).ListGet("l", &l); e != nil || len(l.L) != 2 {
+		t.Fatal("notifications not served", l.L, e)
+	}
+
+	code, body = post(`[]`)
+	var r jsonReply
+	if e := json.Unmarshal([]byte(body), &r); e != nil || r.Error == nil || r.Error.Code != triblab.JSONRPC_INVALID_REQUEST {
+		t.Fatalf("empty batch: %d %s", code, body)
+	}
+}
@@ -1,10 +1,10 @@
 package triblab
 
 import (
+	"crypto/tls"
 	"fmt"
-	"net"
-	"net/http"
 	"net/rpc"
+	"sync"
 	"time"
 	"trib"
 )
@@ -12,10 +12,12 @@ import (
 // KeeperClient
 type KeeperClient struct {
 	addr string
+	tls  *tls.Config // nil for plaintext
+	sim  *Sim        // nil for the real network
 }
 
 func (self *KeeperClient) GetBacks(stub string, backs *[]string) error {
-	conn, e := rpc.DialHTTP("tcp", self.addr)
+	conn, e := self.sim.dial(self.addr, self.tls, "", nil)
 	if e != nil {
 		return e
 	}
@@ -30,7 +32,7 @@ func (self *KeeperClient) GetBacks(stub string, backs *[]string) error {
 }
 
 func (self *KeeperClient) GetId(stub string, myId *int64) error {
-	conn, e := rpc.DialHTTP("tcp", self.addr)
+	conn, e := self.sim.dial(self.addr, self.tls, "", nil)
 	if e != nil {
 		return e
 	}
@@ -44,18 +46,191 @@ func (self *KeeperClient) GetId(stub string, myId *int64) error {
 	return conn.Close()
 }
 
+func (self *KeeperClient) GetAddr(stub string, addr *string) error {
+	conn, e := self.sim.dial(self.addr, self.tls, "", nil)
+	if e != nil {
+		return e
+	}
+
+	e = conn.Call("Keeper.GetAddr", stub, addr)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	return conn.Close()
+}
+
+// Fetches the full status of the keeper, for tooling.
+func (self *KeeperClient) Status(stub string, st *KeeperStatus) error {
+	conn, e := self.sim.dial(self.addr, self.tls, "", nil)
+	if e != nil {
+		return e
+	}
+
+	*st = KeeperStatus{}
+
+	e = conn.Call("Keeper.Status", stub, st)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	return conn.Close()
+}
+
+
+func (self *KeeperClient) GetPlacement(stub string, p *Placement) error {
+	conn, e := self.sim.dial(self.addr, self.tls, "", nil)
+	if e != nil {
+		return e
+	}
+
+	*p = Placement{}
+
+	e = conn.Call("Keeper.GetPlacement", stub, p)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	return conn.Close()
+}
+
+func (self *KeeperClient) Pin(args *PinArgs, succ *bool) error {
+	conn, e := self.sim.dial(self.addr, self.tls, "", nil)
+	if e != nil {
+		return e
+	}
+
+	e = conn.Call("Keeper.Pin", args, succ)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	return conn.Close()
+}
+
+func (self *KeeperClient) Unpin(bin string, succ *bool) error {
+	conn, e := self.sim.dial(self.addr, self.tls, "", nil)
+	if e != nil {
+		return e
+	}
+
+	e = conn.Call("Keeper.Unpin", bin, succ)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	return conn.Close()
+}
+
+func (self *KeeperClient) Migrate(args *MigrateArgs, succ *bool) error {
+	conn, e := self.sim.dial(self.addr, self.tls, "", nil)
+	if e != nil {
+		return e
+	}
+
+	e = conn.Call("Keeper.Migrate", args, succ)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	return conn.Close()
+}
+
+func (self *KeeperClient) GetState(stub string, state *string) error {
+	conn, e := self.sim.dial(self.addr, self.tls, "", nil)
+	if e != nil {
+		return e
+	}
+
+	e = conn.Call("Keeper.GetState", stub, state)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	return conn.Close()
+}
+
+func (self *KeeperClient) SyncState(state string, succ *bool) error {
+	conn, e := self.sim.dial(self.addr, self.tls, "", nil)
+	if e != nil {
+		return e
+	}
+
+	e = conn.Call("Keeper.SyncState", state, succ)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	return conn.Close()
+}
 
 func NewKeeperClient(addr string) *KeeperClient {
 	return &KeeperClient{addr: addr}
 }
 
+func NewKeeperClientWith(addr string, opts *ClientOptions) (*KeeperClient, error) {
+	if opts == nil {
+		opts = new(ClientOptions)
+	}
+
+	conf, e := opts.TLS.client()
+	if e != nil {
+		return nil, e
+	}
+	return &KeeperClient{addr: addr, tls: conf, sim: opts.Sim}, nil
+}
+
 
 // Keeper with proper RPC interface
 type Keeper struct {
 	kconfig *trib.KeeperConfig
+
+	lock   sync.Mutex
+	state  *keeperState
+	spath  string      // where state is persisted, "" for nowhere
+	leader bool        // result of the last election
+	lead   string      // address of the leader at the last election
+	tls    *tls.Config // for dialing backends and keepers, nil for plaintext
+	token  string      // caller token for backends
+	voted  readyFlag   // set after the first election
+	logged map[string]time.Time // when recover_txns first saw each txn log entry
+	log    *Logger
+	sim    *Sim        // nil for real time and network
 	// GetBacks
 	// GetAddr
 	// GetId
+	// Status
+	// GetPlacement
+	// Pin
+	// Unpin
+	// Migrate
+	// GetState
+	// SyncState
+}
+
+// Keeper roles reported by Status.
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+// Snapshot of a keeper, as returned by Keeper.Status.
+type KeeperStatus struct {
+	Id         int64
+	Addr       string
+	Role       string
+	Epoch      uint64
+	Clock      uint64
+	Backs      []BackStatus
+	Migrations []MigrationTask
 }
 
 func (self *Keeper) GetBacks(stub string, backs *[]string) error {
@@ -67,7 +242,6 @@ func (self *Keeper) GetBacks(stub string, backs *[]string) error {
 	return nil
 }
 
-/*
 func (self *Keeper) GetAddr(stub string, myaddr *string) error {
 	if self.kconfig == nil {
 		return fmt.Errorf("Keeper not configured.")
@@ -76,7 +250,6 @@ func (self *Keeper) GetAddr(stub string, myaddr *string) error {
 	*myaddr = self.kconfig.Addr()
 	return nil
 }
-*/
 
 func (self *Keeper) GetId(stub string, myId *int64) error {
 	if self.kconfig == nil {
@@ -87,142 +260,663 @@ func (self *Keeper) GetId(stub string, myId *int64) error {
 	return nil
 }
 
+func (self *Keeper) Status(stub string, st *KeeperStatus) error {
+	if self.kconfig == nil {
+		return fmt.Errorf("Keeper not configured.")
+	}
 
-// repeating every 1s forever 
-func bclk_sync(all_stores []trib.Storage) {
-	var curr_max uint64
-	curr_max = 0
-
-	ticker := time.NewTicker(time.Second)
-	clkChan := make(chan uint64)
-
-	go func(tick <-chan time.Time){
-		for {
-			_ = <-tick
-
-			for _, store := range all_stores {
-				go func(s trib.Storage) {
-					var ret uint64
-					_ = s.Clock(curr_max, &ret)
-					clkChan <- ret
-				}(store)
-			}
+	self.lock.Lock()
+	defer self.lock.Unlock()
 
-			// update max
-			var max uint64
-			max = 0
-			for _ = range all_stores {
-				clki := <-clkChan
-				if clki > max {
-					max = clki
-				}
-			}
+	st.Id = self.kconfig.Id
+	st.Addr = self.kconfig.Addr()
+	st.Role = RoleFollower
+	if self.leader {
+		st.Role = RoleLeader
+	}
+	st.Epoch = self.state.Epoch
+	st.Clock = self.state.Clock
+
+	st.Backs = make([]BackStatus, 0, len(self.state.Backs))
+	for _, b := range self.state.Backs {
+		st.Backs = append(st.Backs, *b)
+	}
+	st.Migrations = make([]MigrationTask, 0, len(self.state.Migrations))
+	for _, m := range self.state.Migrations {
+		st.Migrations = append(st.Migrations, *m)
+	}
+
+	return nil
+}
+
+func (self *Keeper) GetPlacement(stub string, p *Placement) error {
+	if self.kconfig == nil {
+		return fmt.Errorf("Keeper not configured.")
+	}
 
-			if max > curr_max {
-				curr_max = max
-			} else {
-				curr_max = curr_max + 1
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// hand out a copy, the table keeps changing under the lock
+	q, e := unmarshalPlacement(self.state.Placement.marshal())
+	if e != nil {
+		return e
+	}
+	*p = *q
+	return nil
+}
+
+// Pins a bin to the given backends, primary first. Takes effect on the
+// front ends once the table is published with the next clock sync.
+// Followers pass it on to the leader.
+//
+// The primary has to stay, see Migrate to move it. Replicas may be
+// dropped or reordered at once, but a new one has to get the data
+// first: it is copied over like a migration, and joins once caught up.
+// So only one new backend may be added at a time.
+func (self *Keeper) Pin(args *PinArgs, succ *bool) error {
+	if self.kconfig == nil {
+		return fmt.Errorf("Keeper not configured.")
+	}
+
+	lead, e := self.leaderClient()
+	if e != nil {
+		return e
+	}
+	if lead != nil {
+		return lead.Pin(args, succ)
+	}
+
+	*succ = false
+	e = self.change(func(st *keeperState) error {
+		for _, m := range st.Migrations {
+			if m.Bin == args.Bin {
+				return fmt.Errorf("bin %q is migrating", args.Bin)
 			}
 		}
-	}(ticker.C)
+
+		p := st.Placement
+		e := p.checkPin(args.Bin, args.Backs)
+		if e != nil {
+			return e
+		}
+		old := p.Lookup(args.Bin)
+		if len(old) > 0 && args.Backs[0] != old[0] {
+			return fmt.Errorf("pin would move bin %q off its primary %q, use Migrate", args.Bin, old[0])
+		}
+
+		more := added(old, args.Backs)
+		if len(more) > 1 {
+			return fmt.Errorf("pin would add %q to bin %q, add one at a time", more, args.Bin)
+		}
+		if len(more) == 0 {
+			return p.pin(args.Bin, args.Backs)
+		}
+
+		// copy the bin over before the new backend joins
+		st.Migrations = append(st.Migrations, &MigrationTask{
+			Bin:     args.Bin,
+			From:    old[0],
+			To:      more[0],
+			Phase:   MIGRATE_COPYING,
+			Started: self.sim.time(),
+			Backs:   args.Backs,
+		})
+		p.shadow(args.Bin, more[0])
+		return nil
+	})
+	*succ = e == nil
+	return e
 }
 
-func ServeKeeper(kc *trib.KeeperConfig) error {
-	if kc == nil {
-		return fmt.Errorf("Invalid Keeper Config.")
+// Puts a pinned bin back where hashing places it, which must keep its
+// primary and add no backend without its data.
+func (self *Keeper) Unpin(bin string, succ *bool) error {
+	if self.kconfig == nil {
+		return fmt.Errorf("Keeper not configured.")
 	}
 
-	// Check if any addresses are invalid
-	for _, b := range kc.Backs {
-		if b == "" {
-			if kc.Ready != nil {
-				kc.Ready <- false
+	lead, e := self.leaderClient()
+	if e != nil {
+		return e
+	}
+	if lead != nil {
+		return lead.Unpin(bin, succ)
+	}
+
+	*succ = false
+	return self.change(func(st *keeperState) error {
+		for _, m := range st.Migrations {
+			if m.Bin == bin {
+				return fmt.Errorf("bin %q is migrating", bin)
 			}
-			return fmt.Errorf("Invalid back-ends address for Keeper config.")
 		}
+		p := st.Placement
+		old, found := p.Pins[bin]
+		if !found {
+			return nil
+		}
+		backs := p.hashed(bin)
+		if len(backs) > 0 && backs[0] != old[0] {
+			return fmt.Errorf("unpin would move bin %q from %q to %q, migrate it there first", bin, old[0], backs[0])
+		}
+		if more := added(old, backs); len(more) > 0 {
+			return fmt.Errorf("unpin would add %q to bin %q, pin them first", more, bin)
+		}
+		*succ = p.unpin(bin)
+		return nil
+	})
+}
+
+// Hands out the whole state, for a keeper taking over as leader.
+func (self *Keeper) GetState(stub string, state *string) error {
+	if self.kconfig == nil {
+		return fmt.Errorf("Keeper not configured.")
 	}
 
-	for _, k := range kc.Addrs {
-		if k == "" {
-			if kc.Ready != nil {
-				kc.Ready <- false
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	*state = self.state.marshal()
+	return nil
+}
+
+// Takes the state handed on by the leader. Refused on a leader and from
+// a leader of an older term, which then has to catch up, so that a stale
+// keeper cannot roll us back.
+func (self *Keeper) SyncState(state string, succ *bool) error {
+	if self.kconfig == nil {
+		return fmt.Errorf("Keeper not configured.")
+	}
+
+	st, e := unmarshalKeeperState(state)
+	if e != nil {
+		return e
+	}
+	e = st.check(self.kconfig.Backs)
+	if e != nil {
+		return e
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	*succ = false
+	if self.leader || st.Term < self.state.Term {
+		return nil
+	}
+	*succ = true
+	if st.Term == self.state.Term && st.Placement.Version < self.state.Placement.Version {
+		return nil // overtaken by a later push
+	}
+	if st.Clock < self.state.Clock {
+		st.Clock = self.state.Clock
+	}
+	self.state = st
+	return self.state.save(self.spath)
+}
+
+// The leader to pass changes on to, nil if that is us.
+func (self *Keeper) leaderClient() (*KeeperClient, error) {
+	self.lock.Lock()
+	leader, lead := self.leader, self.lead
+	self.lock.Unlock()
+
+	if leader {
+		return nil, nil
+	}
+	if lead == "" {
+		return nil, fmt.Errorf("no leader elected yet")
+	}
+	return self.keeper(lead), nil
+}
+
+// Applies a change to the state of the leader, saves it and hands it on
+// to the followers.
+func (self *Keeper) change(f func(st *keeperState) error) error {
+	self.lock.Lock()
+	e := f(self.state)
+	if e == nil {
+		e = self.state.save(self.spath)
+	}
+	self.lock.Unlock()
+	if e != nil {
+		return e
+	}
+
+	if !self.push() {
+		return fmt.Errorf("no longer the leader, try again")
+	}
+	return nil
+}
+
+// Hands the state of the leader on to the followers, so that whichever
+// takes over next goes on from it. Followers that are down catch up on a
+// later round. Returns false if one of them follows a later term, in
+// which case we step down until the next election has caught us up.
+func (self *Keeper) push() bool {
+	self.lock.Lock()
+	leader := self.leader
+	state := self.state.marshal()
+	self.lock.Unlock()
+
+	if !leader {
+		return false
+	}
+
+	addrs := self.kconfig.Addrs
+	refused := make([]bool, len(addrs))
+	self.sim.fanOut(len(addrs), func(i int) {
+		if i == self.kconfig.This {
+			return
+		}
+		var succ bool
+		e := self.keeper(addrs[i]).SyncState(state, &succ)
+		if e != nil {
+			self.log.Debug("could not hand state on", "keeper", addrs[i], "error", e)
+			return
+		}
+		refused[i] = !succ
+	})
+
+	for i, r := range refused {
+		if r {
+			self.log.Warn("state refused, stepping down", "keeper", addrs[i])
+			self.lock.Lock()
+			self.leader = false
+			self.lock.Unlock()
+			return false
+		}
+	}
+	return true
+}
+
+// Catches up with the previous leader before taking over from it: takes
+// the freshest state among the other keepers, then the last table it
+// published, which is newer still if it died before handing it on. Our
+// version then goes past every published one, as front ends only take
+// newer tables, and our term past every one seen.
+func (self *Keeper) takeover() {
+	addrs, backs := self.kconfig.Addrs, self.kconfig.Backs
+
+	states := make([]*keeperState, len(addrs))
+	self.sim.fanOut(len(addrs), func(i int) {
+		if i == self.kconfig.This {
+			return
+		}
+		var s string
+		if self.keeper(addrs[i]).GetState("", &s) != nil {
+			return // down
+		}
+		st, e := unmarshalKeeperState(s)
+		if e == nil {
+			e = st.check(backs)
+		}
+		if e != nil {
+			self.log.Warn("ignoring keeper state", "keeper", addrs[i], "error", e)
+			return
+		}
+		states[i] = st
+	})
+
+	tables := make([]*Placement, len(backs))
+	self.sim.fanOut(len(backs), func(i int) {
+		var s string
+		if self.client(backs[i]).Get(PLACEMENT_KEY, &s) != nil || s == "" {
+			return
+		}
+		p, e := unmarshalPlacement(s)
+		if e == nil && equalLists(p.Backs, backs) {
+			tables[i] = p
+		}
+	})
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	term := self.state.Term
+	for _, st := range states {
+		if st == nil {
+			continue
+		}
+		if st.Term > term || st.Term == term && st.Placement.Version > self.state.Placement.Version {
+			self.state.Placement = st.Placement
+			self.state.Migrations = st.Migrations
+			term = st.Term
+		}
+		if st.Clock > self.state.Clock {
+			self.state.Clock = st.Clock
+		}
+		if st.Epoch > self.state.Epoch {
+			self.state.Epoch = st.Epoch
+		}
+	}
+
+	var published *Placement
+	for _, p := range tables {
+		if p != nil && (published == nil || p.Version > published.Version) {
+			published = p
+		}
+	}
+	if published != nil {
+		if published.Version > self.state.Placement.Version {
+			self.log.Warn("taking the placement published by the last leader", "version", published.Version)
+			self.state.adoptPlacement(published, self.sim.time())
+		}
+		if published.Version >= self.state.Placement.Version {
+			self.state.Placement.Version = published.Version + 1
+		}
+	}
+
+	self.state.Term = term + 1
+
+	e := self.state.save(self.spath)
+	if e != nil {
+		self.log.Error("could not save keeper state", "path", self.spath, "error", e)
+	}
+}
+
+// Client of another keeper.
+func (self *Keeper) keeper(addr string) *KeeperClient {
+	return &KeeperClient{addr: addr, tls: self.tls, sim: self.sim}
+}
+
+// Client of a backend, with the keeper's credentials.
+func (self *Keeper) client(addr string) *client {
+	return &client{addr: addr, tls: self.tls, token: self.token, log: self.log, sim: self.sim}
+}
+
+// The leader is the live keeper with the lowest index. Returns true if
+// that is us.
+func (self *Keeper) elect() bool {
+	lead := self.kconfig.Addr()
+	for i := 0; i < self.kconfig.This; i++ {
+		var id int64
+		if self.keeper(self.kconfig.Addrs[i]).GetId("", &id) == nil {
+			lead = self.kconfig.Addrs[i]
+			break
+		}
+	}
+	leader := lead == self.kconfig.Addr()
+
+	self.lock.Lock()
+	was := self.leader
+	self.lock.Unlock()
+	if leader && !was {
+		self.takeover()
+	}
+
+	self.lock.Lock()
+	self.leader = leader
+	self.lead = lead
+	self.lock.Unlock()
+	self.voted.mark()
+	return leader
+}
+
+
+// clock reply of the i-th backend
+type clkReply struct {
+	i   int
+	clk uint64
+	err error
+}
+
+// repeating every 1s forever 
+func (self *Keeper) bclk_sync(all_stores []trib.Storage) {
+	for {
+		self.sim.sleep(time.Second)
+
+		// only the leader syncs clocks
+		if !self.elect() {
+			continue
+		}
+
+		// as handed on by the last leader, if it was not us
+		var curr_max uint64
+		self.lock.Lock()
+		curr_max = self.state.Clock
+		self.lock.Unlock()
+
+		replies := make([]clkReply, len(all_stores))
+		self.sim.fanOut(len(all_stores), func(i int) {
+			var ret uint64
+			e := all_stores[i].Clock(curr_max, &ret)
+			replies[i] = clkReply{i, ret, e}
+		})
+
+		// update max
+		var max uint64
+		max = 0
+		alive := make([]bool, len(all_stores))
+		for _, r := range replies {
+			alive[r.i] = r.err == nil
+			if r.clk > max {
+				max = r.clk
 			}
-			return fmt.Errorf("Invalid Keeper address.")
+		}
+
+		if max > curr_max {
+			curr_max = max
+		} else {
+			curr_max = curr_max + 1
+		}
+
+		self.synced(curr_max, alive)
+		if !self.push() {
+			continue // behind a later leader
+		}
+		self.publish(all_stores, alive)
+
+		e := self.recover_txns(all_stores, alive)
+		if e != nil {
+			self.log.Warn("could not recover transactions", "error", e)
 		}
 	}
+}
+
+// Records the result of one clock sync round and persists it.
+func (self *Keeper) synced(clk uint64, alive []bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := self.sim.time()
+	self.state.Clock = clk
+	changed := false
+	for i, b := range self.state.Backs {
+		if alive[i] {
+			b.LastBeat = now
+		}
+		if b.Alive != alive[i] {
+			b.Alive = alive[i]
+			changed = true
+		}
+	}
+	if changed {
+		self.state.Epoch++
+	}
+
+	e := self.state.save(self.spath)
+	if e != nil {
+		self.log.Error("could not save keeper state", "path", self.spath, "error", e)
+	}
+}
+
+// Pushes the placement table to every live backend. Done on every round
+// so that restarted backends get it back.
+func (self *Keeper) publish(all_stores []trib.Storage, alive []bool) {
+	self.lock.Lock()
+	kv := &trib.KeyValue{Key: PLACEMENT_KEY, Value: self.state.Placement.marshal()}
+	self.lock.Unlock()
+
+	for i, s := range all_stores {
+		if !alive[i] {
+			continue
+		}
+		var succ bool
+		e := s.Set(kv, &succ)
+		if e != nil {
+			self.log.Warn("could not publish placement", "back", self.kconfig.Backs[i], "error", e)
+		}
+	}
+}
+
+// Serve as a keeper, resuming from the state saved under
+// KEEPER_STATE_DIR by the previous run of the keeper at the same address.
+func ServeKeeper(kc *trib.KeeperConfig) error {
+	if kc == nil {
+		return fmt.Errorf("Invalid Keeper Config.")
+	}
+	return ServeKeeperWith(kc, &KeeperOptions{StateDir: defaultStateDir(kc.Backs)})
+}
 
-	if kc.This >= len(kc.Addrs) {
+// Serve as a keeper, resuming from the state saved in opts.StateDir by
+// the previous run of the keeper at the same address.
+func ServeKeeperWith(kc *trib.KeeperConfig, opts *KeeperOptions) error {
+	if kc == nil {
+		return fmt.Errorf("Invalid Keeper Config.")
+	}
+
+	e := checkKeeperConfig(kc)
+	if e != nil {
 		if kc.Ready != nil {
 			kc.Ready <- false
 		}
-		return fmt.Errorf("Invalid Keeper this pointer.")
+		return e
 	}
 
+	if opts == nil {
+		opts = new(KeeperOptions)
+	}
 
-	// Server Establishment
-	var serverUp = make(chan bool, 1)
-	var serverErr = make(chan error, 1)
-	go func(kc *trib.KeeperConfig, ready chan bool, errs chan error) error {
-		k := &Keeper{kconfig: kc}
-
-		kserver := rpc.NewServer()
-		err := kserver.RegisterName("Keeper", k)
-		if err != nil {
-			fmt.Println("Could not register keeper server")
-			if ready != nil {
-				ready <- false
-			}
-			if errs != nil {
-				errs <- err
-			}
-			return err
+	sconf, e := opts.TLS.server()
+	if e != nil {
+		if kc.Ready != nil {
+			kc.Ready <- false
 		}
+		return e
+	}
+	cconf, e := opts.TLS.client()
+	if e != nil {
+		if kc.Ready != nil {
+			kc.Ready <- false
+		}
+		return e
+	}
 
-		l, e := net.Listen("tcp", kc.Addr())
+	// Restore the state of the previous run, if any.
+	k := &Keeper{
+		kconfig: kc,
+		spath:   keeperStatePath(opts.StateDir, kc.Addr()),
+		logged:  make(map[string]time.Time),
+		tls:     cconf,
+		token:   opts.Token,
+		log:     opts.Logger.With("node", kc.Addr()),
+		sim:     opts.Sim,
+	}
+	st, e := loadKeeperState(k.spath)
+	if e != nil {
+		if kc.Ready != nil {
+			kc.Ready <- false
+		}
+		return e
+	}
+	if st == nil {
+		st = newKeeperState(kc.Backs)
+		if opts.Replicas > 0 {
+			st.Placement.Replicas = opts.Replicas
+		}
+	} else {
+		e = st.check(kc.Backs)
+		if e == nil && opts.Replicas > 0 && st.Placement.Replicas != opts.Replicas {
+			// added replicas would start out empty
+			e = fmt.Errorf("replicas changed from %d to %d", st.Placement.Replicas, opts.Replicas)
+		}
 		if e != nil {
-			fmt.Println("Could not open keeper address %q for listen.", kc.Addr())
-			if ready != nil {
-				ready <- false
-			}
-			if errs != nil {
-				errs <- e
+			if kc.Ready != nil {
+				kc.Ready <- false
 			}
-			return e
+			return fmt.Errorf("%s: %v; remove it to start over", k.spath, e)
 		}
+	}
+	k.state = st
 
-		if ready != nil {
-			ready <- true
-		}
-		if errs != nil {
-			errs <- nil
+	e = st.save(k.spath)
+	if e != nil {
+		if kc.Ready != nil {
+			kc.Ready <- false
 		}
+		return e
+	}
 
-		return http.Serve(l, kserver)
-	}(kc, serverUp, serverErr)
+	// Server Establishment
+	kserver := rpc.NewServer()
+	e = kserver.RegisterName("Keeper", k)
+	if e != nil {
+		k.log.Error("could not register keeper server", "error", e)
+		if kc.Ready != nil {
+			kc.Ready <- false
+		}
+		return e
+	}
 
-	serverReady := <-serverUp
-	errS := <-serverErr
+	l, e := opts.Sim.listen(kc.Addr(), sconf)
+	if e != nil {
+		k.log.Error("could not listen", "addr", kc.Addr(), "error", e)
+		if kc.Ready != nil {
+			kc.Ready <- false
+		}
+		return e
+	}
 
-	if !serverReady {
+	h := &rpcHandler{srv: anyCaller(kserver), tracer: opts.Tracer}
+	e = listenJSON(h, opts.JSONAddr, sconf)
+	if e != nil {
+		l.Close()
 		if kc.Ready != nil {
 			kc.Ready <- false
 		}
-		return errS
+		return e
 	}
+	k.sim.spawn(func() { serve(l, h) })
+	k.log.Info("serving keeper", "json", opts.JSONAddr, "admin", opts.AdminAddr)
+
+	metrics := NewMetrics()
+	if opts.AdminAddr != "" {
+		e = serveAdmin(opts.AdminAddr, &adminNode{
+			ready:   func() error { return k.voted.check("keeper") },
+			metrics: k.metrics(metrics),
+			traces:  opts.Tracer,
+		})
+		if e != nil {
+			if kc.Ready != nil {
+				kc.Ready <- false
+			}
+			return e
+		}
+	}
+
+	// settle who leads before saying we are ready
+	k.elect()
 
 	// sync clocks of backends every 1 sec.
-	go func(kc *trib.KeeperConfig) {
+	k.sim.spawn(func() {
 		// retrieve all respective backends which should have been created already before
 		// keeper establishment.
 		var all_stores = make([]trib.Storage, 0, len(kc.Backs))
 		for _, baddr := range kc.Backs {
-			all_stores = append(all_stores, NewClient(baddr))
+			var s trib.Storage = k.client(baddr)
+			if opts.AdminAddr != "" {
+				s = Intercept(s, metrics.Interceptor())
+			}
+			all_stores = append(all_stores, s)
 		}
 
-		// lab2: assume current keeper is always primary.
-		// ticker repeat every 1s.
-		bclk_sync(all_stores)
-	}(kc)
+		// repeats every 1s; followers just keep electing.
+		k.bclk_sync(all_stores)
+	})
+
+	k.sim.spawn(k.run_migrations)
 
 	if kc.Ready != nil {
 		kc.Ready <- true
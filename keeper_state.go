@@ -0,0 +1,261 @@
+package triblab
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Directory under which ServeKeeper keeps the keeper state, one
+// subdirectory per set of backends.
+var KEEPER_STATE_DIR = filepath.Join(os.TempDir(), "triblab-keeper")
+
+// State directory of ServeKeeper for a keeper of backs. A keeper that
+// reuses an address for another cluster gets a directory of its own,
+// rather than being refused for the changed backends.
+func defaultStateDir(backs []string) string {
+	h := fnv.New32a()
+	for _, b := range backs {
+		h.Write([]byte(b))
+		h.Write([]byte{0})
+	}
+	return filepath.Join(KEEPER_STATE_DIR, fmt.Sprintf("%08x", h.Sum32()))
+}
+
+// Keeper options that do not fit into trib.KeeperConfig.
+type KeeperOptions struct {
+	// Directory holding the keeper state file, which a restarted
+	// keeper resumes from. Empty to keep the state in memory only, so
+	// that every run starts fresh; ServeKeeper uses one under
+	// KEEPER_STATE_DIR.
+	StateDir string
+
+	// Address to also serve JSON-RPC 2.0 on, see BackOptions.
+	JSONAddr string
+
+	// Serve and dial with mutual TLS, see BackOptions. Nil for
+	// plaintext.
+	TLS *TLSConfig
+
+	// Caller token for backends that check callers. The keeper needs
+	// read and write on all bins, an ACL rule with an empty prefix.
+	Token string
+
+	// Admin address, see BackOptions.
+	AdminAddr string
+
+	// Records a span for every call served, see BackOptions.
+	Tracer *Tracer
+
+	// Nil for the one given to SetLogger. Lines get the keeper address as
+	// the node field.
+	Logger *Logger
+
+	// Keep within the simulation, see BackOptions.
+	Sim *Sim
+
+	// Replicas of each hashed bin, 1 if 0. Only taken by a fresh
+	// keeper; one resuming from a state saved with other replicas
+	// refuses to start, as the added copies would not have the data.
+	Replicas int
+}
+
+// Membership view entry for one backend.
+type BackStatus struct {
+	Addr     string
+	Alive    bool
+	LastBeat time.Time // last successful clock sync
+}
+
+// An in-progress copy of one bin between two backends.
+type MigrationTask struct {
+	Bin     string
+	From    string
+	To      string
+	Phase   string
+	Started time.Time // start of the current phase
+	Cursor  string    // last key copied, "" when not started
+	Backs   []string  // of the bin once flipped, nil for From replaced by To
+}
+
+// The backends of the bin once the task flips it.
+func (self *MigrationTask) final(p *Placement) []string {
+	if self.Backs != nil {
+		return self.Backs
+	}
+	return replaced(p.Lookup(self.Bin), self.From, self.To)
+}
+
+// Everything a keeper needs to remember across a restart.
+type keeperState struct {
+	Term       uint64 // bumped by every keeper taking over as leader
+	Epoch      uint64 // bumped on every membership change
+	Clock      uint64 // max backend clock seen so far
+	Backs      []*BackStatus
+	Migrations []*MigrationTask
+	Placement  *Placement
+}
+
+func newKeeperState(backs []string) *keeperState {
+	st := &keeperState{Epoch: 1, Placement: newPlacement(backs)}
+	for _, b := range backs {
+		st.Backs = append(st.Backs, &BackStatus{Addr: b, Alive: true})
+	}
+	return st
+}
+
+// Checks that the configured backends are the ones the state was saved
+// with. Hashed bins go by their index on the ring, so adding, dropping
+// or reordering backends would move most of them onto backends that do
+// not have their data.
+func (self *keeperState) check(backs []string) error {
+	if self.Placement == nil {
+		self.Placement = newPlacement(backs)
+	}
+
+	saved := make([]string, 0, len(self.Backs))
+	for _, b := range self.Backs {
+		saved = append(saved, b.Addr)
+	}
+	if !equalLists(saved, backs) || !equalLists(self.Placement.Backs, backs) {
+		return fmt.Errorf("backends changed from %q to %q, which would move bins off their data",
+			self.Placement.Backs, backs)
+	}
+	return nil
+}
+
+func (self *keeperState) marshal() string {
+	bytes, e := json.Marshal(self)
+	if e != nil {
+		panic(e)
+	}
+	return string(bytes)
+}
+
+func unmarshalKeeperState(s string) (*keeperState, error) {
+	st := new(keeperState)
+	e := json.Unmarshal([]byte(s), st)
+	if e != nil {
+		return nil, e
+	}
+	if st.Placement == nil {
+		return nil, fmt.Errorf("keeper state without placement")
+	}
+	return st, nil
+}
+
+// Takes a newer placement table published by a leader that died before
+// handing its state on. Migrations follow the table: tasks of bins no
+// longer moving are dropped, and those whose bin flipped meanwhile wait
+// out their grace period. A bin moving without a task of ours cannot
+// tell copying from flipped, so it is taken as flipped, which at worst
+// drops a half done copy.
+func (self *keeperState) adoptPlacement(p *Placement, now time.Time) {
+	tasks := make(map[string]*MigrationTask)
+	for _, t := range self.Migrations {
+		tasks[t.Bin] = t
+	}
+
+	bins := make([]string, 0, len(p.Moving))
+	for bin := range p.Moving {
+		bins = append(bins, bin)
+	}
+	sort.Strings(bins)
+
+	self.Migrations = nil
+	for _, bin := range bins {
+		addr := p.Moving[bin]
+		t := tasks[bin]
+		if t == nil {
+			backs := p.Lookup(bin)
+			t = &MigrationTask{Bin: bin, From: addr, Phase: MIGRATE_FLIPPED}
+			if len(backs) > 0 {
+				t.To = backs[0]
+			}
+		}
+		if t.Phase == MIGRATE_COPYING && addr == t.From {
+			t.Phase = MIGRATE_FLIPPED
+		}
+		t.Started = now
+		self.Migrations = append(self.Migrations, t)
+	}
+	self.Placement = p
+}
+
+// Location of the state file for a keeper at addr, "" for none.
+func keeperStatePath(dir, addr string) string {
+	if dir == "" {
+		return ""
+	}
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(addr)
+	return filepath.Join(dir, "keeper-"+name+".state")
+}
+
+// Reads the keeper state at path. A missing file, or no path, is not an
+// error; it just means the keeper starts fresh.
+func loadKeeperState(path string) (*keeperState, error) {
+	if path == "" {
+		return nil, nil
+	}
+	bytes, e := ioutil.ReadFile(path)
+	if os.IsNotExist(e) {
+		return nil, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	st := new(keeperState)
+	e = json.Unmarshal(bytes, st)
+	if e != nil {
+		return nil, fmt.Errorf("corrupted keeper state %q: %v", path, e)
+	}
+	return st, nil
+}
+
+// Writes the keeper state to path atomically: the new state goes to a
+// temp file in the same directory, which is synced and then renamed over
+// the old one, so a crash leaves either the old or the new state. Does
+// nothing without a path.
+func (self *keeperState) save(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	bytes, e := json.MarshalIndent(self, "", "    ")
+	if e != nil {
+		return e
+	}
+
+	dir := filepath.Dir(path)
+	e = os.MkdirAll(dir, 0755)
+	if e != nil {
+		return e
+	}
+
+	f, e := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if e != nil {
+		return e
+	}
+	tmp := f.Name()
+
+	_, e = f.Write(bytes)
+	if e == nil {
+		e = f.Sync()
+	}
+	if e2 := f.Close(); e == nil {
+		e = e2
+	}
+	if e != nil {
+		os.Remove(tmp)
+		return e
+	}
+
+	return os.Rename(tmp, path)
+}
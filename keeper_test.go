@@ -0,0 +1,504 @@
+package triblab_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"trib"
+	"trib/entries"
+	"trib/randaddr"
+	"trib/store"
+	"triblab"
+)
+
+// Starts simulated backends and keepers, with the keeper states in dir
+// and replicas of each bin. Returns a failing check for calls made from
+// tasks, and a step through the simulation.
+func simCluster(t *testing.T, s *triblab.Sim, dir string, replicas int, backs, keepers []string) (
+	check func(what string, e error), run func(d time.Duration)) {
+	quiet := triblab.NewLogger(ioutil.Discard, triblab.LOG_ERROR)
+	for _, addr := range backs {
+		addr := addr
+		s.Go(addr, func() {
+			b := &trib.BackConfig{Addr: addr, Store: store.NewStorage()}
+			e := triblab.ServeBackWith(b, &triblab.BackOptions{Sim: s, Logger: quiet})
+			if e != nil {
+				t.Error(e)
+			}
+		})
+	}
+	for i, addr := range keepers {
+		i := i
+		s.Go(addr, func() {
+			kc := &trib.KeeperConfig{Backs: backs, Addrs: keepers, This: i, Id: int64(i)}
+			e := triblab.ServeKeeperWith(kc, &triblab.KeeperOptions{
+				StateDir: dir,
+				Replicas: replicas,
+				Sim:      s,
+				Logger:   quiet,
+			})
+			if e != nil {
+				t.Error(e)
+			}
+		})
+	}
+
+	check = func(what string, e error) {
+		if e != nil {
+			t.Errorf("%v %s: %v", s.Now().Sub(triblab.SIM_EPOCH), what, e)
+		}
+	}
+	run = func(d time.Duration) {
+		if e := s.Run(d); e != nil {
+			t.Fatal(e)
+		}
+	}
+	return check, run
+}
+
+func TestKeeperStatus(t *testing.T) {
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s := triblab.NewSim(1)
+	backs := []string{"back-0", "back-1", "back-2"}
+	keepers := []string{"keeper-0", "keeper-1"}
+	check, run := simCluster(t, s, dir, 0, backs, keepers)
+
+	copts := &triblab.ClientOptions{Sim: s}
+	var kcs []*triblab.KeeperClient
+	for _, addr := range keepers {
+		kc, e := triblab.NewKeeperClientWith(addr, copts)
+		if e != nil {
+			t.Fatal(e)
+		}
+		kcs = append(kcs, kc)
+	}
+
+	// the first keeper leads, and both see every backend alive
+	var epoch uint64
+	s.Go("", func() {
+		s.Sleep(3 * time.Second)
+		for i, kc := range kcs {
+			var addr string
+			check("addr", kc.GetAddr("", &addr))
+			var id int64
+			check("id", kc.GetId("", &id))
+			if addr != keepers[i] || id != int64(i) {
+				t.Errorf("keeper %d is %q, id %d", i, addr, id)
+			}
+
+			var st triblab.KeeperStatus
+			check("status", kc.Status("", &st))
+			role := triblab.RoleFollower
+			if i == 0 {
+				role = triblab.RoleLeader
+			}
+			if st.Addr != keepers[i] || st.Role != role || st.Epoch == 0 || st.Clock == 0 {
+				t.Errorf("keeper %d status: %+v", i, st)
+			}
+			if len(st.Backs) != len(backs) {
+				t.Fatalf("keeper %d backends: %+v", i, st.Backs)
+			}
+			for j, b := range st.Backs {
+				if b.Addr != backs[j] || !b.Alive || s.Now().Sub(b.LastBeat) > 2*time.Second {
+					t.Errorf("keeper %d backend %d: %+v", i, j, b)
+				}
+			}
+			epoch = st.Epoch
+		}
+	})
+	run(4 * time.Second)
+
+	// a backend going down starts a new epoch, on the follower too
+	s.Crash("back-1")
+	s.Go("", func() {
+		s.Sleep(3 * time.Second)
+		for i, kc := range kcs {
+			var st triblab.KeeperStatus
+			check("status", kc.Status("", &st))
+			if st.Epoch <= epoch || st.Backs[1].Alive || !st.Backs[0].Alive {
+				t.Errorf("keeper %d missed the failure: %+v", i, st)
+			}
+		}
+	})
+	run(4 * time.Second)
+}
+
+func TestKeeperFailover(t *testing.T) {
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s := triblab.NewSim(1)
+	backs := []string{"back-0", "back-1", "back-2"}
+	check, run := simCluster(t, s, dir, 0, backs, []string{"keeper-0", "keeper-1"})
+
+	copts := &triblab.ClientOptions{Sim: s}
+	k0, e := triblab.NewKeeperClientWith("keeper-0", copts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	k1, e := triblab.NewKeeperClientWith("keeper-1", copts)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// a migration asked of the follower goes through the leader
+	var to string
+	var version uint64
+	s.Go("", func() {
+		bc, e := triblab.NewBinClientWith(backs, copts)
+		check("bin client", e)
+		var succ bool
+		check("set", bc.Bin("bob").Set(trib.KV("name", "bob"), &succ))
+
+		s.Sleep(2 * time.Second)
+		var p triblab.Placement
+		check("placement", k1.GetPlacement("", &p))
+		to = backs[0]
+		if p.Lookup("bob")[0] == to {
+			to = backs[1]
+		}
+		check("migrate", k1.Migrate(&triblab.MigrateArgs{Bin: "bob", To: to}, &succ))
+
+		s.Sleep(20 * time.Second)
+		var st triblab.KeeperStatus
+		check("status", k0.Status("", &st))
+		if st.Role != triblab.RoleLeader || len(st.Migrations) != 0 {
+			t.Errorf("keeper-0 status: %+v", st)
+		}
+		check("placement", k0.GetPlacement("", &p))
+		version = p.Version
+	})
+	run(25 * time.Second)
+
+	// the follower takes over with the table of the leader
+	s.Crash("keeper-0")
+	s.Go("", func() {
+		s.Sleep(3 * time.Second)
+		var st triblab.KeeperStatus
+		check("status", k1.Status("", &st))
+		if st.Role != triblab.RoleLeader {
+			t.Errorf("keeper-1 did not take over: %+v", st)
+		}
+		var p triblab.Placement
+		check("placement", k1.GetPlacement("", &p))
+		if p.Lookup("bob")[0] != to || p.Version <= version {
+			t.Errorf("keeper-1 lost the migration: %+v, version was %d", p, version)
+		}
+
+		// as do front ends started after the failover
+		s.Sleep(2 * time.Second)
+		bc, e := triblab.NewBinClientWith(backs, copts)
+		check("bin client", e)
+		where, _, v := bc.(*triblab.VStorage).Where("bob")
+		if len(where) == 0 || where[0] != to || v <= version {
+			t.Errorf("front end sees bob on %q, version %d", where, v)
+		}
+		var name string
+		check("get", bc.Bin("bob").Get("name", &name))
+		if name != "bob" {
+			t.Errorf("bob's name is %q", name)
+		}
+
+		var succ bool
+		check("pin", k1.Pin(&triblab.PinArgs{Bin: "carol", Backs: p.Lookup("carol")}, &succ))
+		check("placement", k1.GetPlacement("", &p))
+		version = p.Version
+	})
+	run(10 * time.Second)
+
+	// the old leader comes back believing it still leads, and catches up
+	// instead of publishing its stale table
+	s.Restart("keeper-0")
+	s.Go("", func() {
+		s.Sleep(5 * time.Second)
+		var st triblab.KeeperStatus
+		check("status", k0.Status("", &st))
+		if st.Role != triblab.RoleLeader {
+			t.Errorf("keeper-0 did not lead again: %+v", st)
+		}
+		var p triblab.Placement
+		check("placement", k0.GetPlacement("", &p))
+		if _, found := p.Pins["carol"]; !found || p.Version <= version {
+			t.Errorf("keeper-0 rolled back the pin: %+v, version was %d", p, version)
+		}
+
+		bc, e := triblab.NewBinClientWith(backs, copts)
+		check("bin client", e)
+		if _, _, v := bc.(*triblab.VStorage).Where("carol"); v < p.Version {
+			t.Errorf("published version %d, keeper has %d", v, p.Version)
+		}
+	})
+	run(10 * time.Second)
+}
+
+func TestKeeperPin(t *testing.T) {
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s := triblab.NewSim(1)
+	backs := []string{"back-0", "back-1", "back-2"}
+	check, run := simCluster(t, s, dir, 0, backs, []string{"keeper"})
+
+	copts := &triblab.ClientOptions{Sim: s}
+	kc, e := triblab.NewKeeperClientWith("keeper", copts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	refused := func(what string, e error, want string) {
+		if e == nil || !strings.Contains(e.Error(), want) {
+			t.Errorf("%s: %v, want %q", what, e, want)
+		}
+	}
+
+	var replica string
+	s.Go("", func() {
+		bc, e := triblab.NewBinClientWith(backs, copts)
+		check("bin client", e)
+		var succ bool
+		check("set", bc.Bin("bob").Set(trib.KV("name", "bob"), &succ))
+
+		s.Sleep(2 * time.Second)
+		var p triblab.Placement
+		check("placement", kc.GetPlacement("", &p))
+		primary := p.Lookup("bob")[0]
+		var v string
+		check("get", bc.Bin("bob").Get("name", &v)) // with the table published
+
+		var others []string
+		for _, b := range backs {
+			if b != primary {
+				others = append(others, b)
+			}
+		}
+
+		// pins keep the primary and add replicas one by one
+		refused("pin elsewhere", kc.Pin(&triblab.PinArgs{Bin: "bob", Backs: others}, &succ), "use Migrate")
+		all := append([]string{primary}, others...)
+		refused("pin two more", kc.Pin(&triblab.PinArgs{Bin: "bob", Backs: all}, &succ), "one at a time")
+		check("pin", kc.Pin(&triblab.PinArgs{Bin: "bob", Backs: []string{primary, others[0]}}, &succ))
+
+		// which joins once it has the data
+		s.Sleep(15 * time.Second)
+		var st triblab.KeeperStatus
+		check("status", kc.Status("", &st))
+		check("placement", kc.GetPlacement("", &p))
+		if len(st.Migrations) != 0 || !reflect.DeepEqual(p.Lookup("bob"), []string{primary, others[0]}) {
+			t.Errorf("replica did not join: %+v, %+v", st.Migrations, p)
+		}
+		raw, e := triblab.NewClientWith(others[0], copts)
+		check("client", e)
+		var name string
+		check("get", raw.Get("bob::name", &name))
+		if name != "bob" {
+			t.Errorf("new replica has name %q", name)
+		}
+
+		// and the front end, on the table of before the pin, picks up
+		// the new one and writes there too
+		check("set", bc.Bin("bob").Set(trib.KV("bio", "pinned"), &succ))
+		var bio string
+		check("get", raw.Get("bob::bio", &bio))
+		if bio != "pinned" {
+			t.Errorf("new replica has bio %q", bio)
+		}
+
+		// nor may unpins move the primary off its data
+		check("migrate", kc.Migrate(&triblab.MigrateArgs{Bin: "bob", To: others[1]}, &succ))
+		s.Sleep(15 * time.Second)
+		refused("unpin", kc.Unpin("bob", &succ), "migrate it there first")
+		check("placement", kc.GetPlacement("", &p))
+		if p.Lookup("bob")[0] != others[1] {
+			t.Errorf("bob did not migrate: %+v", p)
+		}
+		replica = p.Lookup("bob")[1]
+		check("set", bc.Bin("bob").Set(trib.KV("bio", "moved"), &succ))
+		raw, e = triblab.NewClientWith(others[1], copts)
+		check("client", e)
+		check("get", raw.Get("bob::bio", &bio))
+		if bio != "moved" {
+			t.Errorf("new primary has bio %q", bio)
+		}
+	})
+	run(40 * time.Second)
+
+	// a write the replica missed is not reported as done, as reads may
+	// fall back to it
+	s.Crash(replica)
+	s.Go("", func() {
+		bc, e := triblab.NewBinClientWith(backs, copts)
+		check("bin client", e)
+		var succ bool
+		if e := bc.Bin("bob").Set(trib.KV("bio", "lost"), &succ); e == nil {
+			t.Error("write missed by a replica succeeded")
+		}
+	})
+	run(10 * time.Second)
+}
+
+// A keeper restarted on its StateDir resumes where it stopped, and one
+// without starts fresh.
+func TestKeeperState(t *testing.T) {
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	backs := []string{"back-0", "back-1", "back-2"}
+	var saved triblab.KeeperStatus
+	var version uint64
+	s := triblab.NewSim(1)
+	check, run := simCluster(t, s, dir, 0, backs, []string{"keeper"})
+	kc, e := triblab.NewKeeperClientWith("keeper", &triblab.ClientOptions{Sim: s})
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.Go("", func() {
+		s.Sleep(2 * time.Second)
+		var p triblab.Placement
+		check("placement", kc.GetPlacement("", &p))
+		var succ bool
+		check("pin", kc.Pin(&triblab.PinArgs{Bin: "carol", Backs: p.Lookup("carol")}, &succ))
+		s.Sleep(2 * time.Second)
+		check("status", kc.Status("", &saved))
+		check("placement", kc.GetPlacement("", &p))
+		version = p.Version
+	})
+	run(5 * time.Second)
+
+	files, e := ioutil.ReadDir(dir)
+	if e != nil || len(files) != 1 {
+		t.Fatalf("state files: %v, %v", files, e)
+	}
+
+	// the whole cluster restarts, with the backends back at clock 0
+	s = triblab.NewSim(2)
+	check, run = simCluster(t, s, dir, 0, backs, []string{"keeper"})
+	kc, e = triblab.NewKeeperClientWith("keeper", &triblab.ClientOptions{Sim: s})
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.Go("", func() {
+		s.Sleep(2 * time.Second)
+		var st triblab.KeeperStatus
+		check("status", kc.Status("", &st))
+		if st.Epoch < saved.Epoch || st.Clock < saved.Clock {
+			t.Errorf("keeper went back from epoch %d, clock %d to %+v", saved.Epoch, saved.Clock, st)
+		}
+		var p triblab.Placement
+		check("placement", kc.GetPlacement("", &p))
+		if _, found := p.Pins["carol"]; !found || p.Version < version {
+			t.Errorf("keeper lost the pin: %+v, version was %d", p, version)
+		}
+	})
+	run(3 * time.Second)
+
+	// other backends or replicas would move bins off their data
+	s = triblab.NewSim(3)
+	refused := func(what string, backs []string, replicas int, want string) {
+		s.Go("keeper", func() {
+			kc := &trib.KeeperConfig{Backs: backs, Addrs: []string{"keeper"}}
+			e := triblab.ServeKeeperWith(kc, &triblab.KeeperOptions{
+				StateDir: dir,
+				Replicas: replicas,
+				Sim:      s,
+				Logger:   triblab.NewLogger(ioutil.Discard, triblab.LOG_ERROR),
+			})
+			if e == nil || !strings.Contains(e.Error(), want) {
+				t.Errorf("%s: %v, want %q", what, e, want)
+			}
+		})
+		if e := s.Run(time.Second); e != nil {
+			t.Fatal(e)
+		}
+	}
+	refused("fewer backends", backs[:2], 0, "backends changed")
+	refused("reordered backends", []string{backs[1], backs[0], backs[2]}, 0, "backends changed")
+	refused("more replicas", backs, 2, "replicas changed")
+
+	// and without a StateDir nothing is kept
+	s = triblab.NewSim(4)
+	check, run = simCluster(t, s, "", 0, backs, []string{"keeper"})
+	kc, e = triblab.NewKeeperClientWith("keeper", &triblab.ClientOptions{Sim: s})
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.Go("", func() {
+		s.Sleep(2 * time.Second)
+		var p triblab.Placement
+		check("placement", kc.GetPlacement("", &p))
+		if len(p.Pins) != 0 {
+			t.Errorf("keeper without a StateDir kept pins: %+v", p)
+		}
+	})
+	run(3 * time.Second)
+}
+
+// A plain ServeKeeper saves its state too, per address and backends.
+func TestKeeperDefaultState(t *testing.T) {
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { triblab.KEEPER_STATE_DIR = old }(triblab.KEEPER_STATE_DIR)
+	triblab.KEEPER_STATE_DIR = dir
+
+	addr := randaddr.Local()
+	addrk := randaddr.Local()
+	for addrk == addr {
+		addrk = randaddr.Local()
+	}
+	ready := make(chan bool)
+	go func() {
+		e := entries.ServeBackSingle(addr, store.NewStorage(), ready)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-ready {
+		t.Fatal("not ready")
+	}
+
+	go func() {
+		e := triblab.ServeKeeper(&trib.KeeperConfig{
+			Backs: []string{addr},
+			Addrs: []string{addrk},
+			Ready: ready,
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-ready {
+		t.Fatal("keeper not ready")
+	}
+
+	paths, e := filepath.Glob(filepath.Join(dir, "*", "keeper-*.state"))
+	if e != nil || len(paths) != 1 {
+		t.Fatalf("state files %v, %v", paths, e)
+	}
+	saved, e := ioutil.ReadFile(paths[0])
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !strings.Contains(string(saved), addr) {
+		t.Fatalf("state does not name the backend: %s", saved)
+	}
+}
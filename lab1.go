@@ -1,22 +1,123 @@
 package triblab
 
 import (
+	"fmt"
 	"trib"
-	"net"
 	"net/rpc"
-	"net/http"
-	"fmt"
 )
 
-// Creates an RPC client that connects to addr.
+// Creates an RPC client that connects to addr. Addresses starting with
+// JSONRPC_SCHEME are reached over JSON-RPC instead of gob.
 func NewClient(addr string) trib.Storage {
 	return &client{addr: addr}
 }
 
+// Client options that do not fit into an address.
+type ClientOptions struct {
+	// Talk TLS to servers that require it. Nil for plaintext.
+	TLS *TLSConfig
+
+	// Caller token for backends that check callers, see NewToken.
+	Token string
+
+	// Logs calls at LOG_DEBUG. Nil for the one given to SetLogger.
+	Logger *Logger
+
+	// Call over the simulation instead of the network. Nil for the
+	// network.
+	Sim *Sim
+}
+
+func NewClientWith(addr string, opts *ClientOptions) (trib.Storage, error) {
+	if opts == nil {
+		opts = new(ClientOptions)
+	}
+
+	conf, e := opts.TLS.client()
+	if e != nil {
+		return nil, e
+	}
+	return &client{addr: addr, tls: conf, token: opts.Token, log: opts.Logger, sim: opts.Sim}, nil
+}
+
+// Backend options that do not fit into trib.BackConfig.
+type BackOptions struct {
+	// Address to also serve JSON-RPC 2.0 on, over plain TCP. JSON-RPC
+	// is always taken as HTTP POSTs at JSONRPC_PATH on the main address.
+	JSONAddr string
+
+	// Serve TLS only, and only to clients with a certificate signed by
+	// the configured CA. Nil for plaintext.
+	TLS *TLSConfig
+
+	// Check the token of every caller against the ACL. Nil to let
+	// anyone do anything. Needs TLS.
+	Auth *AuthConfig
+
+	// Refuse calls over these limits with ErrOverloaded. Nil for no
+	// limits.
+	Limits *Limits
+
+	// Middlewares around every storage call, outermost first, e.g.
+	// LogCalls or Metrics.Interceptor.
+	Interceptors []Interceptor
+
+	// Address to serve /healthz, /readyz, /metrics and /debug/pprof/
+	// on, over plain HTTP. Empty for none.
+	AdminAddr string
+
+	// Records a span for every call served, continuing the trace of
+	// the caller. Nil for no tracing.
+	Tracer *Tracer
+
+	// Nil for the one given to SetLogger. Lines get the backend address
+	// as the node field.
+	Logger *Logger
+
+	// Serve within the simulation, on its clock, instead of on the
+	// network. Nil for the network.
+	Sim *Sim
+}
+
 // Serve as a backend based on the given configuration
 func ServeBack(b *trib.BackConfig) error {
+	return ServeBackWith(b, nil)
+}
+
+func ServeBackWith(b *trib.BackConfig, opts *BackOptions) error {
+	if opts == nil {
+		opts = new(BackOptions)
+	}
+	if opts.Auth != nil && opts.TLS == nil {
+		if b.Ready != nil {
+			b.Ready <- false
+		}
+		return fmt.Errorf("Auth needs TLS, caller tokens would go in plaintext")
+	}
+
+	conf, e := opts.TLS.server()
+	if e != nil {
+		if b.Ready != nil {
+			b.Ready <- false
+		}
+		return e
+	}
+
+	back := newBackend(b.Store)
+	back.log = opts.Logger.With("node", b.Addr)
+	back.sim = opts.Sim
+	chain := opts.Interceptors
+	metrics := NewMetrics()
+	if opts.AdminAddr != "" {
+		chain = append([]Interceptor{metrics.Interceptor()}, chain...)
+	}
+	var served Storage = back
+	if len(chain) > 0 {
+		served = Intercept(back, chain...)
+	}
+
 	srv := rpc.NewServer()
-	e := srv.RegisterName("Storage", b.Store)
+	e = srv.RegisterName("Storage", served)
 	if e != nil {
 		if b.Ready != nil {
 			b.Ready <- false
@@ -24,19 +125,60 @@ func ServeBack(b *trib.BackConfig) error {
 		return e
 	}
 
-	l, e := net.Listen("tcp", b.Addr)
-	fmt.Println("srv2: ", b.Addr)
+	callers := anyCaller(srv)
+	if opts.Auth != nil {
+		auth, e := newAuthority(opts.Auth, served, back)
+		if e != nil {
+			if b.Ready != nil {
+				b.Ready <- false
+			}
+			return e
+		}
+		callers = auth.server
+	}
+
+	l, e := opts.Sim.listen(b.Addr, conf)
 	if e != nil {
+		back.log.Error("could not listen", "addr", b.Addr, "error", e)
 		if b.Ready != nil {
 			b.Ready <- false
 		}
 		return e
 	}
 
+	h := &rpcHandler{srv: callers, lim: newLimiter(opts.Limits), tracer: opts.Tracer}
+	e = listenJSON(h, opts.JSONAddr, conf)
+	if e != nil {
+		l.Close()
+		if b.Ready != nil {
+			b.Ready <- false
+		}
+		return e
+	}
+
+	var ready readyFlag
+	if opts.AdminAddr != "" {
+		e = serveAdmin(opts.AdminAddr, &adminNode{
+			ready:   func() error { return ready.check("backend") },
+			metrics: backMetrics(back, metrics),
+			traces:  opts.Tracer,
+		})
+		if e != nil {
+			l.Close()
+			if b.Ready != nil {
+				b.Ready <- false
+			}
+			return e
+		}
+	}
+
+	opts.Sim.spawn(func() { back.sweep(TTL_SWEEP) })
+	ready.mark()
+	back.log.Info("serving storage", "json", opts.JSONAddr, "admin", opts.AdminAddr)
 
 	if b.Ready != nil {
 		b.Ready <- true
 	}
 
-	return http.Serve(l, srv)
+	return serve(l, h)
 }
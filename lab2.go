@@ -1,24 +1,36 @@
 package triblab
 
 import (
+	"crypto/tls"
 	"trib"
 	"encoding/json"
 	"fmt"
-	"hash/fnv"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	USER_BIN = "_USERLIST_"
+
+	// how often front ends look for a new placement table
+	PLACEMENT_REFRESH = time.Second
+
+	// how long front ends wait on a backend for the table
+	PLACEMENT_TIMEOUT = 2 * time.Second
+
+	// field of the posts that timelines and expiry order them by
+	POSTS_ORDER = "Clock"
 )
 
 type BinI struct {
 	trib.Storage
 
 	bname string
-	pstore trib.Storage
+	stores []Storage // replicas, primary first
+	shadows []Storage // write-only copies, while migrating
+	sim *Sim          // nil for the real network
 }
 
 type VStorage struct {
@@ -27,18 +39,79 @@ type VStorage struct {
 
 	baddrs []string     // backend addresses
 	binmap map[string]*BinI
+
+	lock sync.Mutex
+	place *Placement    // last table published by the keeper
+	fetched time.Time   // last refresh of place
+	refreshing bool     // a refresh is fetching the table
+
+	tls *tls.Config     // nil for plaintext
+	token string        // caller token, "" for none
+	log *Logger         // nil for the default
+	sim *Sim            // nil for the real network
 }
 
 type ServerI struct {
 	trib.Server
 
 	vstore trib.BinStorage
-	users []string
+	users *userList
+
+	tracer *Tracer  // nil for no tracing
+	span *Span      // of the call being served, on traced copies
+	log *Logger     // nil for the default
+	sim *Sim        // nil for real time
+}
+
+// Users seen so far, shared by the copies of a front end.
+type userList struct {
+	lock sync.Mutex
+	names []string
 }
 
 // BinI 
+
+// Reads from the first replica that answers.
+func (self *BinI) read(f func(s Storage) error) error {
+	var e error
+	for _, s := range self.stores {
+		e = f(s)
+		if e == nil {
+			return nil
+		}
+	}
+	return e
+}
+
+// Writes to every replica and shadow. The primary goes last so that its
+// result is the one left in the reply. Fails if any copy did, since reads
+// fall back to the replicas; the primary's error comes first.
+func (self *BinI) write(f func(s Storage) error) error {
+	var err error
+	for _, s := range self.shadows {
+		e := f(s)
+		if e != nil && err == nil {
+			err = fmt.Errorf("shadow of bin %q: %v", self.bname, e)
+		}
+	}
+	for i := len(self.stores)-1; i > 0; i-- {
+		e := f(self.stores[i])
+		if e != nil && err == nil {
+			err = fmt.Errorf("replica %d of bin %q: %v", i, self.bname, e)
+		}
+	}
+
+	e := f(self.stores[0])
+	if e != nil {
+		return e
+	}
+	return err
+}
+
 func (self *BinI) Get(key string, value *string) error {
-	return self.pstore.Get(self.bname+"::"+key, value)
+	return self.read(func(s Storage) error {
+		return s.Get(self.bname+"::"+key, value)
+	})
 }
 
 func (self *BinI) Set(kv *trib.KeyValue, succ *bool) error {
@@ -50,7 +123,9 @@ func (self *BinI) Set(kv *trib.KeyValue, succ *bool) error {
 		kvb = nil
 	}
 
-	return self.pstore.Set(kvb, succ)
+	return self.write(func(s Storage) error {
+		return s.Set(kvb, succ)
+	})
 }
 
 func (self *BinI) rmPrefix(slist []string) []string {
@@ -70,7 +145,9 @@ func (self *BinI) Keys(p *trib.Pattern, list *trib.List) error {
 		pb = nil
 	}
 
-	err := self.pstore.Keys(pb, list)
+	err := self.read(func(s Storage) error {
+		return s.Keys(pb, list)
+	})
 	if err != nil {
 		return err
 	}
@@ -80,7 +157,9 @@ func (self *BinI) Keys(p *trib.Pattern, list *trib.List) error {
 }
 
 func (self *BinI) ListGet(key string, list *trib.List) error {
-	return self.pstore.ListGet(self.bname+"::"+key, list)
+	return self.read(func(s Storage) error {
+		return s.ListGet(self.bname+"::"+key, list)
+	})
 }
 
 func (self *BinI) ListAppend(kv *trib.KeyValue, succ *bool) error {
@@ -92,7 +171,9 @@ func (self *BinI) ListAppend(kv *trib.KeyValue, succ *bool) error {
 		kvb = nil
 	}
 
-	return self.pstore.ListAppend(kvb, succ)
+	return self.write(func(s Storage) error {
+		return s.ListAppend(kvb, succ)
+	})
 }
 
 func (self *BinI) ListRemove(kv *trib.KeyValue, n* int) error {
@@ -104,7 +185,9 @@ func (self *BinI) ListRemove(kv *trib.KeyValue, n* int) error {
 		kvb = nil
 	}
 
-	return self.pstore.ListRemove(kvb, n)
+	return self.write(func(s Storage) error {
+		return s.ListRemove(kvb, n)
+	})
 }
 
 func (self *BinI) ListKeys(p *trib.Pattern, list *trib.List) error {
@@ -116,7 +199,9 @@ func (self *BinI) ListKeys(p *trib.Pattern, list *trib.List) error {
 		pb = nil
 	}
 
-	err := self.pstore.ListKeys(pb, list)
+	err := self.read(func(s Storage) error {
+		return s.ListKeys(pb, list)
+	})
 	if err != nil {
 		return err
 	}
@@ -126,17 +211,303 @@ func (self *BinI) ListKeys(p *trib.Pattern, list *trib.List) error {
 }
 
 func (self *BinI) Clock(atLeast uint64, ret *uint64) error {
-	return self.pstore.Clock(atLeast, ret)
+	return self.read(func(s Storage) error {
+		return s.Clock(atLeast, ret)
+	})
+}
+
+func (self *BinI) Scan(args *ScanArgs, page *ScanPage) error {
+	ab := *args
+	ab.Prefix = self.bname+"::"+args.Prefix
+	if args.Cursor != "" {
+		ab.Cursor = self.bname+"::"+args.Cursor
+	}
+
+	err := self.read(func(s Storage) error {
+		return s.Scan(&ab, page)
+	})
+	if err != nil {
+		return err
+	}
+
+	page.Keys = self.rmPrefix(page.Keys)
+	if page.Cursor != "" {
+		page.Cursor = strings.SplitN(page.Cursor, "::", 2)[1]
+	}
+	return nil
+}
+
+func (self *BinI) ListRange(args *RangeArgs, list *trib.List) error {
+	ab := *args
+	ab.Key = self.bname+"::"+args.Key
+
+	return self.read(func(s Storage) error {
+		return s.ListRange(&ab, list)
+	})
+}
+
+func (self *BinI) ListLen(key string, n *int) error {
+	return self.read(func(s Storage) error {
+		return s.ListLen(self.bname+"::"+key, n)
+	})
+}
+
+func (self *BinI) ListTrim(args *TrimArgs, n *int) error {
+	ab := *args
+	ab.Key = self.bname+"::"+args.Key
+
+	return self.write(func(s Storage) error {
+		return s.ListTrim(&ab, n)
+	})
+}
+
+func (self *BinI) SetWithTTL(args *TTLArgs, succ *bool) error {
+	ab := *args
+	ab.Key = self.bname+"::"+args.Key
+
+	return self.write(func(s Storage) error {
+		return s.SetWithTTL(&ab, succ)
+	})
+}
+
+func (self *BinI) ListExpire(args *ExpireArgs, succ *bool) error {
+	ab := *args
+	ab.Key = self.bname+"::"+args.Key
+
+	return self.write(func(s Storage) error {
+		return s.ListExpire(&ab, succ)
+	})
+}
+
+func (self *BinI) Incr(args *IncrArgs, ret *int64) error {
+	ab := *args
+	ab.Key = self.bname+"::"+args.Key
+
+	return self.write(func(s Storage) error {
+		return s.Incr(&ab, ret)
+	})
+}
+
+func (self *BinI) prefixed(keys []string) []string {
+	ret := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ret = append(ret, self.bname+"::"+k)
+	}
+	return ret
+}
+
+func (self *BinI) Watch(args *WatchArgs, ret *WatchResult) error {
+	ab := *args
+	ab.Keys = self.prefixed(args.Keys)
+	ab.Lists = self.prefixed(args.Lists)
+
+	err := self.read(func(s Storage) error {
+		return s.Watch(&ab, ret)
+	})
+	if err != nil {
+		return err
+	}
+
+	ret.Keys = self.rmPrefix(ret.Keys)
+	ret.Lists = self.rmPrefix(ret.Lists)
+	return nil
+}
+
+// Versions are per backend, so transactions stick to the primary, and
+// are refused while the bin migrates.
+func (self *BinI) GetVersioned(args *VersionArgs, ret *Versioned) error {
+	if len(self.shadows) > 0 {
+		return ErrMigrating
+	}
+	ab := *args
+	ab.Key = self.bname+"::"+args.Key
+
+	return self.stores[0].GetVersioned(&ab, ret)
+}
+
+// Commits on the primary, then brings the other copies along.
+func (self *BinI) Commit(args *CommitArgs, committed *bool) error {
+	if len(self.shadows) > 0 {
+		return ErrMigrating
+	}
+	ab := CommitArgs{
+		Reads: make([]TxnRead, 0, len(args.Reads)),
+		Writes: make([]TxnWrite, 0, len(args.Writes)),
+	}
+	for _, r := range args.Reads {
+		r.Key = self.bname+"::"+r.Key
+		ab.Reads = append(ab.Reads, r)
+	}
+	for _, w := range args.Writes {
+		w.Key = self.bname+"::"+w.Key
+		ab.Writes = append(ab.Writes, w)
+	}
+
+	err := self.stores[0].Commit(&ab, committed)
+	if err != nil || !*committed {
+		return err
+	}
+
+	return self.follow(ab.Writes)
+}
+
+// Applies writes done on the primary to the other copies. Fails like
+// write does if any copy did.
+func (self *BinI) follow(writes []TxnWrite) error {
+	var err error
+	copies := make([]Storage, 0, len(self.stores)+len(self.shadows))
+	copies = append(copies, self.stores[1:]...)
+	copies = append(copies, self.shadows...)
+	for _, s := range copies {
+		for i := range writes {
+			e := applyWrite(s, &writes[i])
+			if e != nil && err == nil {
+				err = fmt.Errorf("copy of bin %q: %v", self.bname, e)
+			}
+		}
+	}
+	return err
+}
+
+// Both phases run on the primary, like Commit. Decide is never refused,
+// as it finishes what was prepared before the migration.
+func (self *BinI) Prepare(args *PrepareArgs, ok *bool) error {
+	if len(self.shadows) > 0 {
+		return ErrMigrating
+	}
+	ab := PrepareArgs{
+		Id: args.Id,
+		Reads: make([]TxnRead, 0, len(args.Reads)),
+		Writes: make([]TxnWrite, 0, len(args.Writes)),
+	}
+	for _, r := range args.Reads {
+		r.Key = self.bname+"::"+r.Key
+		ab.Reads = append(ab.Reads, r)
+	}
+	for _, w := range args.Writes {
+		w.Key = self.bname+"::"+w.Key
+		ab.Writes = append(ab.Writes, w)
+	}
+
+	return self.stores[0].Prepare(&ab, ok)
+}
+
+func (self *BinI) Decide(args *DecideArgs, ret *Decision) error {
+	err := self.stores[0].Decide(args, ret)
+	if err != nil {
+		return err
+	}
+
+	err = self.follow(ret.Writes)
+	ret.Writes = self.rmPrefixWrites(ret.Writes)
+	return err
+}
+
+func (self *BinI) rmPrefixWrites(writes []TxnWrite) []TxnWrite {
+	ret := make([]TxnWrite, 0, len(writes))
+	for _, w := range writes {
+		w.Key = strings.SplitN(w.Key, "::", 2)[1]
+		ret = append(ret, w)
+	}
+	return ret
+}
+
+func (self *BinI) InDoubt(age time.Duration, ids *[]string) error {
+	return self.stores[0].InDoubt(age, ids)
+}
+
+// Starts a transaction on the bin.
+func (self *BinI) Begin() *Txn {
+	return NewTxn(self)
 }
 
 var _ trib.Storage = new(BinI)
+var _ Storage = new(BinI)
 
 
 // VStorage
 func (self *VStorage) bin_hash(name string) uint32 {
-	h := fnv.New32a()
-	h.Write([]byte(name))
-        return uint32(h.Sum32()) % uint32(len(self.baddrs))
+	return uint32(hashBin(name, len(self.baddrs)))
+}
+
+func (self *VStorage) client(addr string) *client {
+	return &client{addr: addr, tls: self.tls, token: self.token, log: self.log, sim: self.sim}
+}
+
+// Picks up a newer placement table from the backends, at most once per
+// PLACEMENT_REFRESH unless forced. The table is fetched without the lock,
+// by one caller at a time, so that the other Bin calls go on with the
+// table they have. Bins are re-resolved when the table changes.
+func (self *VStorage) refresh(force bool) {
+	self.lock.Lock()
+	if !force && (self.refreshing || self.sim.since(self.fetched) < PLACEMENT_REFRESH) {
+		self.lock.Unlock()
+		return
+	}
+	self.refreshing = true
+	self.fetched = self.sim.time()
+	self.lock.Unlock()
+
+	p := self.fetch()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.refreshing = false
+	if p != nil && (self.place == nil || p.Version > self.place.Version) {
+		self.place = p
+		self.binmap = make(map[string]*BinI)
+	}
+}
+
+// Reads the table from the first backend answering within
+// PLACEMENT_TIMEOUT, nil if it has none.
+func (self *VStorage) fetch() *Placement {
+	for _, addr := range self.baddrs {
+		c := self.client(addr)
+		var v string
+		var e error
+		if !self.sim.timeout(PLACEMENT_TIMEOUT, func() { e = c.Get(PLACEMENT_KEY, &v) }) || e != nil {
+			continue
+		}
+		if v == "" {
+			return nil // no keeper has published yet
+		}
+
+		p, e := unmarshalPlacement(v)
+		if e != nil {
+			return nil
+		}
+		return p
+	}
+	return nil
+}
+
+// Caller holds the lock.
+func (self *VStorage) place_bin(name string) (backs, shadows []string) {
+	if self.place != nil {
+		backs = self.place.Lookup(name)
+		shadows = self.place.Shadows(name)
+	}
+	if len(backs) == 0 {
+		backs = []string{self.baddrs[self.bin_hash(name)]}
+	}
+	return backs, shadows
+}
+
+// Where Bin places a bin: the backends serving it, primary first, and
+// those only getting its writes while it migrates. Version is that of
+// the placement table used, 0 while no keeper has published one and
+// bins are hashed onto the backends.
+func (self *VStorage) Where(name string) (backs, shadows []string, version uint64) {
+	self.refresh(true) // the latest table, however recent ours is
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	backs, shadows = self.place_bin(name)
+	if self.place != nil {
+		version = self.place.Version
+	}
+	return backs, shadows, version
 }
 
 func (self *VStorage) Bin(name string) trib.Storage {
@@ -144,17 +515,41 @@ func (self *VStorage) Bin(name string) trib.Storage {
 		return nil
 	}
 
+	self.refresh(false)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	b, e := self.binmap[name]
 	if e == true {
 		return b
 	}
 
-	h := self.bin_hash(name)
-	newbin := &BinI{bname: name, pstore: NewClient(self.baddrs[h])}
+	backs, shadows := self.place_bin(name)
+	log := self.log.With("bin", name)
+	stores := make([]Storage, 0, len(backs))
+	for _, addr := range backs {
+		c := self.client(addr)
+		c.log = log
+		stores = append(stores, c)
+	}
+	newbin := &BinI{bname: name, stores: stores, sim: self.sim}
+	for _, addr := range shadows {
+		c := self.client(addr)
+		c.log = log
+		newbin.shadows = append(newbin.shadows, c)
+	}
 	self.binmap[name] = newbin
 	return newbin
 }
 
+func (self *VStorage) simulation() *Sim {
+	return self.sim
+}
+
+func (self *BinI) simulation() *Sim {
+	return self.sim
+}
+
 var _ trib.BinStorage = new(VStorage)
 
 
@@ -214,14 +609,41 @@ func less_message(t1, t2 *trib.Trib) bool {
 	return t1.Message < t2.Message
 }
 
-func printTribs(tribs []*trib.Trib) {
-	for _, t := range tribs {
-		fmt.Println(t.Clock, t.Time, t.User, t.Message)
-	}
-}
 
 
 // ServerI
+
+// Bins of front ends backed by plain trib.Storage get the extended
+// operations emulated.
+func (self *ServerI) bin(name string) Storage {
+	return extend(self.vstore.Bin(name))
+}
+
+// Starts a span for a call to the front end, under the call being served
+// if any. Returns a copy of the front end whose backend calls go in the
+// span.
+func (self *ServerI) trace(name string) (*ServerI, *Span) {
+	if self.tracer == nil {
+		return self, nil
+	}
+
+	var sp *Span
+	if self.span == nil {
+		sp = self.tracer.Start(name, SPAN_SERVER, "")
+	} else {
+		sp = self.span.Child(name, SPAN_INTERNAL)
+	}
+
+	ret := *self
+	ret.span = sp
+	if t, ok := self.vstore.(*tracedBins); ok {
+		ret.vstore = &tracedBins{bins: t.bins, span: sp}
+	} else {
+		ret.vstore = &tracedBins{bins: self.vstore, span: sp}
+	}
+	return &ret, sp
+}
+
 func (self *ServerI) hasUser(user string) (bool, error) {
 	var exist_flag string
 
@@ -233,7 +655,12 @@ func (self *ServerI) hasUser(user string) (bool, error) {
 	return exist_flag=="true", nil
 }
 
-func (self *ServerI) SignUp(user string) error {
+func (self *ServerI) SignUp(user string) (e error) {
+	self, sp := self.trace("SignUp")
+	sp.SetAttr("user", user)
+	defer sp.finishErr(&e)
+
+
 	if !trib.IsValidUsername(user) {
 		return fmt.Errorf("Invalid user name %q", user)
 	}
@@ -268,33 +695,40 @@ func (self *ServerI) SignUp(user string) error {
 }
 
 
-func (self *ServerI) ListUsers() ([]string, error) {
-	if len(self.users) >= trib.MinListUser {
-		return self.users, nil
+func (self *ServerI) ListUsers() (ret []string, e error) {
+	self, sp := self.trace("ListUsers")
+	defer sp.finishErr(&e)
+
+	self.users.lock.Lock()
+	names := self.users.names
+	self.users.lock.Unlock()
+	if len(names) >= trib.MinListUser {
+		return names, nil
 	}
 
-	userDB := self.vstore.Bin(USER_BIN)
-	var userlist trib.List
-	err := userDB.Keys(&trib.Pattern{"",""}, &userlist)
+	// the user list only ever grows, one page is enough
+	userDB := self.bin(USER_BIN)
+	var page ScanPage
+	err := userDB.Scan(&ScanArgs{Limit: trib.MinListUser}, &page)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(userlist.L) < trib.MinListUser {
-		self.users = userlist.L
-	} else {
-		self.users = userlist.L[0:trib.MinListUser]
-	}
+	names = page.Keys
+	sort.Strings(names)
 
-	sort.Strings(self.users)
-	return self.users, nil
+	self.users.lock.Lock()
+	self.users.names = names
+	self.users.lock.Unlock()
+	return names, nil
 }
 
 
+// Fetches the last MaxTribFetch posts of user.
 func (self *ServerI) getTribs(user string) ([]*trib.Trib, error) {
 	var list trib.List
-	bin := self.vstore.Bin(user)
-	err := bin.ListGet("posts", &list)
+	bin := self.bin(user)
+	err := bin.ListRange(&RangeArgs{Key: "posts", Start: -trib.MaxTribFetch, Stop: -1, By: POSTS_ORDER}, &list)
 	if err != nil {
 		return nil, err
 	}
@@ -313,39 +747,33 @@ func (self *ServerI) getTribs(user string) ([]*trib.Trib, error) {
 
 
 func (self *ServerI) expirePosts(user string) {
-	tribs, err := self.getTribs(user)
-	if err != nil {
-		fmt.Errorf("Error: getTribs failure.")
-		return
-	}
+	bin := self.bin(user)
 
-	if len(tribs) <= trib.MaxTribFetch {
+	// concurrent posts land out of clock order, so drop the oldest by
+	// clock rather than the first appended
+	var n int
+	err := bin.ListTrim(&TrimArgs{Key: "posts", Keep: trib.MaxTribFetch, By: POSTS_ORDER}, &n)
+	if err != nil {
+		self.log.Warn("could not trim posts", "bin", user, "error", err)
 		return
 	}
 
-	OrderedBy(less_clock, less_time, less_user, less_message).Sort(tribs)
-
-	bin := self.vstore.Bin(user)
-
-	for i:=0; i<len(tribs)-trib.MaxTribFetch; i++ {
-		post, _ := json.Marshal(*tribs[i])
-
-		var n int
-		err = bin.ListRemove(&trib.KeyValue{Key: "posts", Value: string(post)}, &n)
-		if err != nil {
-			fmt.Errorf("Error: expirePosts failure.")
-		}
-
+	if n > 0 {
 		var clk uint64
 		err = bin.Clock(0, &clk)
 		if err != nil {
-			fmt.Errorf("Error: expirePosts clock update failure.")
+			self.log.Warn("could not sync clock after trimming posts", "bin", user, "error", err)
 		}
 	}
 }
 
 
-func (self *ServerI) Post(who, post string, clock uint64) error {
+func (self *ServerI) Post(who, post string, clock uint64) (e error) {
+	self, sp := self.trace("Post")
+	sp.SetAttr("user", who)
+	defer sp.finishErr(&e)
+
+
 	exist, err := self.hasUser(who)
 	if err != nil {
 		return err
@@ -373,7 +801,7 @@ func (self *ServerI) Post(who, post string, clock uint64) error {
 		return err
 	}
 
-	tb := trib.Trib{who, post, time.Now(), newclk}
+	tb := trib.Trib{who, post, self.sim.time(), newclk}
 	tb_json, errj := json.Marshal(tb)
 	if errj != nil {
 		return errj
@@ -393,7 +821,12 @@ func (self *ServerI) Post(who, post string, clock uint64) error {
 }
 
 
-func (self *ServerI) Tribs(user string) ([]*trib.Trib, error) {
+func (self *ServerI) Tribs(user string) (ret []*trib.Trib, e error) {
+	self, sp := self.trace("Tribs")
+	sp.SetAttr("user", user)
+	defer sp.finishErr(&e)
+
+
 	exist, err := self.hasUser(user)
 	if err != nil {
 		return nil, err
@@ -419,7 +852,7 @@ func (self *ServerI) Tribs(user string) ([]*trib.Trib, error) {
 		tlist = tribs[len(tribs)-trib.MaxTribFetch:]
 	}
 
-	printTribs(tlist)
+	self.log.Debug("tribs", "bin", user, "count", len(tlist))
 	return tlist, nil
 }
 
@@ -443,7 +876,12 @@ func removeDup(s []string) []string {
 }
 
 
-func (self *ServerI) Following(who string) ([]string, error) {
+func (self *ServerI) Following(who string) (ret []string, e error) {
+	self, sp := self.trace("Following")
+	sp.SetAttr("user", who)
+	defer sp.finishErr(&e)
+
+
 	exist, err := self.hasUser(who)
 	if err != nil {
 		return nil, err
@@ -463,7 +901,13 @@ func (self *ServerI) Following(who string) ([]string, error) {
 }
 
 
-func (self *ServerI) IsFollowing(who, whom string) (bool, error) {
+func (self *ServerI) IsFollowing(who, whom string) (ret bool, e error) {
+	self, sp := self.trace("IsFollowing")
+	sp.SetAttr("user", who)
+	sp.SetAttr("whom", whom)
+	defer sp.finishErr(&e)
+
+
 	exist, err := self.hasUser(who)
 	if err != nil {
 		return false, err
@@ -501,7 +945,13 @@ func (self *ServerI) IsFollowing(who, whom string) (bool, error) {
 
 
 
-func (self *ServerI) Follow(who, whom string) error {
+func (self *ServerI) Follow(who, whom string) (e error) {
+	self, sp := self.trace("Follow")
+	sp.SetAttr("user", who)
+	sp.SetAttr("whom", whom)
+	defer sp.finishErr(&e)
+
+
 	exist, err := self.hasUser(who)
 	if err != nil {
 		return err
@@ -523,38 +973,36 @@ func (self *ServerI) Follow(who, whom string) error {
 	}
 
 
-	// is already following?
-	isFollowing, err2 := self.IsFollowing(who, whom)
-	if err2 != nil {
-		return err2
-	}
-
-	if isFollowing {
-		return fmt.Errorf("already following user %q.", whom)
-	}
-
+	// check and append in one go, so that concurrent follows can not
+	// slip in between; whom's followers list goes along
+	err = RunXTxn(self.vstore, func(xt *XTxn) error {
+		var list trib.List
+		err := xt.Bin(who).ListGet("follows", &list)
+		if err != nil {
+			return err
+		}
 
-	flist, err3 := self.Following(who)
-	if err3 != nil {
-		return err3
-	}
+		flist := removeDup(list.L)
+		for _, w := range flist {
+			if w == whom {
+				return fmt.Errorf("already following user %q.", whom)
+			}
+		}
 
-	if len(flist) >= trib.MaxFollowing {
-		return fmt.Errorf("Reached max. limit of ", trib.MaxFollowing, " followees.")
-	}
+		if len(flist) >= trib.MaxFollowing {
+			return fmt.Errorf("Reached max. limit of %d followees.", trib.MaxFollowing)
+		}
 
-	bin := self.vstore.Bin(who)
-	var b bool
-	err = bin.ListAppend(&trib.KeyValue{"follows", whom}, &b)
+		xt.Bin(who).ListAppend(&trib.KeyValue{"follows", whom})
+		xt.Bin(whom).ListAppend(&trib.KeyValue{"followers", who})
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	if !b {
-		return fmt.Errorf("Follow list append failed.")
-	}
 
 	var clk uint64
-	err = bin.Clock(0, &clk)
+	err = self.bin(who).Clock(0, &clk)
 	if err != nil {
 		return err
 	}
@@ -563,7 +1011,13 @@ func (self *ServerI) Follow(who, whom string) error {
 }
 
 
-func (self *ServerI) Unfollow(who, whom string) error {
+func (self *ServerI) Unfollow(who, whom string) (e error) {
+	self, sp := self.trace("Unfollow")
+	sp.SetAttr("user", who)
+	sp.SetAttr("whom", whom)
+	defer sp.finishErr(&e)
+
+
 	exist, err := self.hasUser(who)
 	if err != nil {
 		return err
@@ -585,24 +1039,28 @@ func (self *ServerI) Unfollow(who, whom string) error {
 	}
 
 
-	is_following, err2 := self.IsFollowing(who, whom)
-	if err2 != nil {
-		return err2
-	}
+	err = RunXTxn(self.vstore, func(xt *XTxn) error {
+		var list trib.List
+		err := xt.Bin(who).ListGet("follows", &list)
+		if err != nil {
+			return err
+		}
 
-	if !is_following {
+		for _, w := range list.L {
+			if w == whom {
+				xt.Bin(who).ListRemove(&trib.KeyValue{"follows", whom})
+				xt.Bin(whom).ListRemove(&trib.KeyValue{"followers", who})
+				return nil
+			}
+		}
 		return fmt.Errorf("User %q is not following %q.", who, whom)
-	}
-
-	bin := self.vstore.Bin(who)
-	var n int
-	err = bin.ListRemove(&trib.KeyValue{"follows", whom}, &n)
+	})
 	if err != nil {
 		return err
 	}
 
 	var clk uint64
-	err = bin.Clock(0, &clk)
+	err = self.bin(who).Clock(0, &clk)
 	if err != nil {
 		return err
 	}
@@ -611,7 +1069,12 @@ func (self *ServerI) Unfollow(who, whom string) error {
 }
 
 
-func (self *ServerI) Home(user string) ([]*trib.Trib, error) {
+func (self *ServerI) Home(user string) (ret []*trib.Trib, e error) {
+	self, sp := self.trace("Home")
+	sp.SetAttr("user", user)
+	defer sp.finishErr(&e)
+
+
 	exist, err := self.hasUser(user)
 	if err != nil {
 		return nil, err
@@ -628,30 +1091,19 @@ func (self *ServerI) Home(user string) ([]*trib.Trib, error) {
 	flist = append(flist, user)
 	tribs := make([]*trib.Trib, 0)
 
-	tribs_chan := make(chan []*trib.Trib, len(flist))
-	ready_chan := make(chan bool, len(flist))
+	fetched := make([][]*trib.Trib, len(flist))
 
 	// create multiple retrieval routines for each followee.
-	for _, u := range flist {
-		go func(user string) {
-			tl := make([]*trib.Trib, 0)
-			u_tribs, u_err := self.Tribs(user)
-			if u_err != nil {
-				fmt.Errorf("Error retrieving tribs for user %q.", user)
-			}
-
-			for _, trib := range u_tribs {
-				tl = append(tl, trib)
-			}
-
-			tribs_chan <- tl
-			ready_chan <- true
-		}(u)
-	}
+	self.sim.fanOut(len(flist), func(i int) {
+		user := flist[i]
+		u_tribs, u_err := self.Tribs(user)
+		if u_err != nil {
+			self.log.Warn("could not fetch tribs for home", "bin", user, "error", u_err)
+		}
+		fetched[i] = u_tribs
+	})
 
-	for i:=0; i<len(flist); i++ {
-		<-ready_chan
-		var tl = <-tribs_chan
+	for _, tl := range fetched {
 		for _, tb := range tl {
 			tribs = append(tribs, tb)
 		}
@@ -672,6 +1124,25 @@ func NewBinClient(backs []string) trib.BinStorage {
 	return &VStorage{baddrs: backs, binmap: make(map[string]*BinI)}
 }
 
+func NewBinClientWith(backs []string, opts *ClientOptions) (trib.BinStorage, error) {
+	if opts == nil {
+		opts = new(ClientOptions)
+	}
+
+	conf, e := opts.TLS.client()
+	if e != nil {
+		return nil, e
+	}
+	return &VStorage{
+		baddrs: backs,
+		binmap: make(map[string]*BinI),
+		tls:    conf,
+		token:  opts.Token,
+		log:    opts.Logger,
+		sim:    opts.Sim,
+	}, nil
+}
+
 // defined in keeper.go
 /*  
 func ServeKeeper(kc *trib.KeeperConfig) error {
@@ -680,5 +1151,28 @@ func ServeKeeper(kc *trib.KeeperConfig) error {
 */
 
 func NewFront(s trib.BinStorage) trib.Server {
-	return &ServerI{vstore: s, users: make([]string, 0)}
+	return NewFrontWith(s, nil)
+}
+
+// Options of a front end beyond trib.Server.
+type FrontOptions struct {
+	// Records a span for every call to the front end, with the backend
+	// calls it makes under it, and hands the trace on to the backends.
+	// Nil for no tracing.
+	Tracer *Tracer
+
+	// Logs errors the front end gets past, such as a followee whose
+	// tribs could not be fetched for a home page. Nil for the one given
+	// to SetLogger.
+	Logger *Logger
+
+	// Run within the simulation. Nil for the real world.
+	Sim *Sim
+}
+
+func NewFrontWith(s trib.BinStorage, opts *FrontOptions) trib.Server {
+	if opts == nil {
+		opts = new(FrontOptions)
+	}
+	return &ServerI{vstore: extendBins(s), users: new(userList), tracer: opts.Tracer, log: opts.Logger, sim: opts.Sim}
 }
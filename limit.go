@@ -0,0 +1,254 @@
+package triblab
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// attempts of a client call refused as overloaded
+	OVERLOAD_RETRIES = 5
+
+	// wait before the first retry, doubled on each one after
+	OVERLOAD_BACKOFF = 20 * time.Millisecond
+)
+
+// A backend refused a call to protect itself. Nothing was done, so the
+// call may be retried after backing off.
+var ErrOverloaded = errors.New("backend overloaded")
+
+// Reports whether e is, or came back over RPC as, ErrOverloaded.
+func IsOverloaded(e error) bool {
+	return e != nil && strings.HasPrefix(e.Error(), ErrOverloaded.Error())
+}
+
+// Token bucket refilled at PerSec, holding up to Burst tokens. A zero
+// PerSec means no limit.
+type Rate struct {
+	PerSec float64
+	Burst  int // 1 when less
+}
+
+// Request limits of a backend. Zero values mean no limit.
+type Limits struct {
+	// Of each caller, known by identity with auth and by remote host
+	// otherwise.
+	PerCaller Rate
+
+	// Of each method over all callers, by name such as "Keys".
+	PerMethod map[string]Rate
+
+	// Calls being served at once, over all callers. Watches do not
+	// count, as they mostly wait rather than work.
+	MaxConcurrent int
+}
+
+// Methods that wait for something to happen, and so hold no slot.
+var longPolls = map[string]bool{"Watch": true}
+
+// Checks if a call of method takes one of the MaxConcurrent slots.
+func holdsSlot(method string) bool {
+	return !longPolls[method[strings.LastIndex(method, ".")+1:]]
+}
+
+type bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(r Rate) *bucket {
+	if r.Burst < 1 {
+		r.Burst = 1
+	}
+	return &bucket{rate: r, tokens: float64(r.Burst), last: time.Now()}
+}
+
+func (self *bucket) take(now time.Time) bool {
+	self.tokens += now.Sub(self.last).Seconds() * self.rate.PerSec
+	if max := float64(self.rate.Burst); self.tokens > max {
+		self.tokens = max
+	}
+	self.last = now
+
+	if self.tokens < 1 {
+		return false
+	}
+	self.tokens--
+	return true
+}
+
+// Admits or refuses calls as they are read off connections. A nil
+// limiter admits everything.
+type limiter struct {
+	limits *Limits
+
+	lock     sync.Mutex
+	callers  map[string]*bucket
+	methods  map[string]*bucket
+	inflight int
+}
+
+func newLimiter(limits *Limits) *limiter {
+	if limits == nil {
+		return nil
+	}
+
+	ret := &limiter{
+		limits:  limits,
+		callers: make(map[string]*bucket),
+		methods: make(map[string]*bucket),
+	}
+	for m, r := range limits.PerMethod {
+		if r.PerSec > 0 {
+			ret.methods[m] = newBucket(r)
+		}
+	}
+	return ret
+}
+
+// Takes a slot for a call of method, e.g. "Storage.Keys", by caller.
+// Admitted calls that hold a slot give it back with done.
+func (self *limiter) admit(caller, method string) error {
+	if self == nil {
+		return nil
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	slot := holdsSlot(method)
+	if slot && self.limits.MaxConcurrent > 0 && self.inflight >= self.limits.MaxConcurrent {
+		return fmtOverloaded("too many calls at once")
+	}
+
+	now := time.Now()
+	if self.limits.PerCaller.PerSec > 0 {
+		b, found := self.callers[caller]
+		if !found {
+			b = newBucket(self.limits.PerCaller)
+			self.callers[caller] = b
+		}
+		if !b.take(now) {
+			return fmtOverloaded("rate limit of " + caller)
+		}
+	}
+
+	name := method[strings.LastIndex(method, ".")+1:]
+	if b, found := self.methods[name]; found && !b.take(now) {
+		return fmtOverloaded("rate limit of " + name)
+	}
+
+	if slot {
+		self.inflight++
+	}
+	return nil
+}
+
+func (self *limiter) done() {
+	if self == nil {
+		return
+	}
+
+	self.lock.Lock()
+	self.inflight--
+	self.lock.Unlock()
+}
+
+func fmtOverloaded(why string) error {
+	return errors.New(ErrOverloaded.Error() + ": " + why)
+}
+
+// Host part of a remote address, to tell anonymous callers apart.
+func remoteHost(addr string) string {
+	host, _, e := net.SplitHostPort(addr)
+	if e != nil {
+		return addr
+	}
+	return host
+}
+
+// Puts the calls read by a server codec through a limiter. Refused calls
+// are answered with the overloaded error without being served.
+type limitedCodec struct {
+	rpc.ServerCodec
+	lim    *limiter
+	caller string
+
+	lock     sync.Mutex
+	refused  map[uint64]error
+	admitted map[uint64]bool
+}
+
+func limitCodec(c rpc.ServerCodec, lim *limiter, caller string) rpc.ServerCodec {
+	if lim == nil {
+		return c
+	}
+	return &limitedCodec{
+		ServerCodec: c,
+		lim:         lim,
+		caller:      caller,
+		refused:     make(map[uint64]error),
+		admitted:    make(map[uint64]bool),
+	}
+}
+
+func (self *limitedCodec) ReadRequestHeader(r *rpc.Request) error {
+	e := self.ServerCodec.ReadRequestHeader(r)
+	if e != nil {
+		return e
+	}
+
+	e = self.lim.admit(self.caller, r.ServiceMethod)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if e != nil {
+		self.refused[r.Seq] = e
+		// no such method, so the server skips the args and answers
+		r.ServiceMethod = "limit.refused"
+	} else if holdsSlot(r.ServiceMethod) {
+		self.admitted[r.Seq] = true
+	}
+	return nil
+}
+
+func (self *limitedCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	self.lock.Lock()
+	e, refused := self.refused[r.Seq]
+	admitted := self.admitted[r.Seq]
+	delete(self.refused, r.Seq)
+	delete(self.admitted, r.Seq)
+	self.lock.Unlock()
+
+	if admitted {
+		self.lim.done()
+	}
+	if refused {
+		r.Error = e.Error()
+	}
+	return self.ServerCodec.WriteResponse(r, x)
+}
+
+// Calls method over conn, backing off and retrying while the backend
+// says it is overloaded.
+func callBackoff(conn *rpcConn, method string, args, reply interface{}) error {
+	conn.span.SetName(method)
+
+	wait := OVERLOAD_BACKOFF
+	for i := 0; ; i++ {
+		e := conn.Call(method, args, reply)
+		if !IsOverloaded(e) {
+			return conn.span.SetError(e)
+		}
+		if i+1 >= OVERLOAD_RETRIES {
+			return conn.span.SetError(ErrOverloaded)
+		}
+		conn.sim.sleep(wait)
+		wait *= 2
+	}
+}
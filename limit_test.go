@@ -0,0 +1,87 @@
+package triblab_test
+
+import (
+	"testing"
+	"time"
+
+	"trib"
+	"trib/randaddr"
+	"trib/store"
+	"triblab"
+)
+
+func startLimitedBack(t *testing.T, s trib.Storage, limits *triblab.Limits) triblab.Storage {
+	addr := randaddr.Local()
+	ready := make(chan bool)
+	go func() {
+		b := &trib.BackConfig{Addr: addr, Store: s, Ready: ready}
+		e := triblab.ServeBackWith(b, &triblab.BackOptions{Limits: limits})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-ready {
+		t.Fatal("not ready")
+	}
+	return triblab.NewClient(addr).(triblab.Storage)
+}
+
+func TestLimits(t *testing.T) {
+	c := startLimitedBack(t, store.NewStorage(), &triblab.Limits{
+		PerMethod: map[string]triblab.Rate{"Keys": {PerSec: 0.5, Burst: 2}},
+	})
+
+	var l trib.List
+	var v string
+	for i := 0; i < 2; i++ {
+		if e := c.Keys(&trib.Pattern{}, &l); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := c.Keys(&trib.Pattern{}, &l); e != triblab.ErrOverloaded {
+		t.Fatal("Keys over its rate got through:", e)
+	}
+	if e := c.Get("k", &v); e != nil {
+		t.Fatal("Get limited along with Keys:", e)
+	}
+
+	// the client backs off until the bucket refills
+	c = startLimitedBack(t, store.NewStorage(), &triblab.Limits{PerCaller: triblab.Rate{PerSec: 20}})
+	for i := 0; i < 3; i++ {
+		if e := c.Get("k", &v); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	// a slow call takes the one slot, a waiting watch does not
+	f := triblab.NewFaults()
+	f.Add(triblab.FaultRule{Method: "Keys", Delay: 2 * time.Second})
+	c = startLimitedBack(t, triblab.FaultyStorage(store.NewStorage(), f), &triblab.Limits{MaxConcurrent: 1})
+	watched := make(chan error)
+	go func() {
+		var ret triblab.WatchResult
+		watched <- c.Watch(&triblab.WatchArgs{Keys: []string{"k"}, Timeout: time.Second}, &ret)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if e := c.Get("k", &v); e != nil {
+		t.Fatal("watch took a slot:", e)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- c.Keys(&trib.Pattern{}, &l)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if e := c.Get("k", &v); !triblab.IsOverloaded(e) {
+		t.Fatal("call over the concurrency cap got through:", e)
+	}
+	if e := <-done; e != nil {
+		t.Fatal(e)
+	}
+	if e := c.Get("k", &v); e != nil {
+		t.Fatal(e)
+	}
+	if e := <-watched; e != nil {
+		t.Fatal(e)
+	}
+}
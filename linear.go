@@ -0,0 +1,290 @@
+package triblab
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"trib"
+)
+
+// One storage call of a history, from its invocation to its return.
+type Op struct {
+	Client int    // who made the call
+	Method string // "Get", "Set", "ListGet", "ListAppend" or "ListRemove"
+	Key    string
+	Value  string   // written by Set, ListAppend and ListRemove
+	Got    string   // read by Get
+	List   []string // read by ListGet
+	N      int      // removed by ListRemove
+
+	// The call returned an error, so a write may or may not have been
+	// done. Failed reads are left out of histories.
+	Failed bool
+
+	Start time.Time // invocation
+	End   time.Time // return
+}
+
+func (self *Op) String() string {
+	switch self.Method {
+	case "Get":
+		return fmt.Sprintf("%d: Get(%q) = %q", self.Client, self.Key, self.Got)
+	case "ListGet":
+		return fmt.Sprintf("%d: ListGet(%q) = %q", self.Client, self.Key, self.List)
+	case "ListRemove":
+		return fmt.Sprintf("%d: ListRemove(%q, %q) = %d", self.Client, self.Key, self.Value, self.N)
+	}
+	return fmt.Sprintf("%d: %s(%q, %q)", self.Client, self.Method, self.Key, self.Value)
+}
+
+// Records the Get/Set and list calls made through the storages it wraps.
+// Other calls are let through unrecorded.
+type History struct {
+	lock sync.Mutex
+	ops  []Op
+}
+
+func NewHistory() *History {
+	return new(History)
+}
+
+// Wraps s so that the calls made through it are recorded as client's.
+func (self *History) Record(s trib.Storage, client int) Storage {
+	return Intercept(s, self.Interceptor(client))
+}
+
+// Records the calls going through an interceptor chain as client's.
+func (self *History) Interceptor(client int) Interceptor {
+	return func(c *Call, next func() error) error {
+		op := Op{Client: client, Method: c.Method, Start: c.Start}
+		switch c.Method {
+		case "Get", "ListGet":
+			op.Key = c.Args.(string)
+		case "Set", "ListAppend", "ListRemove":
+			kv := c.Args.(*trib.KeyValue)
+			op.Key, op.Value = kv.Key, kv.Value
+		default:
+			return next()
+		}
+
+		e := next()
+		op.End = time.Now()
+		if e != nil {
+			if op.Method == "Get" || op.Method == "ListGet" {
+				return e
+			}
+			op.Failed = true
+		} else {
+			switch op.Method {
+			case "Get":
+				op.Got = *c.Reply.(*string)
+			case "ListGet":
+				op.List = append([]string(nil), c.Reply.(*trib.List).L...)
+			case "ListRemove":
+				op.N = *c.Reply.(*int)
+			}
+		}
+
+		self.lock.Lock()
+		self.ops = append(self.ops, op)
+		self.lock.Unlock()
+		return e
+	}
+}
+
+// The calls recorded so far.
+func (self *History) Ops() []Op {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]Op(nil), self.ops...)
+}
+
+// Checks that ops could have been done one at a time, each at some point
+// between its invocation and return, by a single storage. Keys are
+// independent, so each is checked on its own. Returns an error naming
+// the first key that fails.
+//
+// This is the search of Wing and Gong with the state cache of Lowe, as
+// in Porcupine; it may take exponential time on long, highly concurrent
+// histories of one key.
+func CheckLinearizable(ops []Op) error {
+	byKey := make(map[string][]*Op)
+	var keys []string
+	for i := range ops {
+		op := &ops[i]
+		k := "s:" + op.Key
+		if strings.HasPrefix(op.Method, "List") {
+			k = "l:" + op.Key
+		}
+		if byKey[k] == nil {
+			keys = append(keys, k)
+		}
+		byKey[k] = append(byKey[k], op)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !linearizable(byKey[k]) {
+			return fmt.Errorf("history of key %q is not linearizable: %v", k[2:], byKey[k])
+		}
+	}
+	return nil
+}
+
+// Sequential model of one key, a string or a list.
+type linState struct {
+	value string
+	list  []string
+}
+
+func (self *linState) hash() string {
+	return self.value + "\x00" + strings.Join(self.list, "\x00") + fmt.Sprint(len(self.list))
+}
+
+// Does op on the state, if it could have given what it gave.
+func (self *linState) step(op *Op) (*linState, bool) {
+	switch op.Method {
+	case "Get":
+		return self, op.Got == self.value
+	case "Set":
+		return &linState{value: op.Value}, true
+	case "ListGet":
+		if len(op.List) != len(self.list) {
+			return self, false
+		}
+		for i := range op.List {
+			if op.List[i] != self.list[i] {
+				return self, false
+			}
+		}
+		return self, true
+	case "ListAppend":
+		list := make([]string, 0, len(self.list)+1)
+		list = append(list, self.list...)
+		return &linState{list: append(list, op.Value)}, true
+	case "ListRemove":
+		var list []string
+		for _, v := range self.list {
+			if v != op.Value {
+				list = append(list, v)
+			}
+		}
+		n := len(self.list) - len(list)
+		return &linState{list: list}, op.Failed || n == op.N
+	}
+	return self, false
+}
+
+// An invocation or return in the event list.
+type linEvent struct {
+	op         int
+	call       bool
+	match      *linEvent // the return of a call
+	prev, next *linEvent
+}
+
+func linearizable(ops []*Op) bool {
+	// failed writes may take effect at any time after their invocation
+	never := time.Unix(1<<62, 0)
+	end := func(op *Op) time.Time {
+		if op.Failed {
+			return never
+		}
+		return op.End
+	}
+
+	type point struct {
+		at   time.Time
+		op   int
+		call bool
+	}
+	points := make([]point, 0, 2*len(ops))
+	for i, op := range ops {
+		points = append(points, point{op.Start, i, true}, point{end(op), i, false})
+	}
+	// calls first on ties, taking such ops as concurrent
+	sort.SliceStable(points, func(i, j int) bool {
+		if !points[i].at.Equal(points[j].at) {
+			return points[i].at.Before(points[j].at)
+		}
+		return points[i].call && !points[j].call
+	})
+
+	head := new(linEvent)
+	calls := make([]*linEvent, len(ops))
+	last := head
+	for _, p := range points {
+		ev := &linEvent{op: p.op, call: p.call, prev: last}
+		last.next = ev
+		last = ev
+		if p.call {
+			calls[p.op] = ev
+		} else {
+			calls[p.op].match = ev
+		}
+	}
+
+	lift := func(ev *linEvent) {
+		ev.prev.next = ev.next
+		ev.next.prev = ev.prev
+		m := ev.match
+		m.prev.next = m.next
+		if m.next != nil {
+			m.next.prev = m.prev
+		}
+	}
+	unlift := func(ev *linEvent) {
+		m := ev.match
+		m.prev.next = m
+		if m.next != nil {
+			m.next.prev = m
+		}
+		ev.prev.next = ev
+		ev.next.prev = ev
+	}
+
+	type frame struct {
+		ev    *linEvent
+		state *linState
+	}
+	var stack []frame
+	done := make([]byte, len(ops))
+	seen := make(map[string]bool)
+	state := new(linState)
+
+	ev := head.next
+	for head.next != nil {
+		if ev.call {
+			next, ok := state.step(ops[ev.op])
+			if ok {
+				done[ev.op] = 1
+				key := string(done) + next.hash()
+				if !seen[key] {
+					seen[key] = true
+					stack = append(stack, frame{ev, state})
+					state = next
+					lift(ev)
+					ev = head.next
+					continue
+				}
+				done[ev.op] = 0
+			}
+			ev = ev.next
+			continue
+		}
+
+		// an op returned before any order took it in, so back up
+		if len(stack) == 0 {
+			return false
+		}
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = f.state
+		done[f.ev.op] = 0
+		unlift(f.ev)
+		ev = f.ev.next
+	}
+	return true
+}
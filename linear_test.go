@@ -0,0 +1,188 @@
+package triblab_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"trib"
+	"trib/randaddr"
+	"trib/store"
+	"triblab"
+)
+
+func TestCheckLinearizable(t *testing.T) {
+	at := func(ms int) time.Time {
+		return time.Unix(0, int64(ms)*int64(time.Millisecond))
+	}
+	op := func(method, key, value string, start, end int) triblab.Op {
+		return triblab.Op{Method: method, Key: key, Value: value, Start: at(start), End: at(end)}
+	}
+	get := func(key, got string, start, end int) triblab.Op {
+		ret := op("Get", key, "", start, end)
+		ret.Got = got
+		return ret
+	}
+	listGet := func(key string, list []string, start, end int) triblab.Op {
+		ret := op("ListGet", key, "", start, end)
+		ret.List = list
+		return ret
+	}
+	failed := func(o triblab.Op) triblab.Op {
+		o.Failed = true
+		return o
+	}
+
+	for i, c := range []struct {
+		ops []triblab.Op
+		ok  bool
+	}{
+		{[]triblab.Op{op("Set", "x", "1", 0, 10), get("x", "1", 5, 15)}, true},
+		{[]triblab.Op{op("Set", "x", "1", 0, 10), get("x", "", 5, 15)}, true},
+		{[]triblab.Op{op("Set", "x", "1", 0, 10), get("x", "", 20, 30)}, false},
+		{[]triblab.Op{
+			op("Set", "x", "1", 0, 10), op("Set", "x", "2", 0, 10),
+			get("x", "1", 20, 30), get("x", "2", 40, 50),
+		}, false},
+		{[]triblab.Op{failed(op("Set", "x", "2", 0, 5)), get("x", "", 10, 20), get("x", "2", 100, 110)}, true},
+		{[]triblab.Op{
+			op("ListAppend", "l", "a", 0, 10), op("ListAppend", "l", "b", 0, 10),
+			listGet("l", []string{"b", "a"}, 20, 30),
+		}, true},
+		{[]triblab.Op{
+			op("ListAppend", "l", "a", 0, 10), op("ListAppend", "l", "b", 0, 10),
+			listGet("l", []string{"a"}, 20, 30),
+		}, false},
+		// a key and a list of the same name are apart
+		{[]triblab.Op{op("Set", "k", "v", 0, 10), listGet("k", nil, 20, 30), get("k", "v", 20, 30)}, true},
+	} {
+		e := triblab.CheckLinearizable(c.ops)
+		if (e == nil) != c.ok {
+			t.Fatalf("history %d: %v", i, e)
+		}
+	}
+}
+
+func TestLinearizableBins(t *testing.T) {
+	used := make(map[string]bool)
+	newAddr := func() string {
+		addr := randaddr.Local()
+		for used[addr] {
+			addr = randaddr.Local()
+		}
+		used[addr] = true
+		return addr
+	}
+
+	var backs []string
+	for len(backs) < 3 {
+		addr := newAddr()
+		ready := make(chan bool)
+		go func() {
+			e := triblab.ServeBack(&trib.BackConfig{Addr: addr, Store: store.NewStorage(), Ready: ready})
+			if e != nil {
+				t.Fatal(e)
+			}
+		}()
+		if !<-ready {
+			t.Fatal("not ready")
+		}
+		backs = append(backs, addr)
+	}
+
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	addrk := newAddr()
+	readyk := make(chan bool)
+	go func() {
+		e := triblab.ServeKeeperWith(&trib.KeeperConfig{
+			Backs: backs,
+			Addrs: []string{addrk},
+			Ready: readyk,
+		}, &triblab.KeeperOptions{StateDir: dir, Replicas: len(backs)})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-readyk {
+		t.Fatal("keeper not ready")
+	}
+
+	// replicated on every backend
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		var v string
+		if e := triblab.NewClient(backs[0]).Get(triblab.PLACEMENT_KEY, &v); e != nil {
+			t.Fatal(e)
+		}
+		if strings.Contains(v, `"Replicas":3`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("placement not published")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	bc := triblab.NewBinClient(backs)
+	h := triblab.NewHistory()
+	keys := []string{"a", "b", "c"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			s := h.Record(bc.Bin("stress"), client)
+			r := rand.New(rand.NewSource(int64(client)))
+
+			var mine []string
+			var succ bool
+			var v string
+			var n int
+			var list trib.List
+			for j := 0; j < 50; j++ {
+				key := keys[r.Intn(len(keys))]
+				value := fmt.Sprintf("%d.%d", client, j)
+				switch r.Intn(5) {
+				case 0:
+					s.Set(trib.KV(key, value), &succ)
+				case 1:
+					s.Get(key, &v)
+				case 2:
+					s.ListAppend(trib.KV("l", value), &succ)
+					mine = append(mine, value)
+				case 3:
+					if len(mine) > 0 {
+						s.ListRemove(trib.KV("l", mine[r.Intn(len(mine))]), &n)
+					}
+				case 4:
+					s.ListGet("l", &list)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ops := h.Ops()
+	if len(ops) < 300 {
+		t.Fatalf("only %d ops recorded", len(ops))
+	}
+	if e := triblab.CheckLinearizable(ops); e != nil {
+		t.Fatal(e)
+	}
+
+	// the checker does catch a stale read
+	stale := triblab.Op{Method: "Get", Key: "a", Got: "stale", Start: time.Now(), End: time.Now()}
+	if triblab.CheckLinearizable(append(ops, stale)) == nil {
+		t.Fatal("stale read passed")
+	}
+}
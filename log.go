@@ -0,0 +1,194 @@
+package triblab
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels, least severe first.
+const (
+	LOG_DEBUG = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// Parses a level name such as "info".
+func ParseLevel(name string) (int, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// Where the lines of a logger and its children go.
+type logOut struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// Writes leveled lines of key=value fields, such as
+//
+//	time=2006-01-02T15:04:05.000Z level=warn msg="could not trim posts" node=localhost:3000 bin=alice error="..."
+//
+// Loggers made by With share the output of their parent. A nil logger
+// logs to the one given to SetLogger.
+type Logger struct {
+	out    *logOut
+	level  int
+	fields []interface{}
+}
+
+func NewLogger(out io.Writer, level int) *Logger {
+	return &Logger{out: &logOut{w: out}, level: level}
+}
+
+var (
+	stdLock sync.Mutex
+	stdLog  = NewLogger(os.Stderr, LOG_INFO)
+)
+
+// Sets the logger of nodes and clients not given one of their own.
+// Meant to be called at startup.
+func SetLogger(l *Logger) {
+	stdLock.Lock()
+	stdLog = l
+	stdLock.Unlock()
+}
+
+func (self *Logger) get() *Logger {
+	if self != nil {
+		return self
+	}
+	stdLock.Lock()
+	defer stdLock.Unlock()
+	return stdLog
+}
+
+// A logger adding the key/value pairs kv to every line.
+func (self *Logger) With(kv ...interface{}) *Logger {
+	l := self.get()
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{out: l.out, level: l.level, fields: fields}
+}
+
+// Reports whether lines of level are written.
+func (self *Logger) Enabled(level int) bool {
+	return level >= self.get().level
+}
+
+func (self *Logger) Debug(msg string, kv ...interface{}) { self.get().log(LOG_DEBUG, msg, kv) }
+func (self *Logger) Info(msg string, kv ...interface{})  { self.get().log(LOG_INFO, msg, kv) }
+func (self *Logger) Warn(msg string, kv ...interface{})  { self.get().log(LOG_WARN, msg, kv) }
+func (self *Logger) Error(msg string, kv ...interface{}) { self.get().log(LOG_ERROR, msg, kv) }
+
+func (self *Logger) log(level int, msg string, kv []interface{}) {
+	if level < self.level {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("time=")
+	b.WriteString(time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	b.WriteString(" level=")
+	b.WriteString(levelNames[level])
+	b.WriteString(" msg=")
+	b.WriteString(logValue(msg))
+	writeFields(&b, self.fields)
+	writeFields(&b, kv)
+	b.WriteString("\n")
+
+	self.out.lock.Lock()
+	io.WriteString(self.out.w, b.String())
+	self.out.lock.Unlock()
+}
+
+func writeFields(b *strings.Builder, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		b.WriteString(" ")
+		b.WriteString(fmt.Sprint(kv[i]))
+		b.WriteString("=")
+		if i+1 < len(kv) {
+			b.WriteString(logValue(kv[i+1]))
+		} else {
+			b.WriteString(`""`)
+		}
+	}
+}
+
+// Quotes values that would not read back as one field.
+func logValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// Logging setup, as found in the "Log" section of bins.rc.
+type LogConfig struct {
+	Level string // "debug", "info", "warn" or "error", "info" if empty
+	File  string // appended to, relative to bins.rc; stderr if empty
+}
+
+// Reads the "Log" section of an rc file such as bins.rc. Returns nil when
+// the section is missing, meaning the default logger.
+func LoadLogger(rcPath string) (*Logger, error) {
+	bytes, e := ioutil.ReadFile(rcPath)
+	if e != nil {
+		return nil, e
+	}
+
+	var rc struct {
+		Log *LogConfig
+	}
+	e = json.Unmarshal(bytes, &rc)
+	if e != nil {
+		return nil, e
+	}
+	if rc.Log != nil && rc.Log.File != "" && !filepath.IsAbs(rc.Log.File) {
+		rc.Log.File = filepath.Join(filepath.Dir(rcPath), rc.Log.File)
+	}
+	return rc.Log.Open()
+}
+
+// Makes the logger the config asks for, with File taken as is. Returns
+// nil for a nil config, meaning the default logger.
+func (self *LogConfig) Open() (*Logger, error) {
+	if self == nil {
+		return nil, nil
+	}
+
+	level := LOG_INFO
+	if self.Level != "" {
+		var e error
+		level, e = ParseLevel(self.Level)
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	var out io.Writer = os.Stderr
+	if self.File != "" {
+		f, e := os.OpenFile(self.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if e != nil {
+			return nil, e
+		}
+		out = f
+	}
+	return NewLogger(out, level), nil
+}
@@ -0,0 +1,87 @@
+package triblab_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"trib"
+	"trib/randaddr"
+	"trib/store"
+	"triblab"
+)
+
+func TestLogger(t *testing.T) {
+	var out syncBuffer
+	l := triblab.NewLogger(&out, triblab.LOG_WARN).With("node", "n1")
+	l.Info("dropped")
+	l.Warn("kept", "bin", "alice", "error", "no such key")
+	line := out.String()
+	if strings.Contains(line, "dropped") {
+		t.Fatalf("info logged at warn: %q", line)
+	}
+	for _, want := range []string{
+		"level=warn", `msg=kept`, "node=n1", "bin=alice", `error="no such key"`,
+	} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("no %q in %q", want, line)
+		}
+	}
+
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	rc := filepath.Join(dir, "bins.rc")
+	e = ioutil.WriteFile(rc, []byte(`{"Log": {"Level": "debug", "File": "triblab.log"}}`), 0644)
+	if e != nil {
+		t.Fatal(e)
+	}
+	fl, e := triblab.LoadLogger(rc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !fl.Enabled(triblab.LOG_DEBUG) {
+		t.Fatal("debug not enabled")
+	}
+
+	// client calls are logged with their bin
+	addr := randaddr.Local()
+	ready := make(chan bool)
+	go func() {
+		b := &trib.BackConfig{Addr: addr, Store: store.NewStorage(), Ready: ready}
+		e := triblab.ServeBackWith(b, &triblab.BackOptions{Logger: fl})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-ready {
+		t.Fatal("not ready")
+	}
+
+	bc, e := triblab.NewBinClientWith([]string{addr}, &triblab.ClientOptions{Logger: fl})
+	if e != nil {
+		t.Fatal(e)
+	}
+	var succ bool
+	if e := bc.Bin("alice").Set(trib.KV("k", "v"), &succ); e != nil {
+		t.Fatal(e)
+	}
+
+	bytes, e := ioutil.ReadFile(filepath.Join(dir, "triblab.log"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	logged := string(bytes)
+	for _, want := range []string{
+		"msg=\"serving storage\" node=" + addr,
+		"msg=call bin=alice method=Storage.Set peer=" + addr,
+	} {
+		if !strings.Contains(logged, want) {
+			t.Fatalf("no %q in log:\n%s", want, logged)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package triblab
+
+import (
+	"fmt"
+	"sort"
+	"time"
+	"trib"
+)
+
+// Migration phases.
+//
+// While COPYING, front ends keep reading from the old backend but also
+// write to the new one, and the keeper copies the bin over. Once a full
+// pass over the bin finds nothing left to copy, ownership flips to the
+// new backend in one placement update. During FLIPPED the old backend
+// still gets the writes, so front ends that have not seen the flip yet
+// keep reading fresh data; after the grace period the task is done.
+//
+// Pin adds a replica the same way, copying from the primary, which then
+// stays on: the new backend just joins the bin at the flip.
+const (
+	MIGRATE_COPYING = "copying"
+	MIGRATE_FLIPPED = "flipped"
+
+	// Time for a placement change to reach every front end: one keeper
+	// round to publish it, one refresh to pick it up, plus slack for
+	// calls already in flight.
+	MIGRATE_GRACE = 2*time.Second + 2*PLACEMENT_REFRESH
+
+	// Reconcile passes per round before giving the writers a break.
+	MIGRATE_PASSES = 10
+)
+
+// Args of Keeper.Migrate.
+type MigrateArgs struct {
+	Bin string
+	To  string // new primary
+}
+
+// Starts moving a bin's primary to another backend. Followers pass it on
+// to the leader.
+func (self *Keeper) Migrate(args *MigrateArgs, succ *bool) error {
+	if self.kconfig == nil {
+		return fmt.Errorf("Keeper not configured.")
+	}
+
+	lead, e := self.leaderClient()
+	if e != nil {
+		return e
+	}
+	if lead != nil {
+		return lead.Migrate(args, succ)
+	}
+
+	*succ = false
+	e = self.change(func(st *keeperState) error {
+		p := st.Placement
+		if !p.hasBack(args.To) {
+			return fmt.Errorf("unknown backend %q", args.To)
+		}
+		for _, m := range st.Migrations {
+			if m.Bin == args.Bin {
+				return fmt.Errorf("bin %q is already migrating", args.Bin)
+			}
+		}
+
+		backs := p.Lookup(args.Bin)
+		if len(backs) == 0 {
+			return fmt.Errorf("bin %q has no backend", args.Bin)
+		}
+		for _, b := range backs {
+			if b == args.To {
+				return fmt.Errorf("bin %q is already on %q", args.Bin, args.To)
+			}
+		}
+
+		st.Migrations = append(st.Migrations, &MigrationTask{
+			Bin:     args.Bin,
+			From:    backs[0],
+			To:      args.To,
+			Phase:   MIGRATE_COPYING,
+			Started: self.sim.time(),
+			Backs:   replaced(backs, backs[0], args.To),
+		})
+		p.shadow(args.Bin, args.To)
+		return nil
+	})
+	*succ = e == nil
+	return e
+}
+
+// Drives the migrations forward, one round per tick.
+func (self *Keeper) run_migrations() {
+	for {
+		self.sim.sleep(time.Second)
+
+		self.lock.Lock()
+		leader := self.leader
+		tasks := make([]*MigrationTask, len(self.state.Migrations))
+		copy(tasks, self.state.Migrations)
+		self.lock.Unlock()
+
+		if !leader {
+			continue
+		}
+
+		for _, t := range tasks {
+			e := self.migrate(t)
+			if e != nil {
+				self.log.Warn("migration stalled", "bin", t.Bin, "from", t.From, "to", t.To, "error", e)
+			}
+		}
+	}
+}
+
+// Runs one round of a migration task.
+func (self *Keeper) migrate(t *MigrationTask) error {
+	self.lock.Lock()
+	phase, started := t.Phase, t.Started
+	self.lock.Unlock()
+
+	// wait until every front end double writes, or for the old readers
+	// to go away
+	if self.sim.since(started) < MIGRATE_GRACE {
+		return nil
+	}
+
+	if phase == MIGRATE_FLIPPED {
+		return self.change(func(st *keeperState) error {
+			st.Placement.unshadow(t.Bin)
+			st.dropMigration(t)
+			return nil
+		})
+	}
+
+	m := &binCopier{
+		bin:    t.Bin,
+		src:    self.client(t.From),
+		dst:    self.client(t.To),
+		cursor: t.Cursor,
+		saved: func(cursor string) {
+			self.lock.Lock()
+			t.Cursor = cursor
+			e := self.state.save(self.spath)
+			self.lock.Unlock()
+			if e != nil {
+				self.log.Error("could not save keeper state", "path", self.spath, "error", e)
+			}
+		},
+	}
+
+	// first pass, resumable from the cursor
+	if t.Cursor != MIGRATE_COPIED {
+		_, e := m.pass()
+		if e != nil {
+			return e
+		}
+	}
+
+	// then keep reconciling until the writers did not get in the way
+	clean := false
+	for i := 0; i < MIGRATE_PASSES && !clean; i++ {
+		n, e := m.pass()
+		if e != nil {
+			return e
+		}
+		clean = n == 0
+	}
+	if !clean {
+		return nil // try again next round
+	}
+
+	return self.change(func(st *keeperState) error {
+		st.Placement.flip(t.Bin, t.From, t.final(st.Placement))
+		t.Phase = MIGRATE_FLIPPED
+		t.Started = self.sim.time()
+		return nil
+	})
+}
+
+func (self *keeperState) dropMigration(t *MigrationTask) {
+	for i, m := range self.Migrations {
+		if m == t {
+			self.Migrations = append(self.Migrations[:i], self.Migrations[i+1:]...)
+			return
+		}
+	}
+}
+
+// Cursor value of a task whose first pass is complete.
+const MIGRATE_COPIED = "\xff"
+
+// Copies one bin between two backends.
+type binCopier struct {
+	bin      string
+	src, dst Storage
+	cursor   string              // resume point of the first pass
+	saved    func(cursor string) // persists the cursor
+}
+
+// Makes dst match src for every key of the bin. Returns how many keys
+// differed; a pass where none did proves that dst was caught up at some
+// point while every writer was double writing.
+func (self *binCopier) pass() (int, error) {
+	prefix := self.bin + "::"
+	pat := &trib.Pattern{Prefix: prefix}
+
+	strs, e := self.union(pat, false)
+	if e != nil {
+		return 0, e
+	}
+	lists, e := self.union(pat, true)
+	if e != nil {
+		return 0, e
+	}
+
+	keys := make([]string, 0, len(strs)+len(lists))
+	for _, k := range strs {
+		keys = append(keys, "s:"+k)
+	}
+	for _, k := range lists {
+		keys = append(keys, "l:"+k)
+	}
+
+	from := self.cursor
+	if from == MIGRATE_COPIED {
+		from = ""
+	}
+
+	n := 0
+	for i, k := range keys {
+		if k <= from {
+			continue
+		}
+
+		var wrote bool
+		if k[0] == 's' {
+			wrote, e = self.copyString(k[2:])
+		} else {
+			wrote, e = self.copyList(k[2:])
+		}
+		if e != nil {
+			return n, e
+		}
+		if wrote {
+			n++
+		}
+
+		if self.cursor != MIGRATE_COPIED && (i%100 == 99) {
+			self.cursor = k
+			self.saved(k)
+		}
+	}
+
+	if self.cursor != MIGRATE_COPIED {
+		self.cursor = MIGRATE_COPIED
+		self.saved(MIGRATE_COPIED)
+	}
+	return n, nil
+}
+
+// Sorted keys matching pat on either side, fetched page by page.
+func (self *binCopier) union(pat *trib.Pattern, lists bool) ([]string, error) {
+	set := make(map[string]bool)
+	for _, s := range []Storage{self.src, self.dst} {
+		args := &ScanArgs{Prefix: pat.Prefix, Suffix: pat.Suffix, Lists: lists}
+		for {
+			var page ScanPage
+			e := s.Scan(args, &page)
+			if e != nil {
+				return nil, e
+			}
+			for _, k := range page.Keys {
+				set[k] = true
+			}
+			if page.Cursor == "" {
+				break
+			}
+			args.Cursor = page.Cursor
+		}
+	}
+
+	ret := make([]string, 0, len(set))
+	for k := range set {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Reads key from s, along with the time it has left.
+func readVersioned(s Storage, key string, list bool) (*Versioned, error) {
+	var v Versioned
+	e := s.GetVersioned(&VersionArgs{Key: key, List: list}, &v)
+	if e != nil {
+		return nil, e
+	}
+	return &v, nil
+}
+
+// Checks if both copies expire, or neither does. How much time each has
+// left is not compared, it drifts while the keeper looks.
+func sameExpiry(a, b *Versioned) bool {
+	return (a.TTL > 0) == (b.TTL > 0)
+}
+
+func (self *binCopier) copyString(key string) (bool, error) {
+	sv, e := readVersioned(self.src, key, false)
+	if e != nil {
+		return false, e
+	}
+	dv, e := readVersioned(self.dst, key, false)
+	if e != nil {
+		return false, e
+	}
+	if sv.Value == dv.Value && sameExpiry(sv, dv) {
+		return false, nil
+	}
+
+	// front ends write dst first, so dst may just be ahead with a write
+	// that has reached src since; then nothing differs anymore
+	sv, e = readVersioned(self.src, key, false)
+	if e != nil {
+		return false, e
+	}
+	if sv.Value == dv.Value && sameExpiry(sv, dv) {
+		return false, nil
+	}
+
+	var succ bool
+	if sv.TTL > 0 {
+		return true, self.dst.SetWithTTL(&TTLArgs{Key: key, Value: sv.Value, TTL: sv.TTL}, &succ)
+	}
+	return true, self.dst.Set(&trib.KeyValue{Key: key, Value: sv.Value}, &succ)
+}
+
+func (self *binCopier) copyList(key string) (bool, error) {
+	sl, e := readVersioned(self.src, key, true)
+	if e != nil {
+		return false, e
+	}
+	dl, e := readVersioned(self.dst, key, true)
+	if e != nil {
+		return false, e
+	}
+	if equalLists(sl.List, dl.List) && sameExpiry(sl, dl) {
+		return false, nil
+	}
+
+	// Likewise dst may be ahead with appends still on their way to src,
+	// which rebuilding would drop. Appends reach dst first, so dst
+	// never lags src by them.
+	if isPrefix(sl.List, dl.List) && sameExpiry(sl, dl) {
+		return false, nil
+	}
+
+	if !equalLists(sl.List, dl.List) {
+		ok, e := self.rebuild(key, sl.List, dl)
+		if e != nil || !ok {
+			return true, e
+		}
+	}
+
+	if !sameExpiry(sl, dl) {
+		var succ bool
+		e = self.dst.ListExpire(&ExpireArgs{Key: key, TTL: sl.TTL}, &succ)
+		if e != nil {
+			return true, e
+		}
+	}
+	return true, nil
+}
+
+// Turns list key on dst from dl into sl in one commit, so that appends
+// from front ends land before or after it rather than in the middle.
+// Returns false if dst changed since dl was read.
+func (self *binCopier) rebuild(key string, sl []string, dl *Versioned) (bool, error) {
+	// Keep the longest common prefix and rebuild the rest. A remove
+	// drops every copy of a value, so rebuild everything if a value to
+	// drop also sits in the prefix.
+	keep := 0
+	for keep < len(sl) && keep < len(dl.List) && sl[keep] == dl.List[keep] {
+		keep++
+	}
+	inPrefix := make(map[string]bool)
+	for _, v := range dl.List[:keep] {
+		inPrefix[v] = true
+	}
+	for _, v := range dl.List[keep:] {
+		if inPrefix[v] {
+			keep = 0
+			break
+		}
+	}
+
+	var writes []TxnWrite
+	removed := make(map[string]bool)
+	for _, v := range dl.List[keep:] {
+		if !removed[v] {
+			removed[v] = true
+			writes = append(writes, TxnWrite{Op: TXN_REMOVE, Key: key, Value: v})
+		}
+	}
+	for _, v := range sl[keep:] {
+		writes = append(writes, TxnWrite{Op: TXN_APPEND, Key: key, Value: v})
+	}
+
+	var ok bool
+	e := self.dst.Commit(&CommitArgs{
+		Reads:  []TxnRead{{Key: key, List: true, Version: dl.Version}},
+		Writes: writes,
+	}, &ok)
+	return ok, e
+}
+
+// Checks if a is a prefix of b.
+func isPrefix(a, b []string) bool {
+	return len(a) <= len(b) && equalLists(a, b[:len(a)])
+}
+
+func equalLists(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
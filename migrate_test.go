@@ -0,0 +1,158 @@
+package triblab_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"trib"
+	"trib/entries"
+	"trib/randaddr"
+	"trib/store"
+	"triblab"
+)
+
+func TestMigrate(t *testing.T) {
+	if os.Getenv("TRIB_LAB") == "lab1" {
+		t.SkipNow()
+	}
+
+	addr1 := randaddr.Local()
+	addr2 := randaddr.Local()
+	for addr2 == addr1 {
+		addr2 = randaddr.Local()
+	}
+
+	ready := make(chan bool)
+	run := func(addr string) {
+		e := entries.ServeBackSingle(addr, store.NewStorage(), ready)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	go run(addr1)
+	go run(addr2)
+	if !(<-ready && <-ready) {
+		t.Fatal("not ready")
+	}
+
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	readyk := make(chan bool)
+	addrk := randaddr.Local()
+	for addrk == addr1 || addrk == addr2 {
+		addrk = randaddr.Local()
+	}
+	go func() {
+		e := triblab.ServeKeeperWith(&trib.KeeperConfig{
+			Backs: []string{addr1, addr2},
+			Addrs: []string{addrk},
+			This:  0,
+			Id:    0,
+			Ready: readyk,
+		}, &triblab.KeeperOptions{StateDir: dir})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-readyk {
+		t.Fatal("keeper not ready")
+	}
+
+	kc := triblab.NewKeeperClient(addrk)
+	var p triblab.Placement
+	if e := kc.GetPlacement("", &p); e != nil {
+		t.Fatal(e)
+	}
+	from := p.Lookup("alice")[0]
+	to := addr1
+	if from == addr1 {
+		to = addr2
+	}
+
+	bc := triblab.NewBinClient([]string{addr1, addr2})
+	var succ bool
+	bin := bc.Bin("alice")
+	if e := bin.Set(trib.KV("name", "alice"), &succ); e != nil {
+		t.Fatal(e)
+	}
+	if e := bin.ListAppend(trib.KV("posts", "p0"), &succ); e != nil {
+		t.Fatal(e)
+	}
+	// keys that expire keep expiring on the new owner
+	ext := bin.(triblab.Storage)
+	if e := ext.SetWithTTL(&triblab.TTLArgs{Key: "session", Value: "s", TTL: time.Hour}, &succ); e != nil {
+		t.Fatal(e)
+	}
+	if e := ext.ListAppend(trib.KV("drafts", "d0"), &succ); e != nil {
+		t.Fatal(e)
+	}
+	if e := ext.ListExpire(&triblab.ExpireArgs{Key: "drafts", TTL: time.Hour}, &succ); e != nil || !succ {
+		t.Fatal("expire failed", e)
+	}
+
+	if e := kc.Migrate(&triblab.MigrateArgs{Bin: "alice", To: to}, &succ); e != nil {
+		t.Fatal(e)
+	}
+
+	// keep writing through the whole migration
+	var st triblab.KeeperStatus
+	n := 1
+	for deadline := time.Now().Add(30 * time.Second); ; n++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("migration did not finish: %+v", st)
+		}
+		if e := bc.Bin("alice").ListAppend(trib.KV("posts", fmt.Sprintf("p%d", n)), &succ); e != nil {
+			t.Fatal(e)
+		}
+		if e := kc.Status("", &st); e != nil {
+			t.Fatal(e)
+		}
+		if len(st.Migrations) == 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var v string
+	raw := triblab.NewClient(to)
+	if e := raw.Get("alice::name", &v); e != nil || v != "alice" {
+		t.Fatalf("name not migrated: %q, %v", v, e)
+	}
+
+	var l trib.List
+	if e := raw.ListGet("alice::posts", &l); e != nil {
+		t.Fatal(e)
+	}
+	if len(l.L) != n+1 {
+		t.Fatalf("lost writes: %d posts on target, %d written", len(l.L), n+1)
+	}
+	for i, post := range l.L {
+		if post != fmt.Sprintf("p%d", i) {
+			t.Fatalf("post %d is %q", i, post)
+		}
+	}
+
+	for _, args := range []*triblab.VersionArgs{{Key: "alice::session"}, {Key: "alice::drafts", List: true}} {
+		var ver triblab.Versioned
+		if e := raw.(triblab.Storage).GetVersioned(args, &ver); e != nil {
+			t.Fatal(e)
+		}
+		if ver.TTL <= 0 || ver.TTL > time.Hour {
+			t.Fatalf("%s migrated with TTL %v", args.Key, ver.TTL)
+		}
+	}
+
+	if e := kc.GetPlacement("", &p); e != nil {
+		t.Fatal(e)
+	}
+	if p.Lookup("alice")[0] != to {
+		t.Fatal("placement did not flip")
+	}
+}
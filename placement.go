@@ -0,0 +1,218 @@
+package triblab
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+)
+
+const (
+	// Raw backend key the keeper publishes the placement table under.
+	// Bin keys always contain "::", so it never collides with them.
+	PLACEMENT_KEY = "_PLACEMENT_"
+)
+
+// Authoritative mapping from bins to backends, owned by the keeper.
+// Bins are placed by hashing unless they are pinned.
+type Placement struct {
+	Version  uint64              // bumped on every change
+	Backs    []string            // hashing ring
+	Replicas int                 // replicas of a hashed bin
+	Pins     map[string][]string // bin -> backends, primary first
+	Moving   map[string]string   // bin -> backend getting extra writes
+}
+
+// Args of Keeper.Pin.
+type PinArgs struct {
+	Bin   string
+	Backs []string // primary first
+}
+
+func newPlacement(backs []string) *Placement {
+	return &Placement{
+		Version:  1,
+		Backs:    backs,
+		Replicas: 1,
+		Pins:     make(map[string][]string),
+		Moving:   make(map[string]string),
+	}
+}
+
+func hashBin(name string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(n))
+}
+
+// Returns the backends holding bin, primary first.
+func (self *Placement) Lookup(bin string) []string {
+	if backs, found := self.Pins[bin]; found {
+		return backs
+	}
+	return self.hashed(bin)
+}
+
+// Returns where hashing puts bin, pinned or not.
+func (self *Placement) hashed(bin string) []string {
+	n := len(self.Backs)
+	if n == 0 {
+		return nil
+	}
+	r := self.Replicas
+	if r < 1 {
+		r = 1
+	}
+	if r > n {
+		r = n
+	}
+
+	h := hashBin(bin, n)
+	ret := make([]string, 0, r)
+	for i := 0; i < r; i++ {
+		ret = append(ret, self.Backs[(h+i)%n])
+	}
+	return ret
+}
+
+// Returns the backends that get a bin's writes without serving its
+// reads, which is the case while it migrates.
+func (self *Placement) Shadows(bin string) []string {
+	if b, found := self.Moving[bin]; found {
+		return []string{b}
+	}
+	return nil
+}
+
+// Starts double writing bin to addr.
+func (self *Placement) shadow(bin, addr string) {
+	if self.Moving == nil {
+		self.Moving = make(map[string]string)
+	}
+	self.Moving[bin] = addr
+	self.Version++
+}
+
+func (self *Placement) unshadow(bin string) {
+	if _, found := self.Moving[bin]; !found {
+		return
+	}
+	delete(self.Moving, bin)
+	self.Version++
+}
+
+// Hands bin over to backs, the backends of a migration whose copy is
+// done. A backend dropped on the way stays a shadow, so that front ends
+// still on the old table keep reading fresh data from it.
+func (self *Placement) flip(bin, from string, backs []string) {
+	if self.Pins == nil {
+		self.Pins = make(map[string][]string)
+	}
+	self.Pins[bin] = backs
+	for _, b := range backs {
+		if b == from {
+			// the new backend joined, it no longer needs extra writes
+			self.unshadow(bin)
+			return
+		}
+	}
+	self.shadow(bin, from)
+}
+
+// Returns backs with from replaced by to.
+func replaced(backs []string, from, to string) []string {
+	ret := make([]string, 0, len(backs))
+	for _, b := range backs {
+		if b == from {
+			b = to
+		}
+		ret = append(ret, b)
+	}
+	return ret
+}
+
+// Returns the backends of backs that are not in old.
+func added(old, backs []string) []string {
+	var ret []string
+	for _, b := range backs {
+		found := false
+		for _, o := range old {
+			found = found || o == b
+		}
+		if !found {
+			ret = append(ret, b)
+		}
+	}
+	return ret
+}
+
+// Checks that bin may be pinned to backs, which must all be on the ring.
+func (self *Placement) checkPin(bin string, backs []string) error {
+	if bin == "" {
+		return fmt.Errorf("empty bin name")
+	}
+	if len(backs) == 0 {
+		return fmt.Errorf("no backends to pin bin %q to", bin)
+	}
+
+	seen := make(map[string]bool)
+	for _, b := range backs {
+		if seen[b] {
+			return fmt.Errorf("backend %q listed twice", b)
+		}
+		seen[b] = true
+		if !self.hasBack(b) {
+			return fmt.Errorf("unknown backend %q", b)
+		}
+	}
+	return nil
+}
+
+// Pins bin to backs, which must all be on the ring.
+func (self *Placement) pin(bin string, backs []string) error {
+	e := self.checkPin(bin, backs)
+	if e != nil {
+		return e
+	}
+
+	if self.Pins == nil {
+		self.Pins = make(map[string][]string)
+	}
+	self.Pins[bin] = backs
+	self.Version++
+	return nil
+}
+
+func (self *Placement) unpin(bin string) bool {
+	if _, found := self.Pins[bin]; !found {
+		return false
+	}
+	delete(self.Pins, bin)
+	self.Version++
+	return true
+}
+
+func (self *Placement) hasBack(addr string) bool {
+	for _, b := range self.Backs {
+		if b == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Placement) marshal() string {
+	bytes, e := json.Marshal(self)
+	if e != nil {
+		panic(e)
+	}
+	return string(bytes)
+}
+
+func unmarshalPlacement(s string) (*Placement, error) {
+	p := new(Placement)
+	e := json.Unmarshal([]byte(s), p)
+	if e != nil {
+		return nil, e
+	}
+	return p, nil
+}
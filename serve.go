@@ -0,0 +1,201 @@
+package triblab
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/gob"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+)
+
+// What net/rpc answers to the HTTP CONNECT opening a gob connection.
+const rpcConnected = "HTTP/1.0 200 Connected to Go RPC\n\n"
+
+// Picks the RPC server for a caller, given the token it presented, and
+// returns the caller's identity, "" for anonymous callers. Refuses
+// callers with an error.
+type serverFor func(token string) (*rpc.Server, string, error)
+
+// The same server for everyone, token or not.
+func anyCaller(srv *rpc.Server) serverFor {
+	return func(token string) (*rpc.Server, string, error) {
+		return srv, "", nil
+	}
+}
+
+// Serves the RPC protocols of a node: gob over HTTP CONNECT, JSON-RPC
+// POSTs at JSONRPC_PATH, and JSON-RPC over TCP once listenJSON is
+// called. Callers give their token as
+// "Authorization: Bearer <token>" over HTTP.
+type rpcHandler struct {
+	srv    serverFor
+	lim    *limiter
+	tracer *Tracer
+}
+
+// Wraps the codec of a connection with tracing and limits. Tracing goes
+// inside, so that refused calls show up as failed spans.
+func (self *rpcHandler) codec(c rpc.ServerCodec, caller, trace string) rpc.ServerCodec {
+	return limitCodec(traceCodec(c, self.tracer, trace, caller), self.lim, caller)
+}
+
+// Anonymous callers are told apart by host for the limits.
+func callerKey(who, remote string) string {
+	if who != "" {
+		return who
+	}
+	return remoteHost(remote)
+}
+
+func (self *rpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	srv, who, e := self.srv(token)
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusUnauthorized)
+		return
+	}
+	caller := callerKey(who, r.RemoteAddr)
+
+	if r.URL.Path == JSONRPC_PATH {
+		self.servePost(srv, caller, w, r)
+		return
+	}
+	if r.Method != "CONNECT" {
+		srv.ServeHTTP(w, r) // turns it down
+		return
+	}
+
+	// same as rpc.Server.ServeHTTP, with our own codec
+	conn, _, e := w.(http.Hijacker).Hijack()
+	if e != nil {
+		return
+	}
+	io.WriteString(conn, rpcConnected)
+	srv.ServeCodec(self.codec(newGobServerCodec(conn), caller, r.Header.Get(TRACE_HEADER)))
+}
+
+// One JSON-RPC request or batch per POST.
+func (self *rpcHandler) servePost(srv *rpc.Server, caller string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "405 must POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var buf bytes.Buffer
+	codec := newJSONServerCodec(r.Body, &buf, nil)
+	c := self.codec(codec, caller, r.Header.Get(TRACE_HEADER))
+	e := srv.ServeRequest(c)
+	for codec.more() {
+		e = srv.ServeRequest(c)
+	}
+
+	if buf.Len() == 0 {
+		if e != nil {
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf.Bytes())
+}
+
+// Serves JSON-RPC connections accepted on l. The first request of a
+// connection names the caller. Returns when l fails.
+func (self *rpcHandler) serveJSON(l net.Listener) error {
+	for {
+		conn, e := l.Accept()
+		if e != nil {
+			return e
+		}
+
+		go func(conn net.Conn) {
+			codec := newJSONServerCodec(conn, conn, conn)
+			token, e := codec.peek()
+			if e != nil {
+				conn.Close()
+				return
+			}
+			srv, who, e := self.srv(token)
+			if e != nil {
+				codec.reject(JSONRPC_UNAUTHORIZED, e)
+				conn.Close()
+				return
+			}
+			caller := callerKey(who, conn.RemoteAddr().String())
+			srv.ServeCodec(self.codec(codec, caller, ""))
+		}(conn)
+	}
+}
+
+// Starts serving JSON-RPC over TCP on addr. Does nothing for an empty
+// addr, leaving JSON-RPC to POSTs on the main address.
+func listenJSON(h *rpcHandler, addr string, conf *tls.Config) error {
+	if addr == "" {
+		return nil
+	}
+
+	l, e := listen(addr, conf)
+	if e != nil {
+		return e
+	}
+	go h.serveJSON(l)
+	return nil
+}
+
+// Server side of the gob protocol, as net/rpc speaks it.
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser) *gobServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+func (self *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return self.dec.Decode(r)
+}
+
+func (self *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return self.dec.Decode(body)
+}
+
+func (self *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	e := self.enc.Encode(r)
+	if e == nil {
+		e = self.enc.Encode(body)
+	}
+	if e == nil {
+		return self.encBuf.Flush()
+	}
+
+	// gob cannot recover from a half written response
+	if self.encBuf.Flush() == nil {
+		self.Close()
+	}
+	return e
+}
+
+func (self *gobServerCodec) Close() error {
+	if self.closed {
+		return nil
+	}
+	self.closed = true
+	return self.rwc.Close()
+}
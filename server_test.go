@@ -1,7 +1,11 @@
 package triblab_test
 
 import (
+	"encoding/json"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"trib"
 	"trib/entries"
@@ -72,3 +76,148 @@ func TestServerConcur(t *testing.T) {
 
 	tribtest.CheckServerConcur(t, server)
 }
+
+// Posts that landed out of clock order expire by clock.
+func TestServerExpire(t *testing.T) {
+	addr := randaddr.Local()
+	ready := make(chan bool)
+	go func() {
+		e := entries.ServeBackSingle(addr, store.NewStorage(), ready)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	<-ready
+
+	bc := triblab.NewBinClient([]string{addr})
+	server := triblab.NewFront(bc)
+	if e := server.SignUp("alice"); e != nil {
+		t.Fatal(e)
+	}
+
+	// the first post appended is the newest but one
+	var succ bool
+	for i := 0; i < trib.MaxTribFetch; i++ {
+		clk := uint64(1000000 + i)
+		if i == 0 {
+			clk = 2000000
+		}
+		post, _ := json.Marshal(&trib.Trib{User: "alice", Message: fmt.Sprintf("p%d", i), Time: time.Now(), Clock: clk})
+		if e := bc.Bin("alice").ListAppend(trib.KV("posts", string(post)), &succ); e != nil {
+			t.Fatal(e)
+		}
+	}
+	// one more, by hand so that nothing expires: the timeline takes the
+	// newest by clock rather than the last appended
+	post, _ := json.Marshal(&trib.Trib{User: "alice", Message: "old", Time: time.Now(), Clock: 1})
+	if e := bc.Bin("alice").ListAppend(trib.KV("posts", string(post)), &succ); e != nil {
+		t.Fatal(e)
+	}
+	tribs, e := server.Tribs("alice")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(tribs) != trib.MaxTribFetch || tribs[0].Message != "p1" || tribs[len(tribs)-1].Message != "p0" {
+		t.Fatalf("timeline not by clock: %d tribs, %v ... %v", len(tribs), tribs[0], tribs[len(tribs)-1])
+	}
+
+	if e := server.Post("alice", "last", 3000000); e != nil {
+		t.Fatal(e)
+	}
+
+	tribs, e = server.Tribs("alice")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(tribs) != trib.MaxTribFetch {
+		t.Fatalf("%d tribs", len(tribs))
+	}
+	for _, tr := range tribs {
+		if tr.Message == "p1" || tr.Message == "old" {
+			t.Fatal("oldest tribs kept")
+		}
+	}
+	if tribs[len(tribs)-2].Message != "p0" || tribs[len(tribs)-1].Message != "last" {
+		t.Fatalf("newest tribs expired: %v, %v", tribs[len(tribs)-2], tribs[len(tribs)-1])
+	}
+}
+
+// Bins held in memory, with none of the extended operations. The first
+// two reads of a follows list return together.
+type localBins struct {
+	lock  sync.Mutex
+	bins  map[string]trib.Storage
+	reads int
+	meet  sync.WaitGroup
+}
+
+func (self *localBins) Bin(name string) trib.Storage {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	s, found := self.bins[name]
+	if !found {
+		s = &meetingStorage{Storage: store.NewStorage(), bins: self}
+		self.bins[name] = s
+	}
+	return s
+}
+
+type meetingStorage struct {
+	trib.Storage
+	bins *localBins
+}
+
+func (self *meetingStorage) ListGet(key string, list *trib.List) error {
+	e := self.Storage.ListGet(key, list)
+	if key == "follows" {
+		self.bins.lock.Lock()
+		self.bins.reads++
+		wait := self.bins.reads <= 2
+		self.bins.lock.Unlock()
+		if wait {
+			self.bins.meet.Done()
+			self.bins.meet.Wait()
+		}
+	}
+	return e
+}
+
+// A front end over plain storages builds their extended operations once,
+// so that two follows reading the same list still lock each other out.
+func TestServerLocalBins(t *testing.T) {
+	bins := &localBins{bins: make(map[string]trib.Storage)}
+	bins.meet.Add(2)
+	server := triblab.NewFront(bins)
+	if e := server.SignUp("alice"); e != nil {
+		t.Fatal(e)
+	}
+	if e := server.SignUp("bob"); e != nil {
+		t.Fatal(e)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = server.Follow("alice", "bob")
+		}(i)
+	}
+	wg.Wait()
+
+	n := 0
+	for _, e := range errs {
+		if e == nil {
+			n++
+		}
+	}
+	following, e := server.Following("alice")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if n != 1 || len(following) != 1 {
+		t.Fatalf("%d follows went through, following %v", n, following)
+	}
+}
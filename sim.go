@@ -0,0 +1,546 @@
+package triblab
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	// one-way delay of simulated messages, picked by the seed in between
+	SIM_MIN_LATENCY = time.Millisecond
+	SIM_MAX_LATENCY = 10 * time.Millisecond
+
+	// real time a task may run without blocking before the simulation
+	// gives up on it, as it is then waiting on something the simulation
+	// does not control
+	SIM_STALL = 10 * time.Second
+
+	// how often a task waiting on a channel checks it
+	SIM_POLL = 10 * time.Millisecond
+)
+
+// Where a simulation starts its virtual clock.
+var SIM_EPOCH = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Runs backends, keepers and front ends of a cluster in one process,
+// over an in-memory transport and a virtual clock. Only one task runs at
+// a time, and which one runs next is picked by the seed, so a seed
+// replays the same interleaving of clock syncs, migrations and client
+// calls every time.
+//
+// Nodes join a simulation through the Sim member of their options, and
+// must be started, and called, from tasks started with Go. Tasks may
+// block on the simulation only: calls to other nodes, sleeps and the
+// fan-outs of the nodes themselves. A task blocking on anything else
+// stalls the simulation, which Run reports.
+//
+// A nil simulation stands for the real world: goroutines, sockets and
+// time.
+type Sim struct {
+	rng    *rand.Rand
+	now    time.Time
+	seq    int64
+	events simEvents
+
+	cur   *simTask      // holding the baton
+	yield chan struct{} // the baton, handed back to the scheduler
+	stall error
+
+	nodes map[string]*simNode
+	steps []string
+}
+
+func NewSim(seed int64) *Sim {
+	return &Sim{
+		rng:   rand.New(rand.NewSource(seed)),
+		now:   SIM_EPOCH,
+		yield: make(chan struct{}),
+		nodes: make(map[string]*simNode),
+	}
+}
+
+type simTask struct {
+	node string
+	wake chan struct{}
+}
+
+type simNode struct {
+	h      *rpcHandler // nil until it serves
+	down   bool
+	frozen []*simEvent // wakeups of its tasks held while down
+}
+
+type simEvent struct {
+	at   time.Time
+	prio int64 // random, for ties
+	seq  int64
+	node string // whose task the event runs, "" for none
+	desc string
+	fire func()
+}
+
+type simEvents []*simEvent
+
+func (self simEvents) Len() int      { return len(self) }
+func (self simEvents) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self simEvents) Less(i, j int) bool {
+	a, b := self[i], self[j]
+	if !a.at.Equal(b.at) {
+		return a.at.Before(b.at)
+	}
+	if a.prio != b.prio {
+		return a.prio < b.prio
+	}
+	return a.seq < b.seq
+}
+func (self *simEvents) Push(x interface{}) { *self = append(*self, x.(*simEvent)) }
+func (self *simEvents) Pop() interface{} {
+	old := *self
+	ev := old[len(old)-1]
+	*self = old[:len(old)-1]
+	return ev
+}
+
+// Virtual time.
+func (self *Sim) Now() time.Time {
+	return self.now
+}
+
+// What happened so far, one line per event, to compare runs by.
+func (self *Sim) Steps() []string {
+	return append([]string(nil), self.steps...)
+}
+
+func (self *Sim) node(addr string) *simNode {
+	n, found := self.nodes[addr]
+	if !found {
+		n = new(simNode)
+		self.nodes[addr] = n
+	}
+	return n
+}
+
+func (self *Sim) schedule(after time.Duration, node, desc string, fire func()) {
+	self.seq++
+	heap.Push(&self.events, &simEvent{
+		at:   self.now.Add(after),
+		prio: self.rng.Int63(),
+		seq:  self.seq,
+		node: node,
+		desc: desc,
+		fire: fire,
+	})
+}
+
+func (self *Sim) latency() time.Duration {
+	return SIM_MIN_LATENCY + time.Duration(self.rng.Int63n(int64(SIM_MAX_LATENCY-SIM_MIN_LATENCY)))
+}
+
+// Starts f as a task of node, "" for tasks of no node such as test
+// clients.
+func (self *Sim) Go(node string, f func()) {
+	t := &simTask{node: node, wake: make(chan struct{})}
+	go func() {
+		<-t.wake
+		defer func() {
+			self.cur = nil
+			self.yield <- struct{}{}
+		}()
+		f()
+	}()
+	self.schedule(0, node, "start "+node, func() { self.run(t) })
+}
+
+// Hands the baton to t until it blocks or ends.
+func (self *Sim) run(t *simTask) {
+	self.cur = t
+	t.wake <- struct{}{}
+	select {
+	case <-self.yield:
+	case <-time.After(SIM_STALL):
+		self.stall = fmt.Errorf("sim: a task of %q blocked outside the simulation at %v",
+			t.node, self.now.Sub(SIM_EPOCH))
+	}
+}
+
+// The task holding the baton.
+func (self *Sim) task() *simTask {
+	if self.cur == nil {
+		panic("sim: node called outside of a task")
+	}
+	return self.cur
+}
+
+// Blocks the current task until something runs it again.
+func (self *Sim) park() *simTask {
+	t := self.task()
+	self.cur = nil
+	self.yield <- struct{}{}
+	<-t.wake
+	return t
+}
+
+// Runs the task again after d.
+func (self *Sim) wakeAfter(d time.Duration, t *simTask, desc string) {
+	self.schedule(d, t.node, desc, func() { self.run(t) })
+}
+
+// Runs the simulation for d of virtual time.
+func (self *Sim) Run(d time.Duration) error {
+	end := self.now.Add(d)
+	for self.stall == nil && len(self.events) > 0 && !self.events[0].at.After(end) {
+		ev := heap.Pop(&self.events).(*simEvent)
+		if n, found := self.nodes[ev.node]; found && n.down {
+			n.frozen = append(n.frozen, ev)
+			continue
+		}
+
+		self.now = ev.at
+		self.steps = append(self.steps, fmt.Sprintf("%v %s", self.now.Sub(SIM_EPOCH), ev.desc))
+		ev.fire()
+	}
+	if self.stall != nil {
+		return self.stall
+	}
+	self.now = end
+	return nil
+}
+
+// Takes addr down: calls to it fail and its tasks stop where they are,
+// until Restart.
+func (self *Sim) Crash(addr string) {
+	self.node(addr).down = true
+	self.steps = append(self.steps, fmt.Sprintf("%v crash %s", self.now.Sub(SIM_EPOCH), addr))
+}
+
+// Brings addr back, with its tasks going on where they stopped, as a
+// node restarted from what it had saved. A backend may also be served
+// anew on the same address, with a fresh store.
+func (self *Sim) Restart(addr string) {
+	n := self.node(addr)
+	n.down = false
+	for _, ev := range n.frozen {
+		ev.at = self.now
+		heap.Push(&self.events, ev)
+	}
+	n.frozen = nil
+	self.steps = append(self.steps, fmt.Sprintf("%v restart %s", self.now.Sub(SIM_EPOCH), addr))
+}
+
+// What nodes use instead of the time package.
+
+func (self *Sim) time() time.Time {
+	if self == nil {
+		return time.Now()
+	}
+	return self.now
+}
+
+func (self *Sim) since(t time.Time) time.Duration {
+	return self.time().Sub(t)
+}
+
+func (self *Sim) sleep(d time.Duration) {
+	if self == nil {
+		time.Sleep(d)
+		return
+	}
+	t := self.task()
+	self.wakeAfter(d, t, "wake "+t.node)
+	self.park()
+}
+
+// Blocks the calling task for d of virtual time.
+func (self *Sim) Sleep(d time.Duration) {
+	self.sleep(d)
+}
+
+// What nodes use instead of go statements.
+
+func (self *Sim) spawn(f func()) {
+	if self == nil {
+		go f()
+		return
+	}
+	self.Go(self.task().node, f)
+}
+
+// A random duration between d/2 and d, so that tasks backing off at once
+// spread out. Picked by the seed in a simulation.
+func (self *Sim) jitter(d time.Duration) time.Duration {
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	if self == nil {
+		return time.Duration(half + rand.Int63n(half+1))
+	}
+	return time.Duration(half + self.rng.Int63n(half+1))
+}
+
+// Runs f, giving up on it after d. Returns false if it timed out; f then
+// goes on in the background, and what it writes must not be read. Calls
+// in a simulation fail rather than hang, so there f just runs.
+func (self *Sim) timeout(d time.Duration, f func()) bool {
+	if self != nil {
+		f()
+		return true
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// Waits for c to be closed, for at most d. Returns false if it was not.
+// A simulation checks c every SIM_POLL of virtual time.
+func (self *Sim) wait(c chan bool, d time.Duration) bool {
+	if self == nil {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-c:
+			return true
+		case <-t.C:
+			return false
+		}
+	}
+
+	for end := self.now.Add(d); ; {
+		select {
+		case <-c:
+			return true
+		default:
+		}
+		left := end.Sub(self.now)
+		if left <= 0 {
+			return false
+		}
+		if left > SIM_POLL {
+			left = SIM_POLL
+		}
+		self.sleep(left)
+	}
+}
+
+// Runs f(0) to f(n-1) at once and waits for them all.
+func (self *Sim) fanOut(n int, f func(i int)) {
+	if self == nil {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				f(i)
+			}(i)
+		}
+		wg.Wait()
+		return
+	}
+
+	if n == 0 {
+		return
+	}
+	waiter := self.task()
+	left := n
+	for i := 0; i < n; i++ {
+		i := i
+		self.spawn(func() {
+			f(i)
+			left--
+			if left == 0 {
+				self.wakeAfter(0, waiter, "join "+waiter.node)
+			}
+		})
+	}
+	self.park()
+}
+
+// What nodes use instead of sockets.
+
+type simListener struct {
+	sim  *Sim
+	addr string
+}
+
+func (self *simListener) Accept() (net.Conn, error) {
+	return nil, errors.New("sim: nothing to accept")
+}
+
+func (self *simListener) Close() error {
+	self.sim.node(self.addr).h = nil
+	return nil
+}
+
+func (self *simListener) Addr() net.Addr {
+	return simAddr(self.addr)
+}
+
+type simAddr string
+
+func (self simAddr) Network() string { return "sim" }
+func (self simAddr) String() string  { return string(self) }
+
+func (self *Sim) listen(addr string, conf *tls.Config) (net.Listener, error) {
+	if self == nil {
+		return listen(addr, conf)
+	}
+	return &simListener{sim: self, addr: addr}, nil
+}
+
+// Serves the calls coming in on l with h. Never returns in a
+// simulation; the node is served until its listener is closed.
+func serve(l net.Listener, h *rpcHandler) error {
+	sl, ok := l.(*simListener)
+	if !ok {
+		return http.Serve(l, h)
+	}
+	sl.sim.node(sl.addr).h = h
+	sl.sim.park()
+	return nil
+}
+
+func (self *Sim) dial(addr string, conf *tls.Config, token string, parent *Span) (*rpcConn, error) {
+	if self == nil {
+		return dial(addr, conf, token, parent)
+	}
+
+	sp := parent.Child("dial", SPAN_CLIENT)
+	sp.SetAttr("peer", addr)
+	return &rpcConn{
+		rpcCaller: &simLink{sim: self, from: self.task().node, to: addr, token: token, trace: sp.Traceparent()},
+		span:      sp,
+		sim:       self,
+	}, nil
+}
+
+// A connection to addr, with every call and reply a message delivered
+// by the simulation.
+type simLink struct {
+	sim   *Sim
+	from  string
+	to    string
+	token string
+	trace string
+}
+
+func (self *simLink) Call(method string, args, reply interface{}) error {
+	var req bytes.Buffer
+	e := gob.NewEncoder(&req).Encode(args)
+	if e != nil {
+		return e
+	}
+
+	s := self.sim
+	caller := s.task()
+	var resp simCodec
+	var lost error
+	answer := func(e error) {
+		lost = e
+		s.wakeAfter(s.latency(), caller, fmt.Sprintf("reply %s %s -> %s", method, self.to, self.from))
+	}
+
+	// not held while the callee is down, but refused
+	s.schedule(s.latency(), "", fmt.Sprintf("call %s %s -> %s", method, self.from, self.to), func() {
+		n := s.node(self.to)
+		if n.down || n.h == nil {
+			answer(fmt.Errorf("sim: %s refused the call", self.to))
+			return
+		}
+
+		resp = simCodec{method: method, args: req.Bytes()}
+		t := &simTask{node: self.to, wake: make(chan struct{})}
+		go func() {
+			<-t.wake
+			defer func() {
+				s.cur = nil
+				s.yield <- struct{}{}
+			}()
+
+			srv, who, e := n.h.srv(self.token)
+			if e != nil {
+				answer(e)
+				return
+			}
+			e = srv.ServeRequest(n.h.codec(&resp, callerKey(who, self.from), self.trace))
+			if e != nil && resp.err == "" {
+				resp.err = e.Error()
+			}
+			answer(nil)
+		}()
+		s.run(t)
+	})
+	s.park()
+
+	if lost != nil {
+		return lost
+	}
+	if resp.err != "" {
+		return rpc.ServerError(resp.err)
+	}
+	return gob.NewDecoder(bytes.NewReader(resp.reply)).Decode(reply)
+}
+
+func (self *simLink) Close() error {
+	return nil
+}
+
+// Serves the one call of a simulated message.
+type simCodec struct {
+	method string
+	args   []byte
+	reply  []byte
+	err    string
+}
+
+func (self *simCodec) ReadRequestHeader(r *rpc.Request) error {
+	r.ServiceMethod = self.method
+	r.Seq = 0
+	return nil
+}
+
+func (self *simCodec) ReadRequestBody(body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(self.args)).Decode(body)
+}
+
+func (self *simCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if r.Error != "" {
+		self.err = r.Error
+		return nil
+	}
+	var buf bytes.Buffer
+	e := gob.NewEncoder(&buf).Encode(body)
+	if e != nil {
+		self.err = e.Error()
+		return e
+	}
+	self.reply = buf.Bytes()
+	return nil
+}
+
+func (self *simCodec) Close() error {
+	return nil
+}
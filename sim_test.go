@@ -0,0 +1,170 @@
+package triblab_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"trib"
+	"trib/store"
+	"triblab"
+)
+
+// Runs a cluster of three backends, a keeper and a front end through
+// sign ups, posts, a migration and a backend crash. Returns the steps
+// of the simulation and what the front end saw.
+func simulate(t *testing.T, seed int64) ([]string, []string) {
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s := triblab.NewSim(seed)
+	quiet := triblab.NewLogger(ioutil.Discard, triblab.LOG_ERROR)
+	backs := []string{"back-0", "back-1", "back-2"}
+	for _, addr := range backs {
+		addr := addr
+		s.Go(addr, func() {
+			b := &trib.BackConfig{Addr: addr, Store: store.NewStorage()}
+			e := triblab.ServeBackWith(b, &triblab.BackOptions{Sim: s, Logger: quiet})
+			if e != nil {
+				t.Error(e)
+			}
+		})
+	}
+	s.Go("keeper", func() {
+		kc := &trib.KeeperConfig{Backs: backs, Addrs: []string{"keeper"}}
+		e := triblab.ServeKeeperWith(kc, &triblab.KeeperOptions{StateDir: dir, Sim: s, Logger: quiet})
+		if e != nil {
+			t.Error(e)
+		}
+	})
+
+	copts := &triblab.ClientOptions{Sim: s, Logger: quiet}
+	bc, e := triblab.NewBinClientWith(backs, copts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	front := triblab.NewFrontWith(bc, &triblab.FrontOptions{Sim: s, Logger: quiet})
+	kc, e := triblab.NewKeeperClientWith("keeper", copts)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var seen []string
+	note := func(what string, e error) {
+		seen = append(seen, fmt.Sprintf("%v %s: %v", s.Now().Sub(triblab.SIM_EPOCH), what, e))
+	}
+	s.Go("", func() {
+		note("signup alice", front.SignUp("alice"))
+		note("signup bob", front.SignUp("bob"))
+		note("follow", front.Follow("alice", "bob"))
+		for i := 0; i < 5; i++ {
+			note("post", front.Post("bob", fmt.Sprintf("hello %d", i), 0))
+		}
+
+		// wait for the keeper to publish, then move bob off his backend
+		s.Sleep(2 * time.Second)
+		var p triblab.Placement
+		note("placement", kc.GetPlacement("", &p))
+		to := backs[0]
+		if p.Lookup("bob")[0] == to {
+			to = backs[1]
+		}
+		var succ bool
+		note("migrate", kc.Migrate(&triblab.MigrateArgs{Bin: "bob", To: to}, &succ))
+
+		for i := 0; i < 40; i++ {
+			tribs, e := front.Home("alice")
+			note(fmt.Sprintf("home %d", len(tribs)), e)
+			s.Sleep(500 * time.Millisecond)
+		}
+
+		var st triblab.KeeperStatus
+		note("status", kc.Status("", &st))
+		if len(st.Migrations) != 0 {
+			t.Errorf("migration did not finish: %+v", st.Migrations)
+		}
+	})
+
+	run := func(d time.Duration) {
+		if e := s.Run(d); e != nil {
+			t.Fatal(e)
+		}
+	}
+	run(10 * time.Second)
+	s.Crash("back-1")
+	run(5 * time.Second)
+	s.Restart("back-1")
+	run(15 * time.Second)
+
+	return s.Steps(), seen
+}
+
+func TestSim(t *testing.T) {
+	steps, seen := simulate(t, 1)
+	if len(steps) < 100 {
+		t.Fatalf("only %d steps:\n%v", len(steps), steps)
+	}
+	homes := 0
+	for _, line := range seen {
+		var at, what string
+		fmt.Sscan(line, &at, &what)
+		if what == "home" {
+			homes++
+		}
+	}
+	if homes != 40 {
+		t.Fatalf("front end did not finish:\n%v", seen)
+	}
+
+	// a seed replays the same run
+	again, seenAgain := simulate(t, 1)
+	if !reflect.DeepEqual(steps, again) || !reflect.DeepEqual(seen, seenAgain) {
+		t.Fatal("same seed, different runs")
+	}
+
+	other, _ := simulate(t, 2)
+	if reflect.DeepEqual(steps, other) {
+		t.Fatal("different seeds, same run")
+	}
+}
+
+// Front end tasks calling Bin while another one refreshes the placement
+// table must park on the simulation, not on the front end's lock.
+func TestSimBins(t *testing.T) {
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s := triblab.NewSim(1)
+	backs := []string{"back-0", "back-1"}
+	check, run := simCluster(t, s, dir, 0, backs, []string{"keeper"})
+
+	bc, e := triblab.NewBinClientWith(backs, &triblab.ClientOptions{Sim: s})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("user%d", i)
+		s.Go("", func() {
+			for j := 0; j < 5; j++ {
+				var succ bool
+				check("set", bc.Bin(name).Set(trib.KV("n", fmt.Sprint(j)), &succ))
+				s.Sleep(time.Second)
+			}
+			var v string
+			check("get", bc.Bin(name).Get("n", &v))
+			if v != "4" {
+				t.Errorf("%s: n is %q", name, v)
+			}
+		})
+	}
+	run(10 * time.Second)
+}
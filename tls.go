@@ -0,0 +1,106 @@
+package triblab
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// Mutual TLS settings, all PEM files. Peers on either side must present
+// a certificate signed by CA.
+type TLSConfig struct {
+	CA   string // certificate(s) of the authority peers are checked against
+	Cert string // our own certificate
+	Key  string // and its private key
+}
+
+// Reads the "TLS" section of an rc file such as bins.rc, e.g.
+//
+//	"TLS": {"CA": "ca.pem", "Cert": "node.pem", "Key": "node-key.pem"}
+//
+// Relative paths are taken from the directory of the rc file. Returns nil
+// when the section is missing, meaning plaintext.
+func LoadTLS(rcPath string) (*TLSConfig, error) {
+	bytes, e := ioutil.ReadFile(rcPath)
+	if e != nil {
+		return nil, e
+	}
+
+	var rc struct {
+		TLS *TLSConfig
+	}
+	e = json.Unmarshal(bytes, &rc)
+	if e != nil {
+		return nil, e
+	}
+	if rc.TLS == nil {
+		return nil, nil
+	}
+
+	dir := filepath.Dir(rcPath)
+	for _, p := range []*string{&rc.TLS.CA, &rc.TLS.Cert, &rc.TLS.Key} {
+		if *p == "" {
+			return nil, fmt.Errorf("%s: TLS needs CA, Cert and Key", rcPath)
+		}
+		if !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	return rc.TLS, nil
+}
+
+func (self *TLSConfig) load() (tls.Certificate, *x509.CertPool, error) {
+	cert, e := tls.LoadX509KeyPair(self.Cert, self.Key)
+	if e != nil {
+		return cert, nil, e
+	}
+
+	pem, e := ioutil.ReadFile(self.CA)
+	if e != nil {
+		return cert, nil, e
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return cert, nil, fmt.Errorf("no certificates in %s", self.CA)
+	}
+	return cert, pool, nil
+}
+
+// Config for listeners, which require a client certificate. Nil for a
+// nil receiver.
+func (self *TLSConfig) server() (*tls.Config, error) {
+	if self == nil {
+		return nil, nil
+	}
+
+	cert, pool, e := self.load()
+	if e != nil {
+		return nil, e
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Config for dialing. Nil for a nil receiver.
+func (self *TLSConfig) client() (*tls.Config, error) {
+	if self == nil {
+		return nil, nil
+	}
+
+	cert, pool, e := self.load()
+	if e != nil {
+		return nil, e
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,207 @@
+package triblab_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"trib"
+	"trib/randaddr"
+	"trib/store"
+	"trib/tribtest"
+	"triblab"
+)
+
+// Writes a CA and a localhost certificate signed by it into dir, as
+// ca.pem, node.pem and node-key.pem.
+func makeCerts(t *testing.T, dir string) {
+	writePEM := func(name, typ string, der []byte) {
+		f, e := os.Create(filepath.Join(dir, name))
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer f.Close()
+		if e := pem.Encode(f, &pem.Block{Type: typ, Bytes: der}); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	cakey, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "triblab test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, e := x509.CreateCertificate(rand.Reader, ca, ca, &cakey.PublicKey, cakey)
+	if e != nil {
+		t.Fatal(e)
+	}
+	writePEM("ca.pem", "CERTIFICATE", der)
+
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+	node := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, e = x509.CreateCertificate(rand.Reader, node, ca, &key.PublicKey, cakey)
+	if e != nil {
+		t.Fatal(e)
+	}
+	writePEM("node.pem", "CERTIFICATE", der)
+
+	der, e = x509.MarshalECPrivateKey(key)
+	if e != nil {
+		t.Fatal(e)
+	}
+	writePEM("node-key.pem", "EC PRIVATE KEY", der)
+}
+
+// Sets up certificates in a fresh directory and loads them through an rc
+// file.
+func loadTestTLS(t *testing.T, dir string) *triblab.TLSConfig {
+	makeCerts(t, dir)
+	rc := filepath.Join(dir, "bins.rc")
+	e := ioutil.WriteFile(rc, []byte(`{
+	"Backs": ["localhost:1"],
+	"TLS": {"CA": "ca.pem", "Cert": "node.pem", "Key": "node-key.pem"}
+}`), 0644)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	conf, e := triblab.LoadTLS(rc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if conf == nil || conf.CA != filepath.Join(dir, "ca.pem") {
+		t.Fatalf("bad TLS config: %+v", conf)
+	}
+	return conf
+}
+
+func TestTLS(t *testing.T) {
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := loadTestTLS(t, dir)
+
+	// certificates from another CA are turned away
+	rogue := filepath.Join(dir, "rogue")
+	if e := os.Mkdir(rogue, 0755); e != nil {
+		t.Fatal(e)
+	}
+	rconf := loadTestTLS(t, rogue)
+
+	addr := randaddr.Local()
+	ready := make(chan bool)
+	go func() {
+		b := &trib.BackConfig{Addr: addr, Store: store.NewStorage(), Ready: ready}
+		e := triblab.ServeBackWith(b, &triblab.BackOptions{TLS: conf})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-ready {
+		t.Fatal("not ready")
+	}
+
+	c, e := triblab.NewClientWith(addr, &triblab.ClientOptions{TLS: conf})
+	if e != nil {
+		t.Fatal(e)
+	}
+	tribtest.CheckStorage(t, c)
+
+	var v string
+	if e := triblab.NewClient(addr).Get("hello", &v); e == nil {
+		t.Fatal("plaintext client got through")
+	}
+	c, e = triblab.NewClientWith(addr, &triblab.ClientOptions{TLS: rconf})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := c.Get("hello", &v); e == nil {
+		t.Fatal("client of another CA got through")
+	}
+
+	// keepers serve and dial backends over TLS as well
+	kaddr := randaddr.Local()
+	for kaddr == addr {
+		kaddr = randaddr.Local()
+	}
+	readyk := make(chan bool)
+	go func() {
+		e := triblab.ServeKeeperWith(&trib.KeeperConfig{
+			Backs: []string{addr},
+			Addrs: []string{kaddr},
+			Ready: readyk,
+		}, &triblab.KeeperOptions{StateDir: dir, TLS: conf})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-readyk {
+		t.Fatal("keeper not ready")
+	}
+
+	kc, e := triblab.NewKeeperClientWith(kaddr, &triblab.ClientOptions{TLS: conf})
+	if e != nil {
+		t.Fatal(e)
+	}
+	var st triblab.KeeperStatus
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if e := kc.Status("", &st); e != nil {
+			t.Fatal(e)
+		}
+		if len(st.Backs) == 1 && st.Backs[0].Alive {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("keeper cannot reach the backend: %+v", st)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if e := triblab.NewKeeperClient(kaddr).Status("", &st); e == nil {
+		t.Fatal("plaintext keeper client got through")
+	}
+
+	bc, e := triblab.NewBinClientWith([]string{addr}, &triblab.ClientOptions{TLS: conf})
+	if e != nil {
+		t.Fatal(e)
+	}
+	var succ bool
+	if e := bc.Bin("alice").Set(trib.KV("name", "alice"), &succ); e != nil {
+		t.Fatal(e)
+	}
+	if e := bc.Bin("alice").Get("name", &v); e != nil || v != "alice" {
+		t.Fatalf("bin over TLS: %q, %v", v, e)
+	}
+}
@@ -0,0 +1,379 @@
+package triblab
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"trib"
+)
+
+const (
+	// finished spans a tracer holds on to, oldest dropped first
+	TRACE_KEEP = 10000
+
+	// HTTP header, and JSON-RPC request member, carrying the trace
+	// context of a call in the W3C traceparent format
+	TRACE_HEADER = "Traceparent"
+)
+
+// Kinds of spans, numbered as in OpenTelemetry.
+const (
+	SPAN_INTERNAL = 1
+	SPAN_SERVER   = 2
+	SPAN_CLIENT   = 3
+)
+
+// Records the spans of one node.
+type Tracer struct {
+	service string
+
+	lock  sync.Mutex
+	spans []*Span // finished ones
+}
+
+func NewTracer(service string) *Tracer {
+	return &Tracer{service: service}
+}
+
+// One timed operation of a trace. A nil span ignores everything, so
+// that code paths do not have to check whether tracing is on.
+type Span struct {
+	tracer *Tracer
+
+	TraceId  string // 32 hex digits
+	SpanId   string // 16 hex digits
+	ParentId string // "" for a root span
+	Name     string
+	Kind     int
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]string
+	Error    string // "" if the operation succeeded
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Starts a span continuing the trace of a remote parent given as a
+// traceparent, or a new trace if parent is "" or malformed. A nil tracer
+// returns a nil span.
+func (self *Tracer) Start(name string, kind int, parent string) *Span {
+	if self == nil {
+		return nil
+	}
+
+	sp := &Span{
+		tracer:  self,
+		TraceId: randomHex(16),
+		SpanId:  randomHex(8),
+		Name:    name,
+		Kind:    kind,
+		Start:   time.Now(),
+		Attrs:   make(map[string]string),
+	}
+	// version-traceid-parentid-flags
+	fields := strings.Split(parent, "-")
+	if len(fields) == 4 && len(fields[1]) == 32 && len(fields[2]) == 16 {
+		sp.TraceId = fields[1]
+		sp.ParentId = fields[2]
+	}
+	return sp
+}
+
+// Starts a span under this one.
+func (self *Span) Child(name string, kind int) *Span {
+	if self == nil {
+		return nil
+	}
+
+	sp := self.tracer.Start(name, kind, "")
+	sp.TraceId = self.TraceId
+	sp.ParentId = self.SpanId
+	return sp
+}
+
+// Context to hand to a remote callee.
+func (self *Span) Traceparent() string {
+	if self == nil {
+		return ""
+	}
+	return "00-" + self.TraceId + "-" + self.SpanId + "-01"
+}
+
+func (self *Span) SetName(name string) {
+	if self == nil {
+		return
+	}
+	self.Name = name
+}
+
+func (self *Span) SetAttr(key, value string) {
+	if self == nil {
+		return
+	}
+	self.Attrs[key] = value
+}
+
+// Marks the span failed if e is not nil. Returns e.
+func (self *Span) SetError(e error) error {
+	if self != nil && e != nil {
+		self.Error = e.Error()
+	}
+	return e
+}
+
+// Marks the span failed if *e is not nil, and ends it. For deferring
+// with a named error result.
+func (self *Span) finishErr(e *error) {
+	self.SetError(*e)
+	self.Finish()
+}
+
+// Ends the span and hands it to its tracer.
+func (self *Span) Finish() {
+	if self == nil {
+		return
+	}
+	self.End = time.Now()
+
+	t := self.tracer
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.spans = append(t.spans, self)
+	if len(t.spans) > TRACE_KEEP {
+		t.spans = append([]*Span(nil), t.spans[len(t.spans)-TRACE_KEEP:]...)
+	}
+}
+
+// Copies of the finished spans, oldest first.
+func (self *Tracer) Spans() []Span {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	ret := make([]Span, 0, len(self.spans))
+	for _, sp := range self.spans {
+		ret = append(ret, *sp)
+	}
+	return ret
+}
+
+// OTLP/JSON shapes, as taken by OpenTelemetry collectors.
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string     `json:"traceId"`
+	SpanId            string     `json:"spanId"`
+	ParentSpanId      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+func otlpAttrs(attrs map[string]string) []otlpAttr {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ret := make([]otlpAttr, 0, len(keys))
+	for _, k := range keys {
+		ret = append(ret, otlpAttr{k, otlpValue{attrs[k]}})
+	}
+	return ret
+}
+
+// Writes the finished spans as an OTLP/JSON ExportTraceServiceRequest.
+func (self *Tracer) Export(w io.Writer) error {
+	spans := make([]otlpSpan, 0)
+	for _, sp := range self.Spans() {
+		st := otlpStatus{Code: 1}
+		if sp.Error != "" {
+			st = otlpStatus{Code: 2, Message: sp.Error}
+		}
+		spans = append(spans, otlpSpan{
+			TraceId:           sp.TraceId,
+			SpanId:            sp.SpanId,
+			ParentSpanId:      sp.ParentId,
+			Name:              sp.Name,
+			Kind:              sp.Kind,
+			StartTimeUnixNano: strconv.FormatInt(sp.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.End.UnixNano(), 10),
+			Attributes:        otlpAttrs(sp.Attrs),
+			Status:            st,
+		})
+	}
+
+	type scope struct {
+		Name string `json:"name"`
+	}
+	type scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	type resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	type resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+
+	return json.NewEncoder(w).Encode(map[string][]resourceSpans{
+		"resourceSpans": {{
+			Resource:   resource{otlpAttrs(map[string]string{"service.name": self.service})},
+			ScopeSpans: []scopeSpans{{Scope: scope{"triblab"}, Spans: spans}},
+		}},
+	})
+}
+
+// Records a server span for every call read by a server codec. The
+// parent comes from the request if the codec carries one per request,
+// and from the connection otherwise.
+type tracedCodec struct {
+	rpc.ServerCodec
+	tracer *Tracer
+	parent string
+	caller string
+
+	lock  sync.Mutex
+	spans map[uint64]*Span
+}
+
+// Codecs that read a trace context along with each request.
+type traceCarrier interface {
+	traceparent() string
+}
+
+func traceCodec(c rpc.ServerCodec, t *Tracer, parent, caller string) rpc.ServerCodec {
+	if t == nil {
+		return c
+	}
+	return &tracedCodec{
+		ServerCodec: c,
+		tracer:      t,
+		parent:      parent,
+		caller:      caller,
+		spans:       make(map[uint64]*Span),
+	}
+}
+
+func (self *tracedCodec) ReadRequestHeader(r *rpc.Request) error {
+	e := self.ServerCodec.ReadRequestHeader(r)
+	if e != nil {
+		return e
+	}
+
+	parent := self.parent
+	if tc, ok := self.ServerCodec.(traceCarrier); ok && tc.traceparent() != "" {
+		parent = tc.traceparent()
+	}
+	sp := self.tracer.Start(r.ServiceMethod, SPAN_SERVER, parent)
+	sp.SetAttr("rpc.method", r.ServiceMethod)
+	if self.caller != "" {
+		sp.SetAttr("caller", self.caller)
+	}
+
+	self.lock.Lock()
+	self.spans[r.Seq] = sp
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *tracedCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	self.lock.Lock()
+	sp := self.spans[r.Seq]
+	delete(self.spans, r.Seq)
+	self.lock.Unlock()
+
+	if r.Error != "" {
+		sp.SetError(fmt.Errorf("%s", r.Error))
+	}
+	sp.Finish()
+	return self.ServerCodec.WriteResponse(r, x)
+}
+
+// What calls go through: an rpc.Client, or a simulated link.
+type rpcCaller interface {
+	Call(method string, args, reply interface{}) error
+	Close() error
+}
+
+// A dialed connection, carrying the client span of the call made over
+// it.
+type rpcConn struct {
+	rpcCaller
+	span *Span
+	sim  *Sim // whose time backoffs wait in, nil for real time
+}
+
+func (self *rpcConn) Close() error {
+	self.span.Finish()
+	return self.rpcCaller.Close()
+}
+
+// Bins whose backend calls are made under span.
+type tracedBins struct {
+	bins trib.BinStorage
+	span *Span
+}
+
+func (self *tracedBins) Bin(name string) trib.Storage {
+	s := self.bins.Bin(name)
+	b, ok := s.(*BinI)
+	if !ok {
+		return s // not ours to trace
+	}
+
+	ret := *b
+	ret.stores = self.traced(b.stores)
+	ret.shadows = self.traced(b.shadows)
+	return &ret
+}
+
+func (self *tracedBins) simulation() *Sim {
+	return simOf(self.bins)
+}
+
+func (self *tracedBins) traced(stores []Storage) []Storage {
+	if stores == nil {
+		return nil
+	}
+
+	ret := make([]Storage, 0, len(stores))
+	for _, s := range stores {
+		if c, ok := s.(*client); ok {
+			cc := *c
+			cc.span = self.span
+			s = &cc
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
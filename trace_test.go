@@ -0,0 +1,107 @@
+package triblab_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"trib"
+	"trib/randaddr"
+	"trib/store"
+	"triblab"
+)
+
+func TestTrace(t *testing.T) {
+	addr := randaddr.Local()
+	ready := make(chan bool)
+	bt := triblab.NewTracer("back")
+	go func() {
+		b := &trib.BackConfig{Addr: addr, Store: store.NewStorage(), Ready: ready}
+		e := triblab.ServeBackWith(b, &triblab.BackOptions{Tracer: bt})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-ready {
+		t.Fatal("not ready")
+	}
+
+	ft := triblab.NewTracer("front")
+	front := triblab.NewFrontWith(triblab.NewBinClient([]string{addr}), &triblab.FrontOptions{Tracer: ft})
+	ne := func(e error) {
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	ne(front.SignUp("alice"))
+	ne(front.SignUp("bob"))
+	ne(front.Follow("alice", "bob"))
+	ne(front.Post("bob", "hello", 0))
+	tribs, e := front.Home("alice")
+	ne(e)
+	if len(tribs) != 1 {
+		t.Fatalf("home: %v", tribs)
+	}
+
+	fspans := make(map[string]triblab.Span)
+	var home triblab.Span
+	for _, sp := range ft.Spans() {
+		fspans[sp.SpanId] = sp
+		if sp.Name == "Home" {
+			home = sp
+		}
+	}
+	if home.SpanId == "" || home.ParentId != "" || home.Kind != triblab.SPAN_SERVER {
+		t.Fatalf("home span: %+v", home)
+	}
+
+	// every followee gets its own span under Home
+	tribsOf := make(map[string]bool)
+	for _, sp := range fspans {
+		if sp.Name == "Tribs" && sp.ParentId == home.SpanId {
+			tribsOf[sp.Attrs["user"]] = true
+		}
+	}
+	if !tribsOf["alice"] || !tribsOf["bob"] {
+		t.Fatalf("tribs spans under home: %v", tribsOf)
+	}
+
+	// and the backend carries the trace on
+	served := 0
+	for _, sp := range bt.Spans() {
+		if sp.TraceId != home.TraceId {
+			continue
+		}
+		parent, found := fspans[sp.ParentId]
+		if !found || parent.Kind != triblab.SPAN_CLIENT || parent.Name != sp.Name {
+			t.Fatalf("backend span %+v under %+v", sp, parent)
+		}
+		if sp.Kind != triblab.SPAN_SERVER {
+			t.Fatalf("backend span kind: %+v", sp)
+		}
+		served++
+	}
+	if served == 0 {
+		t.Fatal("no backend spans in the home trace")
+	}
+
+	var buf bytes.Buffer
+	ne(bt.Export(&buf))
+	var export struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceId      string `json:"traceId"`
+					ParentSpanId string `json:"parentSpanId"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	ne(json.Unmarshal(buf.Bytes(), &export))
+	if len(export.ResourceSpans) != 1 || len(export.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("export: %s", buf.String())
+	}
+	if n := len(export.ResourceSpans[0].ScopeSpans[0].Spans); n != len(bt.Spans()) {
+		t.Fatalf("exported %d spans", n)
+	}
+}
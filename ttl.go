@@ -0,0 +1,232 @@
+package triblab
+
+import (
+	"fmt"
+	"time"
+	"trib"
+)
+
+const (
+	// how often backends look for expired keys nobody asked for
+	TTL_SWEEP = time.Second
+)
+
+// Args of Storage.SetWithTTL.
+type TTLArgs struct {
+	Key   string
+	Value string
+	TTL   time.Duration
+}
+
+// Args of Storage.ListExpire.
+type ExpireArgs struct {
+	Key string
+	TTL time.Duration // 0 to keep the list for good
+}
+
+// Expiry times of lists or of string keys. Guarded by tlock.
+func (self *backend) ttls(lists bool) map[string]time.Time {
+	if lists {
+		return self.listTTL
+	}
+	return self.strTTL
+}
+
+func (self *backend) expired(lists bool, key string, now time.Time) bool {
+	self.tlock.Lock()
+	defer self.tlock.Unlock()
+
+	t, found := self.ttls(lists)[key]
+	return found && !now.Before(t)
+}
+
+// Time left before key expires, 0 if it does not.
+func (self *backend) ttlLeft(lists bool, key string) time.Duration {
+	self.tlock.Lock()
+	defer self.tlock.Unlock()
+
+	t, found := self.ttls(lists)[key]
+	if !found {
+		return 0
+	}
+	left := t.Sub(self.sim.time())
+	if left <= 0 {
+		left = 1 // about to go
+	}
+	return left
+}
+
+func (self *backend) setTTL(lists bool, key string, ttl time.Duration) {
+	self.tlock.Lock()
+	defer self.tlock.Unlock()
+
+	ttls := self.ttls(lists)
+	if ttl > 0 {
+		ttls[key] = self.sim.time().Add(ttl)
+	} else {
+		delete(ttls, key)
+	}
+}
+
+// Drops key if its TTL ran out.
+func (self *backend) evict(lists bool, key string) error {
+	if !self.expired(lists, key, self.sim.time()) {
+		return nil
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.evictLocked(lists, key)
+}
+
+// Same as evict, but the caller holds the lock.
+func (self *backend) evictLocked(lists bool, key string) error {
+	if !self.expired(lists, key, self.sim.time()) {
+		return nil
+	}
+	self.setTTL(lists, key, 0)
+
+	if lists {
+		var list trib.List
+		e := self.Storage.ListGet(key, &list)
+		if e != nil {
+			return e
+		}
+		var n int
+		return self.rebuild(key, list.L, nil, &n)
+	}
+
+	var succ bool
+	e := self.Storage.Set(&trib.KeyValue{Key: key, Value: ""}, &succ)
+	if e != nil {
+		return e
+	}
+	self.touch(false, key, false)
+	return nil
+}
+
+// Drops the expired keys from a key listing.
+func (self *backend) live(lists bool, keys []string) ([]string, error) {
+	ret := keys[:0]
+	for _, k := range keys {
+		if self.expired(lists, k, self.sim.time()) {
+			e := self.evict(lists, k)
+			if e != nil {
+				return nil, e
+			}
+			continue
+		}
+		ret = append(ret, k)
+	}
+	return ret, nil
+}
+
+func (self *backend) Get(key string, value *string) error {
+	e := self.evict(false, key)
+	if e != nil {
+		return e
+	}
+	return self.Storage.Get(key, value)
+}
+
+func (self *backend) Set(kv *trib.KeyValue, succ *bool) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.setTTL(false, kv.Key, 0)
+	e := self.Storage.Set(kv, succ)
+	if e != nil {
+		return e
+	}
+	self.touch(false, kv.Key, kv.Value != "")
+	return nil
+}
+
+func (self *backend) SetWithTTL(args *TTLArgs, succ *bool) error {
+	if args.TTL <= 0 {
+		return fmt.Errorf("invalid TTL %v", args.TTL)
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	e := self.Storage.Set(&trib.KeyValue{Key: args.Key, Value: args.Value}, succ)
+	if e != nil {
+		return e
+	}
+	if args.Value != "" {
+		self.setTTL(false, args.Key, args.TTL)
+	} else {
+		self.setTTL(false, args.Key, 0)
+	}
+	self.touch(false, args.Key, args.Value != "")
+	return nil
+}
+
+func (self *backend) Keys(p *trib.Pattern, list *trib.List) error {
+	e := self.Storage.Keys(p, list)
+	if e != nil {
+		return e
+	}
+	list.L, e = self.live(false, list.L)
+	return e
+}
+
+func (self *backend) ListKeys(p *trib.Pattern, list *trib.List) error {
+	e := self.Storage.ListKeys(p, list)
+	if e != nil {
+		return e
+	}
+	list.L, e = self.live(true, list.L)
+	return e
+}
+
+func (self *backend) ListExpire(args *ExpireArgs, succ *bool) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	*succ = false
+	e := self.evictLocked(true, args.Key)
+	if e != nil {
+		return e
+	}
+
+	var list trib.List
+	e = self.Storage.ListGet(args.Key, &list)
+	if e != nil {
+		return e
+	}
+	if len(list.L) == 0 {
+		return nil
+	}
+
+	self.setTTL(true, args.Key, args.TTL)
+	*succ = true
+	return nil
+}
+
+// Evicts expired keys every period, so that keys nobody reads again do
+// not stay around forever. Never returns.
+func (self *backend) sweep(period time.Duration) {
+	for {
+		self.sim.sleep(period)
+		now := self.sim.time()
+		for _, lists := range []bool{false, true} {
+			var due []string
+			self.tlock.Lock()
+			for k, t := range self.ttls(lists) {
+				if !now.Before(t) {
+					due = append(due, k)
+				}
+			}
+			self.tlock.Unlock()
+
+			for _, k := range due {
+				e := self.evict(lists, k)
+				if e != nil {
+					self.log.Warn("could not evict", "key", k, "list", lists, "error", e)
+				}
+			}
+		}
+	}
+}
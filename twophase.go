@@ -0,0 +1,524 @@
+package triblab
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"trib"
+)
+
+const (
+	// Bin holding the outcome of cross-bin transactions.
+	TXN_BIN = "_TXNLOG_"
+
+	// Decisions in the transaction log.
+	TXN_COMMIT = "commit"
+	TXN_ABORT  = "abort"
+
+	// How long a part may stay prepared, by the clock of its backend,
+	// before the keeper or a transaction held up by it decides for its
+	// coordinator. Coordinators give up committing transactions older
+	// than that by their own clock.
+	TXN_TIMEOUT = 10 * time.Second
+
+	// How long the outcome of a transaction stays in the log, for parts
+	// of it still to be decided, from when the keeper first saw it.
+	TXN_LOG_KEEP = 6 * TXN_TIMEOUT
+)
+
+// Args of Storage.Prepare.
+type PrepareArgs struct {
+	Id     string
+	Reads  []TxnRead
+	Writes []TxnWrite
+}
+
+// Args of Storage.Decide.
+type DecideArgs struct {
+	Id     string
+	Commit bool
+}
+
+// Reply of Storage.Decide.
+type Decision struct {
+	Known  bool       // false if the transaction was not prepared here
+	Writes []TxnWrite // what got applied
+}
+
+// A transaction between its two phases.
+type preparedTxn struct {
+	args *PrepareArgs
+	at   time.Time
+}
+
+func lockKey(list bool, key string) string {
+	if list {
+		return "l:" + key
+	}
+	return "s:" + key
+}
+
+// The locks a write takes: one held alone, and one shared with other
+// transactions, "" for none. Appends and removes share their list, as
+// they commute unless on the same value, which they hold alone. So
+// concurrent follows of one user do not conflict.
+func writeLocks(w *TxnWrite) (alone, shared string) {
+	if w.Op == TXN_SET {
+		return lockKey(false, w.Key), ""
+	}
+	return "v:" + w.Key + "\x00" + w.Value, lockKey(true, w.Key)
+}
+
+// Checks if a transaction other than txn holds key alone or, unless we
+// only share it, at all. Caller holds the lock.
+func (self *backend) heldLocked(txn, key string, alone bool) bool {
+	if id, found := self.held[key]; found && id != txn {
+		return true
+	}
+	if !alone {
+		return false
+	}
+	for id := range self.shared[key] {
+		if id != txn {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *backend) Prepare(args *PrepareArgs, ok *bool) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	*ok = false
+	if _, found := self.prepared[args.Id]; found {
+		*ok = true // a retried prepare
+		return nil
+	}
+
+	valid, e := self.validLocked(args.Id, args.Reads, args.Writes)
+	if e != nil || !valid {
+		return e
+	}
+
+	self.prepared[args.Id] = &preparedTxn{args: args, at: self.sim.time()}
+	for _, r := range args.Reads {
+		self.held[lockKey(r.List, r.Key)] = args.Id
+	}
+	for _, w := range args.Writes {
+		alone, shared := writeLocks(&w)
+		self.held[alone] = args.Id
+		if shared == "" {
+			continue
+		}
+		if self.shared[shared] == nil {
+			self.shared[shared] = make(map[string]bool)
+		}
+		self.shared[shared][args.Id] = true
+	}
+
+	*ok = true
+	return nil
+}
+
+func (self *backend) Decide(args *DecideArgs, ret *Decision) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	ret.Known = false
+	ret.Writes = []TxnWrite{}
+
+	p, found := self.prepared[args.Id]
+	if !found {
+		return nil
+	}
+
+	for k, id := range self.held {
+		if id == args.Id {
+			delete(self.held, k)
+		}
+	}
+	for k, ids := range self.shared {
+		delete(ids, args.Id)
+		if len(ids) == 0 {
+			delete(self.shared, k)
+		}
+	}
+	delete(self.prepared, args.Id)
+	ret.Known = true
+
+	if !args.Commit {
+		return nil
+	}
+
+	for _, w := range p.args.Writes {
+		e := self.applyLocked(&w)
+		if e != nil {
+			return e
+		}
+	}
+	ret.Writes = p.args.Writes
+	return nil
+}
+
+// What a transaction was prepared with, if it still is.
+func (self *backend) preparedArgs(id string) (*PrepareArgs, bool) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	p, found := self.prepared[id]
+	if !found {
+		return nil, false
+	}
+	return p.args, true
+}
+
+func (self *backend) InDoubt(age time.Duration, ids *[]string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	*ids = []string{}
+	for id, p := range self.prepared {
+		if self.sim.since(p.at) > age {
+			*ids = append(*ids, id)
+		}
+	}
+	sort.Strings(*ids)
+	return nil
+}
+
+// Records the outcome of a transaction in the log, unless someone got
+// there first. Returns the outcome that stuck. A transaction older than
+// TXN_TIMEOUT is aborted instead of committed, as the keeper may have
+// aborted some of its parts already and dropped the log entry since.
+func logDecision(log Storage, sim *Sim, id string, commit bool) (bool, error) {
+	var ret bool
+	e := RunTxn(log, func(tx *Txn) error {
+		var v string
+		e := tx.Get(id, &v)
+		if e != nil {
+			return e
+		}
+
+		if v != "" {
+			ret = v == TXN_COMMIT
+			return nil
+		}
+
+		ret = commit && sim.since(txnTime(id)) <= TXN_TIMEOUT
+		if ret {
+			tx.Set(&trib.KeyValue{Key: id, Value: TXN_COMMIT})
+		} else {
+			tx.Set(&trib.KeyValue{Key: id, Value: TXN_ABORT})
+		}
+		return nil
+	})
+	return ret, e
+}
+
+// Bins of one transaction may share a backend, so each gets its own id
+// there: the transaction id, a slash, and the bin name.
+func partId(id, bin string) string {
+	return id + "/" + bin
+}
+
+// Transaction ids start with when the transaction began.
+func newTxnId(now time.Time) string {
+	b := make([]byte, 12)
+	_, e := rand.Read(b)
+	if e != nil {
+		panic(e)
+	}
+	return fmt.Sprintf("%x-%s", now.UnixNano(), hex.EncodeToString(b))
+}
+
+// When the transaction of an id or part id began, the zero time for
+// ids of another form.
+func txnTime(id string) time.Time {
+	n, e := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 16, 64)
+	if e != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// Transaction over several bins, committed with two-phase commit. The
+// front end coordinates it; the outcome is written to TXN_BIN before any
+// participant applies it, so the keeper can finish the job if the front
+// end dies in between.
+type XTxn struct {
+	bins  trib.BinStorage
+	parts map[string]*Txn
+	order []string // bins in the order they were touched
+}
+
+func NewXTxn(bins trib.BinStorage) *XTxn {
+	return &XTxn{bins: bins, parts: make(map[string]*Txn)}
+}
+
+// The part of the transaction on bin name: reads and writes on it work
+// as with a single-bin Txn, but only XTxn.Commit commits them.
+func (self *XTxn) Bin(name string) *Txn {
+	t, found := self.parts[name]
+	if !found {
+		t = NewTxn(extend(self.bins.Bin(name)))
+		self.parts[name] = t
+		self.order = append(self.order, name)
+	}
+	return t
+}
+
+// Returns ErrConflict if the transaction lost a race and should be
+// retried from the start.
+func (self *XTxn) Commit() error {
+	if len(self.order) == 1 {
+		return self.parts[self.order[0]].Commit()
+	}
+
+	sim := simOf(self.bins)
+	id := newTxnId(sim.time())
+
+	// phase one
+	var err error
+	prepared := make([]*Txn, 0, len(self.order))
+	names := make([]string, 0, len(self.order))
+	for _, name := range self.order {
+		t := self.parts[name]
+		if len(t.reads)+len(t.writes) == 0 {
+			continue
+		}
+
+		// a lost reply may still have prepared it
+		prepared = append(prepared, t)
+		names = append(names, name)
+
+		var ok bool
+		pa := &PrepareArgs{Id: partId(id, name), Reads: t.reads, Writes: t.writes}
+		err = t.store.Prepare(pa, &ok)
+		if err == nil && !ok {
+			self.resolve(t)
+			err = ErrConflict
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// the decision; logging it is the commit point
+	commit := err == nil
+	logged := commit
+	if commit {
+		e := holdMigrating(sim, func() error {
+			var e error
+			commit, e = logDecision(extend(self.bins.Bin(TXN_BIN)), sim, id, true)
+			return e
+		})
+		if e != nil {
+			// the outcome is unknown; leave it to the keeper
+			return e
+		}
+		if !commit {
+			err = fmt.Errorf("transaction %s aborted by the keeper", id)
+		}
+	}
+
+	// phase two
+	done := true
+	for i, t := range prepared {
+		var d Decision
+		da := &DecideArgs{Id: partId(id, names[i]), Commit: commit}
+		e := t.store.Decide(da, &d)
+		if e != nil {
+			done = false
+		}
+	}
+
+	if logged && done {
+		// nobody is in doubt anymore
+		var succ bool
+		self.bins.Bin(TXN_BIN).Set(&trib.KeyValue{Key: id, Value: ""}, &succ)
+	}
+	return err
+}
+
+// Decides the parts left prepared on the backend of t for longer than
+// TXN_TIMEOUT, as the keeper would, so that a coordinator that died does
+// not hold up the transactions after it for good. Failures are left to
+// the keeper, or to the next transaction tripping on them.
+func (self *XTxn) resolve(t *Txn) {
+	var ids []string
+	e := t.store.InDoubt(TXN_TIMEOUT, &ids)
+	if e != nil {
+		return
+	}
+
+	sim := simOf(self.bins)
+	log := extend(self.bins.Bin(TXN_BIN))
+	for _, id := range ids {
+		parts := strings.SplitN(id, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		commit, e := logDecision(log, sim, parts[0], false)
+		if e != nil {
+			return
+		}
+		var d Decision
+		extend(self.bins.Bin(parts[1])).Decide(&DecideArgs{Id: id, Commit: commit}, &d)
+	}
+}
+
+// Runs f in a fresh cross-bin transaction and commits it, retrying on
+// conflicts after a jittered backoff as RunTxn does, and waiting for
+// migrations of its bins to end. f returning an error aborts the
+// transaction.
+func RunXTxn(bins trib.BinStorage, f func(xt *XTxn) error) error {
+	sim := simOf(bins)
+	return holdMigrating(sim, func() error {
+		wait := TXN_BACKOFF
+		for i := 0; i < TXN_RETRIES; i++ {
+			if i > 0 {
+				sim.sleep(sim.jitter(wait))
+				wait *= 2
+			}
+
+			xt := NewXTxn(bins)
+			e := f(xt)
+			if e != nil {
+				return e
+			}
+
+			e = xt.Commit()
+			if e != ErrConflict {
+				return e
+			}
+		}
+		return ErrConflict
+	})
+}
+
+// Finishes the transactions left prepared by coordinators that went
+// away: commits the ones logged as committed, aborts the rest. Each part
+// is decided through its bin, so that the writes also reach the other
+// copies of it. Once every backend answers, outcomes seen longer than
+// TXN_LOG_KEEP ago with no part left prepared are dropped from the log.
+// Ages go by the clock of the backend or the keeper, never by the front
+// end time in the ids.
+func (self *Keeper) recover_txns(all_stores []trib.Storage, alive []bool) error {
+	n := len(all_stores)
+	old := make([][]string, n)      // in doubt
+	prepared := make([][]string, n) // in doubt or not
+	errs := make([]error, n)
+	self.sim.fanOut(n, func(i int) {
+		if !alive[i] {
+			return
+		}
+		back := extend(all_stores[i])
+		errs[i] = back.InDoubt(TXN_TIMEOUT, &old[i])
+		if errs[i] == nil {
+			errs[i] = back.InDoubt(0, &prepared[i])
+		}
+		if errs[i] != nil {
+			self.log.Warn("could not list transactions", "back", self.kconfig.Backs[i], "error", errs[i])
+		}
+	})
+
+	self.lock.Lock()
+	p, e := unmarshalPlacement(self.state.Placement.marshal())
+	self.lock.Unlock()
+	if e != nil {
+		return e
+	}
+	log := self.bin(p, TXN_BIN, "")
+
+	all := true
+	for i := range all_stores {
+		if !alive[i] || errs[i] != nil {
+			all = false
+			continue
+		}
+
+		for _, id := range old[i] {
+			parts := strings.SplitN(id, "/", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			commit, e := logDecision(log, self.sim, parts[0], false)
+			if e != nil {
+				return e
+			}
+
+			// prepared on this backend, whatever the primary is now
+			var d Decision
+			e = self.bin(p, parts[1], self.kconfig.Backs[i]).Decide(&DecideArgs{Id: id, Commit: commit}, &d)
+			if e != nil {
+				self.log.Warn("could not decide transaction", "back", self.kconfig.Backs[i], "txn", id, "error", e)
+			}
+		}
+	}
+	if !all {
+		return nil
+	}
+
+	busy := make(map[string]bool)
+	for i := range all_stores {
+		for _, id := range prepared[i] {
+			busy[strings.SplitN(id, "/", 2)[0]] = true
+		}
+	}
+	var ids trib.List
+	e = log.Keys(&trib.Pattern{}, &ids)
+	if e != nil {
+		return e
+	}
+	seen := make(map[string]time.Time, len(ids.L))
+	for _, id := range ids.L {
+		at, found := self.logged[id]
+		if !found {
+			at = self.sim.time()
+		}
+		seen[id] = at
+		if busy[id] || self.sim.since(at) <= TXN_LOG_KEEP {
+			continue
+		}
+		var succ bool
+		e = log.Set(&trib.KeyValue{Key: id, Value: ""}, &succ)
+		if e != nil {
+			return e
+		}
+		delete(seen, id)
+	}
+	self.logged = seen
+	return nil
+}
+
+// The bin as front ends see it in p, with first as its primary if not
+// empty. Decide goes to the primary, and the writes it returns to the
+// other copies.
+func (self *Keeper) bin(p *Placement, name, first string) *BinI {
+	backs := p.Lookup(name)
+	if first != "" {
+		rest := []string{first}
+		for _, b := range backs {
+			if b != first {
+				rest = append(rest, b)
+			}
+		}
+		backs = rest
+	}
+
+	b := &BinI{bname: name, sim: self.sim}
+	for _, addr := range backs {
+		b.stores = append(b.stores, self.client(addr))
+	}
+	for _, addr := range p.Shadows(name) {
+		if addr != first {
+			b.shadows = append(b.shadows, self.client(addr))
+		}
+	}
+	return b
+}
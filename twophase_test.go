@@ -0,0 +1,362 @@
+package triblab_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"trib"
+	"trib/entries"
+	"trib/randaddr"
+	"trib/store"
+	"triblab"
+)
+
+func TestXTxn(t *testing.T) {
+	if os.Getenv("TRIB_LAB") == "lab1" {
+		t.SkipNow()
+	}
+
+	addr1 := randaddr.Local()
+	addr2 := randaddr.Local()
+	for addr2 == addr1 {
+		addr2 = randaddr.Local()
+	}
+
+	ready := make(chan bool)
+	run := func(addr string) {
+		e := entries.ServeBackSingle(addr, store.NewStorage(), ready)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	go run(addr1)
+	go run(addr2)
+	if !(<-ready && <-ready) {
+		t.Fatal("not ready")
+	}
+
+	bc := triblab.NewBinClient([]string{addr1, addr2})
+
+	e := triblab.RunXTxn(bc, func(xt *triblab.XTxn) error {
+		var l trib.List
+		e := xt.Bin("alice").ListGet("follows", &l)
+		if e != nil {
+			return e
+		}
+		xt.Bin("alice").ListAppend(trib.KV("follows", "bob"))
+		xt.Bin("bob").ListAppend(trib.KV("followers", "alice"))
+		return nil
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var l trib.List
+	if e := bc.Bin("alice").ListGet("follows", &l); e != nil || len(l.L) != 1 {
+		t.Fatal("follows not written", e)
+	}
+	if e := bc.Bin("bob").ListGet("followers", &l); e != nil || len(l.L) != 1 {
+		t.Fatal("followers not written", e)
+	}
+
+	// two coordinators that died after preparing, one of them after
+	// logging the commit
+	var ok, succ bool
+	alice := bc.Bin("alice").(triblab.Storage)
+	bob := bc.Bin("bob").(triblab.Storage)
+	e = alice.Prepare(&triblab.PrepareArgs{
+		Id:     "t1/alice",
+		Writes: []triblab.TxnWrite{{Op: triblab.TXN_SET, Key: "name", Value: "alice"}},
+	}, &ok)
+	if e != nil || !ok {
+		t.Fatal("prepare failed", e)
+	}
+	e = bc.Bin(triblab.TXN_BIN).Set(trib.KV("t1", triblab.TXN_COMMIT), &succ)
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = bob.Prepare(&triblab.PrepareArgs{
+		Id:     "t2/bob",
+		Writes: []triblab.TxnWrite{{Op: triblab.TXN_SET, Key: "name", Value: "bob"}},
+	}, &ok)
+	if e != nil || !ok {
+		t.Fatal("prepare failed", e)
+	}
+
+	// held keys stop other transactions
+	tx := triblab.NewTxn(bob)
+	tx.Set(trib.KV("name", "eve"))
+	if tx.Commit() != triblab.ErrConflict {
+		t.Fatal("wrote a key held by a prepared transaction")
+	}
+
+	// but appends of other values to a list do not wait for each other,
+	// so concurrent follows of bob all go through
+	e = bob.Prepare(&triblab.PrepareArgs{
+		Id:     "t3/bob",
+		Writes: []triblab.TxnWrite{{Op: triblab.TXN_APPEND, Key: "followers", Value: "carol"}},
+	}, &ok)
+	if e != nil || !ok {
+		t.Fatal("prepare failed", e)
+	}
+	tx = triblab.NewTxn(bob)
+	tx.ListAppend(trib.KV("followers", "dave"))
+	if e := tx.Commit(); e != nil {
+		t.Fatal("append waited for another value:", e)
+	}
+	tx = triblab.NewTxn(bob)
+	tx.ListAppend(trib.KV("followers", "carol"))
+	if tx.Commit() != triblab.ErrConflict {
+		t.Fatal("appended a value held by a prepared transaction")
+	}
+	tx = triblab.NewTxn(bob)
+	if e := tx.ListGet("followers", &l); e != nil {
+		t.Fatal(e)
+	}
+	tx.Set(trib.KV("n", "1"))
+	if tx.Commit() != triblab.ErrConflict {
+		t.Fatal("read a list with a prepared append")
+	}
+
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	readyk := make(chan bool)
+	addrk := randaddr.Local()
+	for addrk == addr1 || addrk == addr2 {
+		addrk = randaddr.Local()
+	}
+	go func() {
+		e := triblab.ServeKeeperWith(&trib.KeeperConfig{
+			Backs: []string{addr1, addr2},
+			Addrs: []string{addrk},
+			Ready: readyk,
+		}, &triblab.KeeperOptions{StateDir: dir})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}()
+	if !<-readyk {
+		t.Fatal("keeper not ready")
+	}
+
+	var v string
+	for deadline := time.Now().Add(triblab.TXN_TIMEOUT + 10*time.Second); ; {
+		if time.Now().After(deadline) {
+			t.Fatal("keeper did not recover the transactions")
+		}
+		time.Sleep(500 * time.Millisecond)
+
+		var ids []string
+		if e := alice.InDoubt(0, &ids); e != nil || len(ids) != 0 {
+			continue
+		}
+		if e := bob.InDoubt(0, &ids); e != nil || len(ids) != 0 {
+			continue
+		}
+		break
+	}
+
+	if e := bc.Bin("alice").Get("name", &v); e != nil || v != "alice" {
+		t.Fatalf("logged commit not applied: %q, %v", v, e)
+	}
+	if e := bc.Bin("bob").Get("name", &v); e != nil || v != "" {
+		t.Fatalf("unlogged transaction applied: %q, %v", v, e)
+	}
+}
+
+// Transactions on a migrating bin wait for the migration to end, so that
+// front ends on either side of the flip cannot both commit.
+func TestXTxnMigrating(t *testing.T) {
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s := triblab.NewSim(1)
+	backs := []string{"back-0", "back-1"}
+	check, run := simCluster(t, s, dir, 0, backs, []string{"keeper"})
+
+	copts := &triblab.ClientOptions{Sim: s}
+	kc, e := triblab.NewKeeperClientWith("keeper", copts)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	incr := func(bins trib.BinStorage) error {
+		return triblab.RunXTxn(bins, func(xt *triblab.XTxn) error {
+			var v string
+			e := xt.Bin("bob").Get("n", &v)
+			if e != nil {
+				return e
+			}
+			n, _ := strconv.Atoi(v)
+			xt.Bin("bob").Set(trib.KV("n", strconv.Itoa(n+1)))
+			return nil
+		})
+	}
+
+	var started time.Time
+	s.Go("", func() {
+		s.Sleep(2 * time.Second)
+		var p triblab.Placement
+		check("placement", kc.GetPlacement("", &p))
+		to := backs[0]
+		if p.Lookup("bob")[0] == to {
+			to = backs[1]
+		}
+		var succ bool
+		check("migrate", kc.Migrate(&triblab.MigrateArgs{Bin: "bob", To: to}, &succ))
+		started = s.Now()
+	})
+	run(5 * time.Second)
+
+	done := 0
+	for i := 0; i < 2; i++ {
+		s.Go("", func() {
+			bc, e := triblab.NewBinClientWith(backs, copts)
+			check("bin client", e)
+			check("incr", incr(bc))
+
+			var st triblab.KeeperStatus
+			check("status", kc.Status("", &st))
+			if len(st.Migrations) != 0 {
+				t.Errorf("committed %v into the migration: %+v", s.Now().Sub(started), st.Migrations)
+			}
+			done++
+		})
+	}
+	run(triblab.TXN_HOLD)
+
+	s.Go("", func() {
+		bc, e := triblab.NewBinClientWith(backs, copts)
+		check("bin client", e)
+		var v string
+		check("get", bc.Bin("bob").Get("n", &v))
+		if done != 2 || v != "2" {
+			t.Errorf("%d increments done, n is %q", done, v)
+		}
+	})
+	run(time.Second)
+}
+
+// The keeper finishes transactions on every copy of their bins, and
+// drops their outcomes from the log once nothing is left to decide.
+func TestXTxnRecovery(t *testing.T) {
+	dir, e := ioutil.TempDir("", "triblab")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s := triblab.NewSim(1)
+	backs := []string{"back-0", "back-1"}
+	check, run := simCluster(t, s, dir, 2, backs, []string{"keeper"})
+
+	copts := &triblab.ClientOptions{Sim: s}
+	bc, e := triblab.NewBinClientWith(backs, copts)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// coordinators that died after preparing, one after logging a commit
+	var committed, aborted string
+	s.Go("", func() {
+		s.Sleep(2 * time.Second)
+		committed = fmt.Sprintf("%x-commit", s.Now().UnixNano())
+		aborted = fmt.Sprintf("%x-abort", s.Now().UnixNano())
+
+		var ok, succ bool
+		alice := bc.Bin("alice").(triblab.Storage)
+		check("prepare", alice.Prepare(&triblab.PrepareArgs{
+			Id:     committed + "/alice",
+			Writes: []triblab.TxnWrite{{Op: triblab.TXN_SET, Key: "name", Value: "alice"}},
+		}, &ok))
+		check("log", bc.Bin(triblab.TXN_BIN).Set(trib.KV(committed, triblab.TXN_COMMIT), &succ))
+		check("prepare", alice.Prepare(&triblab.PrepareArgs{
+			Id:     aborted + "/alice",
+			Writes: []triblab.TxnWrite{{Op: triblab.TXN_SET, Key: "age", Value: "30"}},
+		}, &ok))
+	})
+
+	logged := func(id string) string {
+		var v string
+		check("log", bc.Bin(triblab.TXN_BIN).Get(id, &v))
+		return v
+	}
+	s.Go("", func() {
+		s.Sleep(triblab.TXN_TIMEOUT + 5*time.Second)
+		for _, addr := range backs {
+			c, e := triblab.NewClientWith(addr, copts)
+			check("client", e)
+			var name, age string
+			check("get", c.Get("alice::name", &name))
+			check("get", c.Get("alice::age", &age))
+			if name != "alice" || age != "" {
+				t.Errorf("%s has name %q, age %q", addr, name, age)
+			}
+		}
+		if logged(committed) != triblab.TXN_COMMIT || logged(aborted) != triblab.TXN_ABORT {
+			t.Errorf("outcomes not logged: %q, %q", logged(committed), logged(aborted))
+		}
+
+		s.Sleep(triblab.TXN_LOG_KEEP)
+		if logged(committed) != "" || logged(aborted) != "" {
+			t.Errorf("outcomes left in the log: %q, %q", logged(committed), logged(aborted))
+		}
+	})
+	run(triblab.TXN_LOG_KEEP + triblab.TXN_TIMEOUT + 10*time.Second)
+}
+
+// Without a keeper, the transaction held up by a dead coordinator decides
+// for it once the part times out.
+func TestXTxnNoKeeper(t *testing.T) {
+	s := triblab.NewSim(1)
+	backs := []string{"back-0", "back-1"}
+	check, run := simCluster(t, s, "", 0, backs, nil)
+
+	bc, e := triblab.NewBinClientWith(backs, &triblab.ClientOptions{Sim: s})
+	if e != nil {
+		t.Fatal(e)
+	}
+	follow := func() error {
+		return triblab.RunXTxn(bc, func(xt *triblab.XTxn) error {
+			xt.Bin("alice").ListAppend(trib.KV("follows", "bob"))
+			xt.Bin("bob").ListAppend(trib.KV("followers", "alice"))
+			return nil
+		})
+	}
+
+	s.Go("", func() {
+		s.Sleep(time.Second)
+		var ok bool
+		bob := bc.Bin("bob").(triblab.Storage)
+		check("prepare", bob.Prepare(&triblab.PrepareArgs{
+			Id:     fmt.Sprintf("%x-dead/bob", s.Now().UnixNano()),
+			Writes: []triblab.TxnWrite{{Op: triblab.TXN_APPEND, Key: "followers", Value: "alice"}},
+		}, &ok))
+
+		if e := follow(); e != triblab.ErrConflict {
+			t.Errorf("follow before the timeout: %v", e)
+		}
+		s.Sleep(triblab.TXN_TIMEOUT)
+		check("follow", follow())
+
+		var l trib.List
+		check("get", bc.Bin("bob").ListGet("followers", &l))
+		var ids []string
+		check("in doubt", bob.InDoubt(0, &ids))
+		if len(l.L) != 1 || len(ids) != 0 {
+			t.Errorf("followers %v, in doubt %v", l.L, ids)
+		}
+	})
+	run(triblab.TXN_TIMEOUT + 20*time.Second)
+}
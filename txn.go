@@ -0,0 +1,332 @@
+package triblab
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"trib"
+)
+
+// Ops of a transaction write.
+const (
+	TXN_SET    = "set"
+	TXN_APPEND = "append"
+	TXN_REMOVE = "remove"
+
+	// commit attempts before a transaction gives up on conflicts
+	TXN_RETRIES = 10
+
+	// first wait between commit attempts, doubled after every conflict
+	// and jittered
+	TXN_BACKOFF = 5 * time.Millisecond
+
+	// how long a transaction waits for a migration of its bins to end
+	TXN_HOLD = 30 * time.Second
+)
+
+// Commit failed because something the transaction read changed.
+var ErrConflict = errors.New("transaction conflict")
+
+// The bin is migrating. Versions are per backend, and front ends on
+// either side of the flip would validate on different ones, so
+// transactions wait for the migration to end.
+var ErrMigrating = errors.New("bin is migrating")
+
+// Args of Storage.GetVersioned.
+type VersionArgs struct {
+	Key  string
+	List bool
+}
+
+// Reply of Storage.GetVersioned.
+type Versioned struct {
+	Value   string        // for string keys
+	List    []string      // for lists
+	Version uint64        // clock of the last change
+	TTL     time.Duration // time left before it expires, 0 if it does not
+}
+
+// A read the transaction depends on.
+type TxnRead struct {
+	Key     string
+	List    bool
+	Version uint64
+}
+
+// A buffered write.
+type TxnWrite struct {
+	Op    string
+	Key   string
+	Value string
+}
+
+// Args of Storage.Commit.
+type CommitArgs struct {
+	Reads  []TxnRead
+	Writes []TxnWrite
+}
+
+func (self *backend) GetVersioned(args *VersionArgs, ret *Versioned) error {
+	e := self.evict(args.List, args.Key)
+	if e != nil {
+		return e
+	}
+
+	// mutations hold the write lock, so value and version match
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	if args.List {
+		var list trib.List
+		e = self.Storage.ListGet(args.Key, &list)
+		ret.List = list.L
+	} else {
+		e = self.Storage.Get(args.Key, &ret.Value)
+	}
+	if e != nil {
+		return e
+	}
+
+	ret.Version = self.version(args.List, args.Key)
+	if ret.Value != "" || len(ret.List) > 0 {
+		ret.TTL = self.ttlLeft(args.List, args.Key)
+	}
+	return nil
+}
+
+// Applies the writes if none of the reads changed since. Reports a
+// conflict with committed == false.
+func (self *backend) Commit(args *CommitArgs, committed *bool) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	*committed = false
+	ok, e := self.validLocked("", args.Reads, args.Writes)
+	if e != nil || !ok {
+		return e
+	}
+
+	for _, w := range args.Writes {
+		e := self.applyLocked(&w)
+		if e != nil {
+			return e
+		}
+	}
+
+	*committed = true
+	return nil
+}
+
+// Checks that none of the reads changed and that no other prepared
+// transaction than txn holds any of the keys involved. Caller holds the
+// lock.
+func (self *backend) validLocked(txn string, reads []TxnRead, writes []TxnWrite) (bool, error) {
+	for _, w := range writes {
+		if w.Op != TXN_SET && w.Op != TXN_APPEND && w.Op != TXN_REMOVE {
+			return false, fmt.Errorf("unknown transaction op %q", w.Op)
+		}
+		alone, shared := writeLocks(&w)
+		if self.heldLocked(txn, alone, true) || shared != "" && self.heldLocked(txn, shared, false) {
+			return false, nil
+		}
+	}
+
+	for _, r := range reads {
+		if self.heldLocked(txn, lockKey(r.List, r.Key), true) {
+			return false, nil
+		}
+
+		e := self.evictLocked(r.List, r.Key)
+		if e != nil {
+			return false, e
+		}
+		if self.version(r.List, r.Key) != r.Version {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Caller holds the lock.
+func (self *backend) applyLocked(w *TxnWrite) error {
+	kv := &trib.KeyValue{Key: w.Key, Value: w.Value}
+	switch w.Op {
+	case TXN_SET:
+		self.setTTL(false, w.Key, 0)
+		var succ bool
+		e := self.Storage.Set(kv, &succ)
+		if e != nil {
+			return e
+		}
+		self.touch(false, w.Key, w.Value != "")
+
+	case TXN_APPEND:
+		e := self.evictLocked(true, w.Key)
+		if e != nil {
+			return e
+		}
+		var succ bool
+		e = self.Storage.ListAppend(kv, &succ)
+		if e != nil {
+			return e
+		}
+		self.touch(true, w.Key, true)
+
+	case TXN_REMOVE:
+		e := self.evictLocked(true, w.Key)
+		if e != nil {
+			return e
+		}
+		var n int
+		e = self.Storage.ListRemove(kv, &n)
+		if e != nil {
+			return e
+		}
+		if n > 0 {
+			return self.touchRemoved(w.Key)
+		}
+	}
+	return nil
+}
+
+// Applies a write with the plain operations, for copies of a bin that
+// follow the primary.
+func applyWrite(s trib.Storage, w *TxnWrite) error {
+	kv := &trib.KeyValue{Key: w.Key, Value: w.Value}
+	var succ bool
+	var n int
+	switch w.Op {
+	case TXN_SET:
+		return s.Set(kv, &succ)
+	case TXN_APPEND:
+		return s.ListAppend(kv, &succ)
+	case TXN_REMOVE:
+		return s.ListRemove(kv, &n)
+	}
+	return fmt.Errorf("unknown transaction op %q", w.Op)
+}
+
+// Optimistic transaction over the keys of one Storage, typically a bin.
+// Reads go to the storage right away and remember the version they saw;
+// writes are buffered until Commit, which applies them all at once on the
+// owning backend, or not at all if anything read has changed since.
+// Reads do not see the transaction's own writes.
+type Txn struct {
+	store  Storage
+	reads  []TxnRead
+	writes []TxnWrite
+}
+
+func NewTxn(s Storage) *Txn {
+	return &Txn{store: s}
+}
+
+func (self *Txn) Get(key string, value *string) error {
+	var v Versioned
+	e := self.store.GetVersioned(&VersionArgs{Key: key}, &v)
+	if e != nil {
+		return e
+	}
+
+	self.reads = append(self.reads, TxnRead{Key: key, Version: v.Version})
+	*value = v.Value
+	return nil
+}
+
+func (self *Txn) ListGet(key string, list *trib.List) error {
+	var v Versioned
+	e := self.store.GetVersioned(&VersionArgs{Key: key, List: true}, &v)
+	if e != nil {
+		return e
+	}
+
+	self.reads = append(self.reads, TxnRead{Key: key, List: true, Version: v.Version})
+	list.L = v.List
+	if list.L == nil {
+		list.L = []string{}
+	}
+	return nil
+}
+
+func (self *Txn) Set(kv *trib.KeyValue) {
+	self.writes = append(self.writes, TxnWrite{TXN_SET, kv.Key, kv.Value})
+}
+
+func (self *Txn) ListAppend(kv *trib.KeyValue) {
+	self.writes = append(self.writes, TxnWrite{TXN_APPEND, kv.Key, kv.Value})
+}
+
+func (self *Txn) ListRemove(kv *trib.KeyValue) {
+	self.writes = append(self.writes, TxnWrite{TXN_REMOVE, kv.Key, kv.Value})
+}
+
+// Returns ErrConflict if the transaction lost a race and should be
+// retried from the start.
+func (self *Txn) Commit() error {
+	if len(self.writes) == 0 {
+		return nil
+	}
+
+	var committed bool
+	e := self.store.Commit(&CommitArgs{Reads: self.reads, Writes: self.writes}, &committed)
+	if e != nil {
+		return e
+	}
+	if !committed {
+		return ErrConflict
+	}
+	return nil
+}
+
+// Runs f in a fresh transaction on s and commits it, retrying on
+// conflicts after a jittered backoff, so that contending transactions
+// spread out. f returning an error aborts the transaction.
+func RunTxn(s Storage, f func(tx *Txn) error) error {
+	sim := simOf(s)
+	wait := TXN_BACKOFF
+	for i := 0; i < TXN_RETRIES; i++ {
+		if i > 0 {
+			sim.sleep(sim.jitter(wait))
+			wait *= 2
+		}
+
+		tx := NewTxn(s)
+		e := f(tx)
+		if e != nil {
+			return e
+		}
+
+		e = tx.Commit()
+		if e != ErrConflict {
+			return e
+		}
+	}
+	return ErrConflict
+}
+
+// Runs f until it gets past ErrMigrating, for up to TXN_HOLD. f has to
+// resolve its bins anew on every call to see the migration end.
+func holdMigrating(sim *Sim, f func() error) error {
+	start := sim.time()
+	for {
+		e := f()
+		if e != ErrMigrating || sim.since(start) >= TXN_HOLD {
+			return e
+		}
+		sim.sleep(PLACEMENT_REFRESH)
+	}
+}
+
+// Storages and bin storages that run in a simulation.
+type simulated interface {
+	simulation() *Sim
+}
+
+// The simulation x runs in, nil for the real world.
+func simOf(x interface{}) *Sim {
+	if s, ok := x.(simulated); ok {
+		return s.simulation()
+	}
+	return nil
+}
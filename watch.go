@@ -0,0 +1,194 @@
+package triblab
+
+import (
+	"time"
+	"trib"
+)
+
+const (
+	// how long a Watch waits when the caller does not say
+	WATCH_TIMEOUT = 30 * time.Second
+
+	// longest wait a Watch may ask for
+	WATCH_MAX = 5 * time.Minute
+
+	// versions kept before the first prune; later prunes wait for
+	// twice what the previous one kept
+	WATCH_PRUNE = 1024
+)
+
+// Args of Storage.Watch.
+type WatchArgs struct {
+	Keys    []string // string keys
+	Lists   []string
+	Since   uint64        // report changes after this clock
+	Timeout time.Duration // WATCH_TIMEOUT when 0
+}
+
+// Reply of Storage.Watch. Empty when the watch timed out. Keys whose
+// versions the backend pruned may be named as changed although they were
+// not, so watchers have to re-read rather than trust it.
+type WatchResult struct {
+	Keys  []string // string keys that changed
+	Lists []string // lists that changed
+	Clock uint64   // Since for the next Watch
+}
+
+// Records a change of key, which exists after it or not, waking up the
+// watchers. Caller holds the lock, so versions go up in the order the
+// changes happen.
+func (self *backend) touch(lists bool, key string, exists bool) {
+	// at least 1, so a change is never confused with no change
+	var clk uint64
+	self.Storage.Clock(1, &clk)
+
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+
+	stored := self.stored[0]
+	if lists {
+		self.listVer[key] = clk
+		stored = self.stored[1]
+	} else {
+		self.strVer[key] = clk
+	}
+	if exists {
+		stored[key] = true
+	} else {
+		delete(stored, key)
+	}
+	if clk > self.clock {
+		self.clock = clk
+	}
+	if len(self.strVer)+len(self.listVer) >= self.pruneAt {
+		self.pruneLocked(clk)
+	}
+	close(self.wake)
+	self.wake = make(chan bool)
+}
+
+// Records values removed from the list at key, which may be gone now.
+// Caller holds the lock.
+func (self *backend) touchRemoved(key string) error {
+	var list trib.List
+	e := self.Storage.ListGet(key, &list)
+	if e != nil {
+		return e
+	}
+	self.touch(true, key, len(list.L) > 0)
+	return nil
+}
+
+// Forgets the versions no waiting watch needs, those up to its Since,
+// or all of them up to clk without watches. They all turn into the
+// floor, so later watches and transactions at worst see a change that
+// was not, never miss one. Caller holds wlock.
+func (self *backend) pruneLocked(clk uint64) {
+	cut := clk
+	for since := range self.watches {
+		if since < cut {
+			cut = since
+		}
+	}
+
+	for _, vers := range []map[string]uint64{self.strVer, self.listVer} {
+		for k, v := range vers {
+			if v <= cut {
+				delete(vers, k)
+			}
+		}
+	}
+	if cut > self.floor {
+		self.floor = cut
+	}
+
+	self.pruneAt = 2 * (len(self.strVer) + len(self.listVer))
+	if self.pruneAt < WATCH_PRUNE {
+		self.pruneAt = WATCH_PRUNE
+	}
+}
+
+// Clock of the last change of key, 0 if it never changed since the
+// backend started, or the floor once pruned.
+func (self *backend) version(lists bool, key string) uint64 {
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	return self.versionLocked(lists, key)
+}
+
+// Caller holds wlock.
+func (self *backend) versionLocked(lists bool, key string) uint64 {
+	vers := self.strVer
+	if lists {
+		vers = self.listVer
+	}
+	if v, found := vers[key]; found {
+		return v
+	}
+	return self.floor
+}
+
+// Fills ret with what changed after since. Caller holds wlock.
+func (self *backend) changed(args *WatchArgs, ret *WatchResult) bool {
+	ret.Keys = []string{}
+	ret.Lists = []string{}
+	ret.Clock = args.Since
+
+	for _, k := range args.Keys {
+		if v := self.versionLocked(false, k); v > args.Since {
+			ret.Keys = append(ret.Keys, k)
+			if v > ret.Clock {
+				ret.Clock = v
+			}
+		}
+	}
+	for _, k := range args.Lists {
+		if v := self.versionLocked(true, k); v > args.Since {
+			ret.Lists = append(ret.Lists, k)
+			if v > ret.Clock {
+				ret.Clock = v
+			}
+		}
+	}
+
+	return len(ret.Keys)+len(ret.Lists) > 0
+}
+
+func (self *backend) Watch(args *WatchArgs, ret *WatchResult) error {
+	timeout := args.Timeout
+	if timeout <= 0 {
+		timeout = WATCH_TIMEOUT
+	}
+	if timeout > WATCH_MAX {
+		timeout = WATCH_MAX
+	}
+
+	// versions after Since are kept while we wait
+	self.wlock.Lock()
+	self.watches[args.Since]++
+	self.wlock.Unlock()
+	defer func() {
+		self.wlock.Lock()
+		if self.watches[args.Since]--; self.watches[args.Since] == 0 {
+			delete(self.watches, args.Since)
+		}
+		self.wlock.Unlock()
+	}()
+
+	deadline := self.sim.time().Add(timeout)
+	for {
+		self.wlock.Lock()
+		found := self.changed(args, ret)
+		wake := self.wake
+		self.wlock.Unlock()
+
+		if found {
+			return nil
+		}
+
+		left := deadline.Sub(self.sim.time())
+		if left <= 0 || !self.sim.wait(wake, left) {
+			return nil
+		}
+	}
+}